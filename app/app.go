@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"runtime"
+	"time"
 
 	"github.com/dimiro1/banner"
 	"github.com/mattn/go-colorable"
@@ -23,6 +25,34 @@ var (
 	BuildTime string
 )
 
+// StartTime process start time
+var StartTime = time.Now()
+
+// Build build information of the running binary
+type Build struct {
+	Version   string `json:"version"`
+	BuildTime string `json:"build_time"`
+	GitCommit string `json:"git_commit"`
+	GitBranch string `json:"git_branch"`
+	GitTag    string `json:"git_tag"`
+	GoVersion string `json:"go_version"`
+	Compiler  string `json:"compiler"`
+	Platform  string `json:"platform"`
+}
+
+func GetBuild() Build {
+	return Build{
+		Version:   Version,
+		BuildTime: BuildTime,
+		GitCommit: GitCommit,
+		GitBranch: GitBranch,
+		GitTag:    GitTag,
+		GoVersion: runtime.Version(),
+		Compiler:  runtime.Compiler,
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
+
 func BuildInfo() string {
 	info := map[string]string{}
 	info["Version"] = Version
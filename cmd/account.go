@@ -0,0 +1,428 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shumin1027/otpd/pkg/client"
+	"github.com/shumin1027/otpd/pkg/logger"
+	"github.com/shumin1027/otpd/pkg/otp"
+	"github.com/shumin1027/otpd/pkg/transfer"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var accountCmd = &cobra.Command{
+	Use:   "account",
+	Short: "Manage accounts",
+	Long: `Manage accounts of a running server with --remote, or of a stopped data path.
+Writes to a clustered server are forwarded to the leader.`,
+}
+
+// accountBackend 账户管理的两种方式：直接读写停止的数据目录，或调用运行中服务的admin接口
+type accountBackend interface {
+	Create(name string, groups []string) (*otp.Account, error)
+	List(f otp.Filter) ([]*otp.Account, string, error)
+	Show(name string) (*otp.Account, error)
+	Delete(name string) error
+	SetDisabled(name string, disabled bool) (*otp.Account, error)
+	Rekey(name string) (*otp.Account, error)
+	// Export and Import accounts with their secrets, see cmd/transfer.go
+	Export(group string, names []string) ([]transfer.Record, error)
+	Import(records []transfer.Record, opts transfer.Options) (*transfer.Result, error)
+	Preview(records []transfer.Record, policy transfer.Policy) (*transfer.Result, error)
+	Close() error
+}
+
+// openAccounts the backend selected by --remote
+func openAccounts() (accountBackend, error) {
+	if remote := conf.String("remote"); remote != "" {
+		c, err := newClient(remote)
+		if err != nil {
+			return nil, err
+		}
+		return &remoteAccounts{client: c}, nil
+	}
+	if err := setEncryption(); err != nil {
+		return nil, err
+	}
+	if err := otp.Init(conf.String("data.driver"), conf.String("data.path")); err != nil {
+		return nil, err
+	}
+	return localAccounts{}, nil
+}
+
+// withAccounts runs fn with the selected backend, exits on error
+func withAccounts(action string, fn func(accountBackend) error) {
+	b, err := openAccounts()
+	if err != nil {
+		logger.L().Fatal("open accounts", zap.Error(err))
+	}
+	err = fn(b)
+	if cerr := b.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		logger.L().Fatal(action, zap.Error(err))
+	}
+}
+
+type localAccounts struct{}
+
+func (localAccounts) Create(name string, groups []string) (*otp.Account, error) {
+	return otp.Create(name, groups)
+}
+
+func (localAccounts) List(f otp.Filter) ([]*otp.Account, string, error) {
+	return otp.List(f)
+}
+
+func (localAccounts) Show(name string) (*otp.Account, error) {
+	account, err := otp.Get(name)
+	if err == nil && account == nil {
+		err = otp.ErrNotFound
+	}
+	return account, err
+}
+
+func (localAccounts) Delete(name string) error {
+	return otp.Delete(name)
+}
+
+func (localAccounts) SetDisabled(name string, disabled bool) (*otp.Account, error) {
+	return otp.SetDisabled(name, disabled)
+}
+
+func (localAccounts) Rekey(name string) (*otp.Account, error) {
+	return otp.Rekey(name)
+}
+
+func (localAccounts) Close() error {
+	return otp.Storage().Close()
+}
+
+// remoteAccounts 调用admin接口，返回的账户不含密钥时OTP为空
+type remoteAccounts struct {
+	client *client.Client
+}
+
+func (r *remoteAccounts) call(method, path string, query url.Values, body, out interface{}) error {
+	return r.client.Call(context.Background(), method, path, query, body, out)
+}
+
+// accountPath the admin path of an account, followed by the action if any
+func accountPath(name, action string) string {
+	path := "/admin/accounts/" + url.PathEscape(name)
+	if action != "" {
+		path += "/" + action
+	}
+	return path
+}
+
+func (r *remoteAccounts) Create(name string, groups []string) (*otp.Account, error) {
+	var account otp.Account
+	body := map[string]interface{}{"name": name, "groups": groups}
+	return &account, r.call(http.MethodPost, "/admin/accounts", nil, body, &account)
+}
+
+func (r *remoteAccounts) List(f otp.Filter) ([]*otp.Account, string, error) {
+	query := url.Values{"limit": []string{strconv.Itoa(f.Limit)}}
+	if f.Group != "" {
+		query.Set("group", f.Group)
+	}
+	if f.Disabled != nil {
+		query.Set("disabled", strconv.FormatBool(*f.Disabled))
+	}
+	if !f.UnusedSince.IsZero() {
+		query.Set("unused_days", strconv.Itoa(int(time.Since(f.UnusedSince).Hours()/24)))
+	}
+	if f.Cursor != "" {
+		query.Set("cursor", f.Cursor)
+	}
+	var page struct {
+		Accounts []*otp.Account `json:"accounts"`
+		Next     string         `json:"next"`
+	}
+	err := r.call(http.MethodGet, "/admin/accounts", query, nil, &page)
+	return page.Accounts, page.Next, err
+}
+
+func (r *remoteAccounts) Show(name string) (*otp.Account, error) {
+	var account otp.Account
+	return &account, r.call(http.MethodGet, accountPath(name, ""), nil, nil, &account)
+}
+
+func (r *remoteAccounts) Delete(name string) error {
+	return r.call(http.MethodDelete, accountPath(name, ""), nil, nil, nil)
+}
+
+func (r *remoteAccounts) SetDisabled(name string, disabled bool) (*otp.Account, error) {
+	action := "enable"
+	if disabled {
+		action = "disable"
+	}
+	var account otp.Account
+	return &account, r.call(http.MethodPost, accountPath(name, action), nil, nil, &account)
+}
+
+func (r *remoteAccounts) Rekey(name string) (*otp.Account, error) {
+	var account otp.Account
+	return &account, r.call(http.MethodPost, accountPath(name, "rekey"), nil, nil, &account)
+}
+
+func (r *remoteAccounts) Close() error {
+	return nil
+}
+
+// accountOutput an account as printed, the key only when it was just generated
+type accountOutput struct {
+	Name       string    `json:"name"`
+	Disabled   bool      `json:"disabled"`
+	Groups     []string  `json:"groups,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	URL        string    `json:"url,omitempty"`
+	Secret     string    `json:"secret,omitempty"`
+}
+
+func newAccountOutput(a *otp.Account, withKey bool) (accountOutput, error) {
+	out := accountOutput{
+		Name:       a.Name,
+		Disabled:   a.Disabled,
+		Groups:     a.Groups,
+		CreatedAt:  a.CreatedAt,
+		UpdatedAt:  a.UpdatedAt,
+		LastUsedAt: a.LastUsedAt,
+	}
+	if withKey {
+		key, err := a.Key()
+		if err != nil {
+			return out, err
+		}
+		out.URL = key.URL()
+		out.Secret = key.Secret()
+	}
+	return out, nil
+}
+
+func outputJSON() bool {
+	return conf.String("output") == "json"
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+func printAccounts(list []*otp.Account) error {
+	if outputJSON() {
+		outs := make([]accountOutput, 0, len(list))
+		for _, a := range list {
+			out, _ := newAccountOutput(a, false)
+			outs = append(outs, out)
+		}
+		return printJSON(outs)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tDISABLED\tGROUPS\tCREATED\tLAST USED")
+	for _, a := range list {
+		fmt.Fprintf(w, "%s\t%t\t%s\t%s\t%s\n", a.Name, a.Disabled, strings.Join(a.Groups, ","), formatTime(a.CreatedAt), formatTime(a.LastUsedAt))
+	}
+	return w.Flush()
+}
+
+// printAccount prints one account, with its key and QR code when withKey is set
+func printAccount(a *otp.Account, withKey bool) error {
+	out, err := newAccountOutput(a, withKey)
+	if err != nil {
+		return err
+	}
+	if outputJSON() {
+		return printJSON(out)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", out.Name)
+	fmt.Fprintf(w, "Disabled:\t%t\n", out.Disabled)
+	fmt.Fprintf(w, "Groups:\t%s\n", strings.Join(out.Groups, ","))
+	fmt.Fprintf(w, "Created:\t%s\n", formatTime(out.CreatedAt))
+	fmt.Fprintf(w, "Updated:\t%s\n", formatTime(out.UpdatedAt))
+	fmt.Fprintf(w, "Last used:\t%s\n", formatTime(out.LastUsedAt))
+	if withKey {
+		fmt.Fprintf(w, "Secret:\t%s\n", out.Secret)
+		fmt.Fprintf(w, "URL:\t%s\n", out.URL)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if withKey && !conf.Bool("no-qr") {
+		code, err := otp.TerminalQRCode(out.URL)
+		if err != nil {
+			return err
+		}
+		fmt.Print("\n" + code)
+	}
+	return nil
+}
+
+var accountCreateCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "Create an account and print its key and QR code",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		withAccounts("create account", func(b accountBackend) error {
+			account, err := b.Create(args[0], conf.Strings("group"))
+			if err != nil {
+				return err
+			}
+			return printAccount(account, true)
+		})
+	},
+}
+
+var accountListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List accounts",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		f := otp.Filter{
+			Group:  conf.String("group"),
+			Limit:  conf.Int("limit"),
+			Cursor: conf.String("cursor"),
+		}
+		if cmd.Flags().Changed("disabled") {
+			disabled := conf.Bool("disabled")
+			f.Disabled = &disabled
+		}
+		if days := conf.Int("unused-days"); days > 0 {
+			f.UnusedSince = time.Now().AddDate(0, 0, -days)
+		}
+		withAccounts("list accounts", func(b accountBackend) error {
+			list, next, err := b.List(f)
+			if err != nil {
+				return err
+			}
+			if err := printAccounts(list); err != nil {
+				return err
+			}
+			if next != "" {
+				fmt.Fprintf(os.Stderr, "more accounts, continue with --cursor %s\n", next)
+			}
+			return nil
+		})
+	},
+}
+
+var accountShowCmd = &cobra.Command{
+	Use:   "show <name>",
+	Short: "Show an account without its secret",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		withAccounts("show account", func(b accountBackend) error {
+			account, err := b.Show(args[0])
+			if err != nil {
+				return err
+			}
+			return printAccount(account, false)
+		})
+	},
+}
+
+var accountDeleteCmd = &cobra.Command{
+	Use:   "delete <name>",
+	Short: "Delete an account",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		withAccounts("delete account", func(b accountBackend) error {
+			if err := b.Delete(args[0]); err != nil {
+				return err
+			}
+			fmt.Printf("account %s deleted\n", args[0])
+			return nil
+		})
+	},
+}
+
+// setDisabledCmd the disable and enable commands
+func setDisabledCmd(disabled bool) *cobra.Command {
+	action := "enable"
+	short := "Enable a disabled account"
+	if disabled {
+		action = "disable"
+		short = "Disable an account, its passcodes are rejected until enabled"
+	}
+	return &cobra.Command{
+		Use:   action + " <name>",
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			withAccounts(action+" account", func(b accountBackend) error {
+				account, err := b.SetDisabled(args[0], disabled)
+				if err != nil {
+					return err
+				}
+				return printAccount(account, false)
+			})
+		},
+	}
+}
+
+var accountRekeyCmd = &cobra.Command{
+	Use:   "rekey <name>",
+	Short: "Replace the secret of an account and print the new key and QR code",
+	Long: `Replace the secret of an account and print the new key and QR code,
+the authenticator enrolled with the previous key stops working.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		withAccounts("rekey account", func(b accountBackend) error {
+			account, err := b.Rekey(args[0])
+			if err != nil {
+				return err
+			}
+			return printAccount(account, true)
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(accountCmd)
+	cmds := []*cobra.Command{
+		accountCreateCmd, accountListCmd, accountShowCmd, accountDeleteCmd,
+		setDisabledCmd(true), setDisabledCmd(false), accountRekeyCmd,
+	}
+	for _, cmd := range cmds {
+		accountCmd.AddCommand(cmd)
+		flags := cmd.PersistentFlags()
+		flags.StringP("remote", "r", "", "manage the accounts of a running server, e.g: http://localhost:18181 or unix:///run/otpd.sock")
+		flags.StringP("output", "o", "table", "output format, support table and json")
+		addClientFlags(flags)
+		addDataFlags(flags)
+	}
+	for _, cmd := range []*cobra.Command{accountCreateCmd, accountRekeyCmd} {
+		cmd.PersistentFlags().BoolP("no-qr", "", false, "do not print the QR code")
+	}
+	accountCreateCmd.PersistentFlags().StringSliceP("group", "g", nil, "groups of the account")
+
+	flags := accountListCmd.PersistentFlags()
+	flags.StringP("group", "g", "", "only accounts in this group")
+	flags.BoolP("disabled", "", false, "only disabled accounts, --disabled=false for enabled ones")
+	flags.IntP("unused-days", "", 0, "only accounts not validated in this many days")
+	flags.IntP("limit", "", 100, "max accounts listed, up to 1000")
+	flags.StringP("cursor", "", "", "continue a previous list")
+}
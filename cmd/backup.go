@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shumin1027/otpd/pkg/backup"
+	"github.com/shumin1027/otpd/pkg/logger"
+	"github.com/shumin1027/otpd/pkg/store"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// headerBackupVersion see http.HeaderBackupVersion
+const headerBackupVersion = "X-Backup-Version"
+
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Back up the store to a file",
+	Long: `Back up the store to a file, from a running server with --remote or from a stopped data path.
+Use --since with the version printed by a previous backup for an incremental backup.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		file := conf.String("file")
+		if file == "" {
+			logger.L().Fatal("--file is required")
+		}
+		passphrase, err := readPassphrase(backupPassphraseEnv)
+		if err != nil {
+			logger.L().Fatal("read passphrase", zap.Error(err))
+		}
+
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			logger.L().Fatal("create backup file", zap.Error(err))
+		}
+		version, err := writeBackup(f, passphrase)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(file)
+			logger.L().Fatal("backup failed", zap.Error(err))
+		}
+		fmt.Printf("backup written to %s, use --since %d for the next incremental backup\n", file, version)
+	},
+}
+
+func writeBackup(w io.Writer, passphrase string) (uint64, error) {
+	since := uint64(conf.Int64("since"))
+	opts := backup.Options{
+		Driver:     store.DriverBadger,
+		Since:      since,
+		Compress:   conf.Bool("compress"),
+		Passphrase: passphrase,
+	}
+
+	if remote := conf.String("remote"); remote != "" {
+		c, err := newClient(remote)
+		if err != nil {
+			return 0, err
+		}
+		query := url.Values{"since": []string{strconv.FormatUint(since, 10)}}
+		resp, err := c.Do(context.Background(), http.MethodPost, "/admin/backup", query, nil)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			return 0, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		}
+		version, err := strconv.ParseUint(resp.Header.Get(headerBackupVersion), 10, 64)
+		if err != nil {
+			return 0, errors.Wrap(err, "invalid backup version header")
+		}
+		bw, err := backup.NewWriter(w, opts)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := io.Copy(bw, resp.Body); err != nil {
+			return 0, err
+		}
+		return version, bw.Close(version)
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+	b, ok := s.(store.Backuper)
+	if !ok {
+		return 0, fmt.Errorf("storage driver %s does not support backup", s.Driver())
+	}
+	opts.Driver = s.Driver()
+	bw, err := backup.NewWriter(w, opts)
+	if err != nil {
+		return 0, err
+	}
+	version, err := b.Backup(bw, since)
+	if err != nil {
+		return 0, err
+	}
+	return version, bw.Close(version)
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore a backup file into a stopped data path",
+	Long: `Restore a backup file into a stopped data path.
+Restore incremental backups in the order they were taken, after the full backup they are based on.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		file := conf.String("file")
+		if file == "" {
+			logger.L().Fatal("--file is required")
+		}
+		passphrase, err := readPassphrase(backupPassphraseEnv)
+		if err != nil {
+			logger.L().Fatal("read passphrase", zap.Error(err))
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			logger.L().Fatal("open backup file", zap.Error(err))
+		}
+		defer f.Close()
+
+		r, err := backup.NewReader(f, passphrase)
+		if err != nil {
+			logger.L().Fatal("read backup file", zap.Error(err))
+		}
+		s, err := openStore()
+		if err != nil {
+			logger.L().Fatal("open storage", zap.Error(err))
+		}
+		defer s.Close()
+		b, ok := s.(store.Backuper)
+		if !ok {
+			logger.L().Fatal("storage driver does not support restore", zap.String("driver", s.Driver()))
+		}
+		if err := b.Load(r); err != nil {
+			logger.L().Fatal("restore failed", zap.Error(err))
+		}
+		fmt.Printf("restored %s (since %d, version %d)\n", file, r.Header.Since, r.Version())
+	},
+}
+
+// backupPassphraseEnv the environment variable of the passphrase of backups
+const backupPassphraseEnv = "OTPD_BACKUP_PASSPHRASE"
+
+// readPassphrase reads the passphrase from --passphrase-file or the environment variable env
+func readPassphrase(env string) (string, error) {
+	if file := conf.String("passphrase-file"); file != "" {
+		buf, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(buf), "\r\n"), nil
+	}
+	return os.Getenv(env), nil
+}
+
+func init() {
+	rootCmd.AddCommand(backupCmd)
+	flags := backupCmd.PersistentFlags()
+	flags.StringP("file", "f", "", "backup file to write, must not exist")
+	flags.Int64P("since", "", 0, "only back up entries newer than this version, 0 for a full backup")
+	flags.BoolP("compress", "z", false, "gzip compress the backup")
+	flags.StringP("passphrase-file", "", "", "encrypt the backup with the passphrase in this file, or set OTPD_BACKUP_PASSPHRASE")
+	flags.StringP("remote", "r", "", "back up a running server, e.g: http://localhost:18181")
+	addClientFlags(flags)
+	addDataFlags(flags)
+
+	rootCmd.AddCommand(restoreCmd)
+	flags = restoreCmd.PersistentFlags()
+	flags.StringP("file", "f", "", "backup file to restore")
+	flags.StringP("passphrase-file", "", "", "passphrase of an encrypted backup, or set OTPD_BACKUP_PASSPHRASE")
+	addDataFlags(flags)
+}
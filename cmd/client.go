@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"github.com/shumin1027/otpd/pkg/client"
+	"github.com/spf13/pflag"
+)
+
+// addClientFlags adds the flags to reach a running server
+func addClientFlags(flags *pflag.FlagSet) {
+	flags.StringP("remote.ca", "", "", "ca bundle to verify the server certificate")
+	flags.StringP("remote.cert", "", "", "client certificate for mutual tls")
+	flags.StringP("remote.key", "", "", "client private key for mutual tls")
+	flags.BoolP("remote.insecure", "", false, "skip server certificate verification")
+	flags.StringP("remote.user", "", "", "basic auth username")
+	flags.StringP("remote.password", "", "", "basic auth password")
+	flags.StringP("remote.token", "", "", "bearer token")
+	flags.DurationP("remote.timeout", "", 0, "request timeout, default to 10s")
+	skipFingerprint(flags, "remote.ca", "remote.cert", "remote.key", "remote.user", "remote.password", "remote.token")
+}
+
+// newClient creates a client for the server at url from the remote.* flags
+func newClient(url string) (*client.Client, error) {
+	return client.New(clientConfig(url))
+}
+
+// clientConfig the client config from the remote.* flags
+func clientConfig(url string) client.Config {
+	return client.Config{
+		URL:      url,
+		CAFile:   conf.String("remote.ca"),
+		CertFile: conf.String("remote.cert"),
+		KeyFile:  conf.String("remote.key"),
+		Insecure: conf.Bool("remote.insecure"),
+		Username: conf.String("remote.user"),
+		Password: conf.String("remote.password"),
+		Token:    conf.String("remote.token"),
+		Timeout:  conf.Duration("remote.timeout"),
+	}
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+
+	"github.com/shumin1027/otpd/pkg/cluster"
+	"github.com/shumin1027/otpd/pkg/logger"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var clusterCmd = &cobra.Command{
+	Use:   "cluster",
+	Short: "Manage the members of a clustered otpd",
+	Long: `Manage the members of a clustered otpd through any running node,
+membership changes are forwarded to the leader.`,
+}
+
+var clusterStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the raft state and the members of the cluster",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var status cluster.Status
+		if err := callCluster(http.MethodGet, "/admin/cluster", nil, nil, &status); err != nil {
+			logger.L().Fatal("cluster status", zap.Error(err))
+		}
+		printClusterStatus(status)
+	},
+}
+
+var clusterJoinCmd = &cobra.Command{
+	Use:   "join <id> <raft-address> [http-url]",
+	Short: "Add a node to the cluster",
+	Long: `Add a node to the cluster as a voter, the node must be running with cluster.bind set.
+http-url is where writes are forwarded when the node becomes the leader.`,
+	Args: cobra.RangeArgs(2, 3),
+	Run: func(cmd *cobra.Command, args []string) {
+		req := map[string]string{"id": args[0], "address": args[1]}
+		if len(args) == 3 {
+			req["http"] = args[2]
+		}
+		var status cluster.Status
+		if err := callCluster(http.MethodPost, "/admin/cluster/join", nil, req, &status); err != nil {
+			logger.L().Fatal("join cluster", zap.Error(err))
+		}
+		printClusterStatus(status)
+	},
+}
+
+var clusterRemoveCmd = &cobra.Command{
+	Use:   "remove <id>",
+	Short: "Remove a node from the cluster",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var status cluster.Status
+		query := url.Values{"id": []string{args[0]}}
+		if err := callCluster(http.MethodPost, "/admin/cluster/remove", query, nil, &status); err != nil {
+			logger.L().Fatal("remove from cluster", zap.Error(err))
+		}
+		printClusterStatus(status)
+	},
+}
+
+func callCluster(method, path string, query url.Values, body, out interface{}) error {
+	c, err := newClient(conf.String("remote"))
+	if err != nil {
+		return err
+	}
+	return c.Call(context.Background(), method, path, query, body, out)
+}
+
+func printClusterStatus(status cluster.Status) {
+	fmt.Printf("node %s is %s, leader %s, applied index %d\n", status.ID, status.State, status.Leader, status.AppliedIndex)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tADDRESS\tHTTP\tVOTER\tLEADER")
+	for _, srv := range status.Servers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%t\n", srv.ID, srv.Address, srv.HTTP, srv.Voter, srv.Leader)
+	}
+	w.Flush()
+}
+
+func init() {
+	rootCmd.AddCommand(clusterCmd)
+	for _, cmd := range []*cobra.Command{clusterStatusCmd, clusterJoinCmd, clusterRemoveCmd} {
+		clusterCmd.AddCommand(cmd)
+		flags := cmd.PersistentFlags()
+		flags.StringP("remote", "r", "http://127.0.0.1:18181", "any node of the cluster, e.g: https://otpd-1:18181 or unix:///run/otpd.sock")
+		addClientFlags(flags)
+	}
+}
@@ -0,0 +1,233 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shumin1027/otpd/pkg/logger"
+	"github.com/shumin1027/otpd/pkg/otp"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var codeCmd = &cobra.Command{
+	Use:   "code",
+	Short: "Generate and verify one-time passwords locally, compatible with oathtool",
+	Long: `Generate and verify HOTP and TOTP codes without a server, the flags follow oathtool.
+KEY is a hex secret, a base32 secret with -b, or an otpauth:// URI whose parameters
+are used unless overridden by flags. KEY "-" reads it from stdin.`,
+}
+
+var codeGenerateCmd = &cobra.Command{
+	Use:   "generate KEY",
+	Short: "Print the codes of the current time step or counter, and the following --window ones",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		p, first := codeParams(cmd, args[0])
+		window := uint64(conf.Int("window"))
+		for c := first; c <= first+window; c++ {
+			code, err := p.Code(c)
+			if err != nil {
+				logger.L().Fatal("generate code", zap.Error(err))
+			}
+			fmt.Println(code)
+		}
+	},
+}
+
+var codeVerifyCmd = &cobra.Command{
+	Use:   "verify KEY CODE",
+	Short: "Verify a code and print its position in the window",
+	Long: `Verify a code and print its position like oathtool: the offset from --counter for HOTP,
+searched up to --window counters ahead, or the offset from the current time step for TOTP,
+searched --window steps before and after. Exits with status 1 if not found.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		p, current := codeParams(cmd, args[0])
+		window := uint64(conf.Int("window"))
+		first, last := current, current+window
+		if p.TOTP {
+			first = current - window
+			if window > current {
+				first = 0
+			}
+		}
+		found, ok, err := p.Verify(args[1], first, last)
+		if err != nil {
+			logger.L().Fatal("verify code", zap.Error(err))
+		}
+		if !ok {
+			fmt.Fprintf(os.Stderr, "otpd: password \"%s\" not found in range %d .. %d\n", args[1], first, last)
+			os.Exit(1)
+		}
+		fmt.Println(int64(found) - int64(current))
+	},
+}
+
+// codeParams the code parameters from KEY and the flags, with the current counter or time step
+func codeParams(cmd *cobra.Command, key string) (otp.CodeParams, uint64) {
+	p, err := readCodeKey(key)
+	if err != nil {
+		logger.L().Fatal("read key", zap.Error(err))
+	}
+	flags := cmd.Flags()
+	if flags.Changed("totp") {
+		p.TOTP = true
+		// 不带值的--totp保留URI中的算法，没有时为sha1
+		if algorithm := conf.String("totp"); algorithm != totpDefault {
+			if p.Algorithm, err = otp.ParseAlgorithm(algorithm); err != nil {
+				logger.L().Fatal("invalid --totp", zap.Error(err))
+			}
+		}
+	}
+	if flags.Changed("hotp") {
+		p.TOTP = false
+	}
+	if flags.Changed("digits") {
+		p.Digits = conf.Int("digits")
+	}
+	if flags.Changed("counter") {
+		p.Counter = uint64(conf.Int64("counter"))
+	}
+	if flags.Changed("time-step-size") {
+		if p.Period, err = parseStepSize(conf.String("time-step-size")); err != nil {
+			logger.L().Fatal("invalid --time-step-size", zap.Error(err))
+		}
+	}
+	if flags.Changed("start-time") {
+		if p.Start, err = parseCodeTime(conf.String("start-time")); err != nil {
+			logger.L().Fatal("invalid --start-time", zap.Error(err))
+		}
+	}
+	now := time.Now()
+	if flags.Changed("now") {
+		if now, err = parseCodeTime(conf.String("now")); err != nil {
+			logger.L().Fatal("invalid --now", zap.Error(err))
+		}
+	}
+
+	current := p.Counter
+	if p.TOTP {
+		step := p.Step(now)
+		if step < 0 {
+			logger.L().Fatal("current time is before the start time")
+		}
+		current = uint64(step)
+	}
+	if conf.Bool("verbose") {
+		printCodeParams(p, now, current)
+	}
+	return p, current
+}
+
+// readCodeKey decodes KEY, the defaults follow oathtool: HOTP with a hex secret
+func readCodeKey(key string) (otp.CodeParams, error) {
+	if key == "-" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return otp.CodeParams{}, err
+		}
+		key = strings.TrimSpace(line)
+	}
+	if strings.HasPrefix(key, "otpauth://") {
+		return otp.ParseCodeURL(key)
+	}
+	p := otp.DefaultCodeParams()
+	p.TOTP = false
+	var err error
+	if conf.Bool("base32") {
+		p.Key, err = otp.ParseKey(key)
+	} else {
+		p.Key, err = otp.ParseHexKey(key)
+	}
+	return p, err
+}
+
+// parseStepSize parses a duration, plain numbers are seconds like in oathtool
+func parseStepSize(s string) (time.Duration, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		s = strconv.Itoa(n) + "s"
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < time.Second {
+		return 0, fmt.Errorf("time step must be at least one second")
+	}
+	return d, nil
+}
+
+// totpDefault value of a bare --totp
+const totpDefault = "default"
+
+// codeTimeLayouts layouts accepted by --now and --start-time, besides @unix-seconds
+var codeTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05 MST",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// parseCodeTime parses now, @unix-seconds or a date, dates without a zone are in UTC
+func parseCodeTime(s string) (time.Time, error) {
+	if s == "now" {
+		return time.Now(), nil
+	}
+	if strings.HasPrefix(s, "@") {
+		sec, err := strconv.ParseInt(s[1:], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(sec, 0), nil
+	}
+	for _, layout := range codeTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unsupported time %q, use now, @unix-seconds, RFC 3339 or \"YYYY-MM-DD hh:mm:ss UTC\"", s)
+}
+
+// printCodeParams prints the parameters like oathtool --verbose
+func printCodeParams(p otp.CodeParams, now time.Time, current uint64) {
+	const layout = "2006-01-02 15:04:05 UTC"
+	fmt.Printf("Hex secret: %s\n", hex.EncodeToString(p.Key))
+	fmt.Printf("Base32 secret: %s\n", base32.StdEncoding.EncodeToString(p.Key))
+	fmt.Printf("Digits: %d\n", p.Digits)
+	fmt.Printf("Window size: %d\n", conf.Int("window"))
+	if p.TOTP {
+		fmt.Printf("TOTP mode: %s\n", p.Algorithm)
+		fmt.Printf("Step size (seconds): %d\n", int64(p.Period/time.Second))
+		fmt.Printf("Start time: %s (%d)\n", p.Start.UTC().Format(layout), p.Start.Unix())
+		fmt.Printf("Current time: %s (%d)\n", now.UTC().Format(layout), now.Unix())
+		fmt.Printf("Counter: 0x%X (%d)\n\n", current, current)
+		return
+	}
+	fmt.Printf("Start counter: 0x%X (%d)\n\n", current, current)
+}
+
+func init() {
+	rootCmd.AddCommand(codeCmd)
+	for _, cmd := range []*cobra.Command{codeGenerateCmd, codeVerifyCmd} {
+		codeCmd.AddCommand(cmd)
+		flags := cmd.PersistentFlags()
+		flags.StringP("totp", "", "", "use time based codes, with the hmac algorithm sha1, sha256 or sha512, default to the algorithm of a totp uri or sha1")
+		flags.Lookup("totp").NoOptDefVal = totpDefault
+		flags.BoolP("hotp", "", false, "use counter based codes, the default unless KEY is a totp uri")
+		flags.BoolP("base32", "b", false, "KEY is base32 instead of hex")
+		flags.IntP("digits", "d", 6, "number of digits of the codes")
+		flags.Int64P("counter", "c", 0, "HOTP counter")
+		flags.StringP("time-step-size", "s", "30s", "TOTP time step, e.g: 30s or 1m")
+		flags.StringP("start-time", "S", "1970-01-01 00:00:00 UTC", "when TOTP time steps start")
+		flags.StringP("now", "N", "now", "use this time as the current time, e.g: @1234567890 or \"2009-02-13 23:31:30 UTC\"")
+		flags.IntP("window", "w", 0, "generate this many more codes, or verify in this many more steps")
+		flags.BoolP("verbose", "v", false, "print the parameters")
+	}
+}
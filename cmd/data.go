@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/shumin1027/otpd/pkg/badger"
+	"github.com/shumin1027/otpd/pkg/otp"
+	"github.com/shumin1027/otpd/pkg/store"
+	"github.com/spf13/pflag"
+)
+
+// addDataFlags adds the flags selecting the storage
+func addDataFlags(flags *pflag.FlagSet) {
+	flags.StringP("data.path", "d", "", "data path, badger runs in memory when empty")
+	flags.StringP("data.driver", "", "badger", "storage driver, support badger, bolt and memory")
+	flags.StringP("data.encryption-key-file", "", "", "encrypt the badger data with the key in this file, 16, 24 or 32 bytes as hex, base64 or raw, or set OTPD_DATA_ENCRYPTION_KEY, not supported with cluster.bind")
+	flags.DurationP("data.encryption-rotation", "", 0, "how often a new data key is generated when encrypted, default to 10 days")
+	skipFingerprint(flags, "data.path", "data.encryption-key-file")
+}
+
+// readEncryptionKey reads the key from --data.encryption-key-file or OTPD_DATA_ENCRYPTION_KEY, nil if neither is set
+func readEncryptionKey() ([]byte, error) {
+	var data []byte
+	if file := conf.String("data.encryption-key-file"); file != "" {
+		buf, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		data = buf
+	} else if env := os.Getenv("OTPD_DATA_ENCRYPTION_KEY"); env != "" {
+		data = []byte(env)
+	} else {
+		return nil, nil
+	}
+	return badger.ParseKey(data)
+}
+
+// setEncryption configures the encryption of the stores opened by otp.Open
+func setEncryption() error {
+	key, err := readEncryptionKey()
+	if err != nil {
+		return err
+	}
+	otp.SetEncryption(badger.Encryption{
+		Key:              key,
+		RotationDuration: conf.Duration("data.encryption-rotation"),
+	})
+	return nil
+}
+
+// openStore opens the storage selected by the data.* flags,
+// the server must not be running on the same data path
+func openStore() (store.Store, error) {
+	if err := setEncryption(); err != nil {
+		return nil, err
+	}
+	return otp.Open(conf.String("data.driver"), conf.String("data.path"))
+}
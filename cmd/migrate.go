@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/shumin1027/otpd/pkg/logger"
+	"github.com/shumin1027/otpd/pkg/otp"
+	"github.com/shumin1027/otpd/pkg/schema"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Upgrade all stored records to the current schema version",
+	Long: `Upgrade all stored records of a stopped data path to the current schema version.
+Records are also upgraded one by one when read, migrate rewrites them all at once.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		s, err := openStore()
+		if err != nil {
+			logger.L().Fatal("open storage", zap.Error(err))
+		}
+		defer s.Close()
+
+		stored, err := schema.StoredVersion(s)
+		if err != nil {
+			logger.L().Fatal("read schema version", zap.Error(err))
+		}
+		current := otp.SchemaVersion()
+		if stored > current {
+			logger.L().Fatal("database was written by a newer otpd", zap.Int("version", stored), zap.Int("supported", current))
+		}
+
+		if err := otp.SetStore(s); err != nil {
+			logger.L().Fatal("open accounts", zap.Error(err))
+		}
+		dryRun := conf.Bool("dry-run")
+		result, err := otp.Migrate(dryRun)
+		if err != nil {
+			logger.L().Fatal("migrate failed", zap.Error(err), zap.Int("upgraded", result.Upgraded), zap.Int("failed", result.Failed))
+		}
+		if dryRun {
+			fmt.Printf("schema version %d -> %d, %d of %d records would be upgraded\n", stored, current, result.Upgraded, result.Total)
+			return
+		}
+		fmt.Printf("schema version %d -> %d, %d of %d records upgraded\n", stored, current, result.Upgraded, result.Total)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+	flags := migrateCmd.PersistentFlags()
+	flags.BoolP("dry-run", "n", false, "only report the records to upgrade")
+	addDataFlags(flags)
+}
@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"os"
 
 	"github.com/shumin1027/otpd/pkg/logger"
@@ -39,6 +42,37 @@ func Execute() {
 	}
 }
 
+// fingerprintSkip annotation of the flags left out of Fingerprint
+const fingerprintSkip = "fingerprint-skip"
+
+// skipFingerprint leaves flags out of Fingerprint: credentials, key files and paths, since the hash
+// is public and could be brute forced, and settings that differ per node such as addresses.
+func skipFingerprint(flags *pflag.FlagSet, names ...string) {
+	for _, name := range names {
+		if err := flags.SetAnnotation(name, fingerprintSkip, []string{"true"}); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Fingerprint returns a short hash of the settings of all flags but the skipped ones,
+// used to tell whether two servers run with the same settings.
+func Fingerprint(conf *koanf.Koanf, flags *pflag.FlagSet) string {
+	settings := map[string]interface{}{}
+	flags.VisitAll(func(f *pflag.Flag) {
+		if _, skip := f.Annotations[fingerprintSkip]; !skip {
+			settings[f.Name] = conf.Get(f.Name)
+		}
+	})
+	// json.Marshal对map的key排序，结果稳定
+	buf, err := json.Marshal(settings)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:8])
+}
+
 func BindPflags(conf *koanf.Koanf, flags *pflag.FlagSet) {
 	provider := posflag.Provider(flags, ".", conf)
 	if err := conf.Load(provider, nil); err != nil {
@@ -1,19 +1,41 @@
 package cmd
 
 import (
+	"context"
+	gotls "crypto/tls"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
+	"github.com/shumin1027/otpd/app"
 	"github.com/shumin1027/otpd/http"
+	"github.com/shumin1027/otpd/pkg/badger"
+	"github.com/shumin1027/otpd/pkg/client"
+	"github.com/shumin1027/otpd/pkg/cluster"
+	"github.com/shumin1027/otpd/pkg/lifecycle"
 	"github.com/shumin1027/otpd/pkg/logger"
 	"github.com/shumin1027/otpd/pkg/otp"
+	"github.com/shumin1027/otpd/pkg/peercred"
+	"github.com/shumin1027/otpd/pkg/replication"
+	"github.com/shumin1027/otpd/pkg/tls"
 	"github.com/spf13/cobra"
+	"go.uber.org/zap"
 )
 
+// lc stops the server components on shutdown
+var lc *lifecycle.Manager
+
 var startCmd = &cobra.Command{
 	Use:   "start",
 	Short: "Start otp server",
 	Long:  `Start otp server`,
 	PreRun: func(cmd *cobra.Command, args []string) {
+		// 只在启动服务时打印，其他子命令的输出可能被脚本解析
+		app.PrintBanner()
+
 		logger.SetGlobal(logger.Config{
 			Filenames:  conf.Strings("log.path"),
 			MaxSize:    conf.Int("log.maxsize"),
@@ -25,23 +47,253 @@ var startCmd = &cobra.Command{
 			Encoder:    conf.String("log.format"),
 		})
 
-		otp.Init(conf.String("data.path"))
+		lc = lifecycle.New(conf.Duration("shutdown.timeout"), logger.L())
+
+		if err := setEncryption(); err != nil {
+			logger.L().Fatal("read encryption key", zap.Error(err))
+		}
+		if err := otp.Init(conf.String("data.driver"), conf.String("data.path")); err != nil {
+			logger.L().Fatal("open storage", zap.Error(err))
+		}
+		// store最先打开，最后关闭，确保memtable刷盘并释放LOCK文件
+		lc.Register("store", func(ctx context.Context) error {
+			return otp.Storage().Close()
+		})
+
+		// badger要求ratio在(0,1)之间，否则每次gc都会失败
+		if ratio := conf.Float64("gc.discard-ratio"); ratio <= 0 || ratio >= 1 {
+			logger.L().Fatal("gc.discard-ratio must be between 0 and 1", zap.Float64("discard_ratio", ratio))
+		}
+		// 定期回收value log，磁盘模式的badger才需要
+		if stor, ok := otp.Storage().(*badger.Store); ok && stor.Dir() != "" && conf.Duration("gc.interval") > 0 {
+			m := badger.NewMaintenance(stor, conf.Duration("gc.interval"), conf.Float64("gc.discard-ratio"), logger.L())
+			m.Start()
+			lc.Register("maintenance", m.Stop)
+		}
+
+		otp.SetGuard(otp.GuardConfig{
+			MaxFailures:     conf.Int("lockout.max-failures"),
+			LockoutDuration: conf.Duration("lockout.duration"),
+			ReplayWindow:    conf.Duration("replay.window"),
+		})
+
+		// 集群模式下写入经raft日志提交后应用到每个节点的badger
+		if bind := conf.String("cluster.bind"); bind != "" {
+			if conf.String("replication.leader") != "" {
+				logger.L().Fatal("cluster.bind and replication.leader can not be used together")
+			}
+			local, ok := otp.Storage().(*badger.Store)
+			if !ok {
+				logger.L().Fatal("clustered mode requires the badger driver")
+			}
+			// 加密只覆盖badger目录，raft日志和快照中的账户是明文
+			if key, _ := readEncryptionKey(); key != nil {
+				logger.L().Fatal("the encryption key does not cover the raft log and snapshots in cluster.dir, clustered mode can not be used with data encryption")
+			}
+			cfg := clusterConfig(bind)
+			if err := clusterTLS(&cfg); err != nil {
+				logger.L().Fatal("load cluster tls, set cluster.tls.cert, cluster.tls.key and cluster.tls.ca, or cluster.insecure", zap.Error(err))
+			}
+			node, err := cluster.New(cfg, local, logger.L())
+			if err != nil {
+				logger.L().Fatal("start cluster node", zap.Error(err))
+			}
+			if err := otp.SetStore(node.Store()); err != nil {
+				logger.L().Fatal("open clustered storage", zap.Error(err))
+			}
+		}
+
+		// follower从leader拉取变更，本地只读
+		if leader := conf.String("replication.leader"); leader != "" {
+			c, err := newClient(leader)
+			if err != nil {
+				logger.L().Fatal("create leader client", zap.Error(err))
+			}
+			f, err := replication.NewFollower(replication.Config{
+				Leader:   leader,
+				Interval: conf.Duration("replication.interval"),
+			}, otp.Storage(), c, logger.L())
+			if err != nil {
+				logger.L().Fatal("start replication", zap.Error(err))
+			}
+			f.Start()
+			lc.Register("replication", f.Stop)
+		}
 
+		// 缓存在最终的store上启用，通过变更订阅失效
+		stopCache, err := otp.EnableCache(otp.CacheConfig{
+			MaxEntries: conf.Int64("cache.size"),
+			TTL:        conf.Duration("cache.ttl"),
+		})
+		if err != nil {
+			logger.L().Fatal("create account cache", zap.Error(err))
+		}
+		lc.Register("cache", stopCache)
 	},
 	Run: func(cmd *cobra.Command, args []string) {
+		mode, err := strconv.ParseUint(conf.String("unix.mode"), 8, 32)
+		if err != nil {
+			logger.L().Fatal("invalid unix socket mode", zap.Error(err))
+		}
+		uids := make([]uint32, 0)
+		for _, uid := range conf.Ints("unix.trusted-uids") {
+			uids = append(uids, uint32(uid))
+		}
+
 		bind := conf.String("bind")
 		port := conf.Int("port")
 		addr := fmt.Sprintf("%s:%d", bind, port)
-		http.Start(addr)
+		var forwardTLS *gotls.Config
+		if conf.String("cluster.bind") != "" {
+			forwardTLS, err = client.TLSConfig(clientConfig(""))
+			if err != nil {
+				logger.L().Fatal("load cluster forwarding tls", zap.Error(err))
+			}
+		}
+		err = http.Start(http.Config{
+			Addr: addr,
+			TLS: tls.Config{
+				CertFile:       conf.String("tls.cert"),
+				KeyFile:        conf.String("tls.key"),
+				ClientCAFile:   conf.String("tls.client-ca"),
+				ClientAuth:     conf.String("tls.client-auth"),
+				ReloadInterval: conf.Duration("tls.reload-interval"),
+			},
+			TLSIdentity: conf.String("tls.identity"),
+			DisableTCP:  conf.Bool("tcp.disable"),
+			Unix: peercred.Config{
+				Path:  conf.String("unix.path"),
+				Mode:  os.FileMode(mode),
+				Owner: conf.String("unix.owner"),
+				Group: conf.String("unix.group"),
+			},
+			TrustedUIDs: uids,
+			AdminUsers:  conf.Strings("admin.users"),
+			JWTKeyFile:  conf.String("auth.jwt-key-file"),
+			ForwardTLS:  forwardTLS,
+			MinFreeDisk: uint64(conf.Int64("health.min-free-mb")) << 20,
+			Fingerprint: Fingerprint(conf, cmd.PersistentFlags()),
+		})
+		if err != nil {
+			lc.Shutdown()
+			logger.L().Fatal("start server", zap.Error(err))
+		}
+		lc.Register("http", http.Shutdown)
+
+		sig := lifecycle.WaitSignal()
+		logger.L().Info("shutdown server ...", zap.String("signal", sig.String()))
+		if err := lc.Shutdown(); err != nil {
+			logger.L().Error("server exited with errors", zap.Error(err))
+			os.Exit(1)
+		}
+		logger.L().Info("server exiting")
 	},
 }
 
+// clusterConfig builds the raft config from the cluster.* flags
+func clusterConfig(bind string) cluster.Config {
+	cfg := cluster.Config{
+		ID:           conf.String("cluster.id"),
+		Bind:         bind,
+		Advertise:    conf.String("cluster.advertise"),
+		HTTP:         conf.String("cluster.http"),
+		Dir:          conf.String("cluster.dir"),
+		Bootstrap:    conf.Bool("cluster.bootstrap"),
+		ApplyTimeout: conf.Duration("cluster.apply-timeout"),
+	}
+	if cfg.ID == "" {
+		cfg.ID, _ = os.Hostname()
+	}
+	if cfg.Advertise == "" {
+		cfg.Advertise = bind
+	}
+	if cfg.Dir == "" {
+		cfg.Dir = filepath.Clean(conf.String("data.path")) + ".raft"
+	}
+	if cfg.HTTP == "" {
+		scheme := "http"
+		if conf.String("tls.cert") != "" {
+			scheme = "https"
+		}
+		host, _, _ := net.SplitHostPort(cfg.Advertise)
+		cfg.HTTP = fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, strconv.Itoa(conf.Int("port"))))
+	}
+	return cfg
+}
+
+// clusterTLS loads the mutual tls of the raft transport from the cluster.tls.* flags
+func clusterTLS(cfg *cluster.Config) error {
+	if conf.Bool("cluster.insecure") {
+		cfg.Insecure = true
+		logger.L().Warn("the raft transport is plaintext and unauthenticated, use it only on a trusted network")
+		return nil
+	}
+	reloader, err := tls.NewReloader(tls.Config{
+		CertFile:       conf.String("cluster.tls.cert"),
+		KeyFile:        conf.String("cluster.tls.key"),
+		ClientCAFile:   conf.String("cluster.tls.ca"),
+		ClientAuth:     tls.ClientAuthRequireAndVerify,
+		ReloadInterval: conf.Duration("tls.reload-interval"),
+	})
+	if err != nil {
+		return err
+	}
+	reloader.OnReload = func() {
+		logger.L().Info("cluster tls certificate reloaded", zap.String("cert", conf.String("cluster.tls.cert")))
+	}
+	reloader.OnError = func(err error) {
+		logger.L().Error("cluster tls certificate reload failed", zap.Error(err))
+	}
+	if cfg.ClientTLS, err = reloader.PeerConfig(); err != nil {
+		return err
+	}
+	cfg.ServerTLS = reloader.ServerConfig()
+	return nil
+}
+
 func init() {
 	rootCmd.AddCommand(startCmd)
 	flags := startCmd.PersistentFlags()
 	flags.IntP("port", "p", 18181, "web listening port")
 	flags.StringP("bind", "b", "0.0.0.0", "bind ip addr")
-	flags.StringP("data.path", "d", "", "data path")
+	flags.BoolP("tcp.disable", "", false, "disable the tcp listener, serve only on the unix socket")
+	flags.StringP("unix.path", "", "", "unix socket path, listen on it alongside tcp when set")
+	flags.StringP("unix.mode", "", "0660", "unix socket file mode")
+	flags.StringP("unix.owner", "", "", "unix socket file owner, user name or uid")
+	flags.StringP("unix.group", "", "", "unix socket file group, group name or gid")
+	flags.IntSliceP("unix.trusted-uids", "", []int{0}, "unix socket peers with these uids are authenticated as their local user")
+	flags.StringSliceP("admin.users", "", []string{"root"}, "users allowed to call the admin APIs")
+	flags.StringP("auth.jwt-key-file", "", "", "file holding the HS256 key verifying Bearer tokens, at least 32 bytes, Bearer is refused when not set")
+	addDataFlags(flags)
+	flags.DurationP("shutdown.timeout", "", 10*time.Second, "time each component is given to stop on shutdown")
+	flags.IntP("lockout.max-failures", "", 0, "failed validations before an account is locked, 0 disables lockout, note that anyone who knows an account name can lock it")
+	flags.DurationP("lockout.duration", "", 15*time.Minute, "how long failures are counted and an account stays locked")
+	flags.DurationP("replay.window", "", 90*time.Second, "how long a used passcode is rejected, 0 disables replay protection")
+	flags.StringP("replication.leader", "", "", "follow the leader at this url and serve validations read-only, e.g: https://otpd-1:18181")
+	flags.DurationP("replication.interval", "", time.Second, "how often changes are pulled from the leader")
+	flags.StringP("cluster.bind", "", "", "raft listening address, enables clustered mode when set, e.g: 0.0.0.0:18182")
+	flags.StringP("cluster.advertise", "", "", "raft address other nodes connect to, default to cluster.bind")
+	flags.StringP("cluster.id", "", "", "unique node name in the cluster, default to the hostname")
+	flags.StringP("cluster.http", "", "", "url other nodes forward writes to, default to http(s)://<advertise host>:<port>")
+	flags.StringP("cluster.dir", "", "", "raft log and snapshot directory, default to <data.path>.raft")
+	flags.BoolP("cluster.bootstrap", "", false, "form a single node cluster on first start, other nodes join it")
+	flags.DurationP("cluster.apply-timeout", "", 5*time.Second, "how long a write waits to be committed by the cluster")
+	flags.StringP("cluster.tls.cert", "", "", "certificate of this node for the raft transport, valid for both server and client auth")
+	flags.StringP("cluster.tls.key", "", "", "private key of cluster.tls.cert")
+	flags.StringP("cluster.tls.ca", "", "", "ca bundle dedicated to the cluster, every certificate it issues is accepted as a node")
+	flags.BoolP("cluster.insecure", "", false, "use a plaintext unauthenticated raft transport, only on a trusted network")
+	addClientFlags(flags)
+	flags.Int64P("cache.size", "", 10000, "accounts kept decoded in memory for validation, 0 disables the cache")
+	flags.DurationP("cache.ttl", "", 5*time.Minute, "how long an account stays cached, bounds staleness when the store can not be watched")
+	flags.DurationP("gc.interval", "", 10*time.Minute, "value log gc interval, 0 disables it")
+	flags.Float64P("gc.discard-ratio", "", 0.5, "rewrite value log files with at least this ratio of stale data")
+	flags.Int64P("health.min-free-mb", "", 100, "readiness fails when the data path has less free megabytes")
+	flags.StringP("tls.cert", "", "", "tls certificate file, serve https when set")
+	flags.StringP("tls.key", "", "", "tls private key file")
+	flags.StringP("tls.client-ca", "", "", "ca bundle to verify client certificates, enable mutual tls when set")
+	flags.StringP("tls.client-auth", "", "", "client certificate policy, support none, request, require, verify-if-given and require-and-verify")
+	flags.StringP("tls.identity", "", "cn", "client certificate field mapped to username, support cn, san-dns, san-email (the full address) and san-uri")
+	flags.DurationP("tls.reload-interval", "", 30*time.Second, "interval to check tls files for changes, 0 disables reloading")
 	flags.StringSliceP("log.path", "", []string{"stderr"}, "log path, support stdout, stderr and file")
 	flags.IntP("log.maxsize", "", 100, "log file size megabytes")
 	flags.IntP("log.maxage", "", 90, "log file retain days")
@@ -50,4 +302,8 @@ func init() {
 	flags.BoolP("log.compress", "", false, "log file rotate compress")
 	flags.StringP("log.level", "", "info", "log level, support debug, info, warn, error, dpanic, panic, fatal")
 	flags.StringP("log.format", "", "console", "log format, support json and consolel")
+	skipFingerprint(flags, "port", "bind", "unix.path", "unix.owner", "unix.group", "auth.jwt-key-file",
+		"replication.leader", "cluster.bind", "cluster.advertise", "cluster.id", "cluster.http", "cluster.dir", "cluster.bootstrap",
+		"cluster.tls.cert", "cluster.tls.key", "cluster.tls.ca", "tls.cert", "tls.key", "tls.client-ca",
+		"log.path", "log.maxsize", "log.maxage", "log.maxbackups", "log.localtime", "log.compress", "log.level", "log.format")
 }
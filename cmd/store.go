@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/shumin1027/otpd/pkg/badger"
+	"github.com/shumin1027/otpd/pkg/logger"
+	"github.com/shumin1027/otpd/pkg/store"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var storeCmd = &cobra.Command{
+	Use:   "store",
+	Short: "Manage the storage of a stopped server",
+}
+
+var rotateKeyCmd = &cobra.Command{
+	Use:   "rotate-key",
+	Short: "Re-encrypt the badger data keys with a new encryption key",
+	Long: `Re-encrypt the data keys of a stopped badger data path with a new encryption key.
+The current key is read from --data.encryption-key-file or OTPD_DATA_ENCRYPTION_KEY,
+leave both unset to encrypt a data path written without a key. Only the key registry
+is rewritten, start the server with the new key afterwards.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if driver := conf.String("data.driver"); driver != store.DriverBadger {
+			logger.L().Fatal("encryption at rest requires the badger driver", zap.String("driver", driver))
+		}
+		dir := conf.String("data.path")
+		if dir == "" {
+			logger.L().Fatal("data.path is required")
+		}
+		oldKey, err := readEncryptionKey()
+		if err != nil {
+			logger.L().Fatal("read current encryption key", zap.Error(err))
+		}
+		newKey, err := readNewEncryptionKey()
+		if err != nil {
+			logger.L().Fatal("read new encryption key", zap.Error(err))
+		}
+		if err := badger.RotateKey(dir, oldKey, newKey); err != nil {
+			logger.L().Fatal("rotate encryption key", zap.Error(err))
+		}
+		fmt.Printf("encryption key of %s rotated\n", dir)
+	},
+}
+
+// readNewEncryptionKey reads the key from --new-key-file or OTPD_DATA_NEW_ENCRYPTION_KEY
+func readNewEncryptionKey() ([]byte, error) {
+	if file := conf.String("new-key-file"); file != "" {
+		buf, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return badger.ParseKey(buf)
+	}
+	if env := os.Getenv("OTPD_DATA_NEW_ENCRYPTION_KEY"); env != "" {
+		return badger.ParseKey([]byte(env))
+	}
+	return nil, errors.New("--new-key-file or OTPD_DATA_NEW_ENCRYPTION_KEY is required")
+}
+
+func init() {
+	rootCmd.AddCommand(storeCmd)
+	storeCmd.AddCommand(rotateKeyCmd)
+	flags := rotateKeyCmd.PersistentFlags()
+	flags.StringP("new-key-file", "", "", "file holding the new encryption key, or set OTPD_DATA_NEW_ENCRYPTION_KEY")
+	addDataFlags(flags)
+}
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/shumin1027/otpd/pkg/logger"
+	"github.com/shumin1027/otpd/pkg/transfer"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Keep local secret files of PAM modules in sync with the accounts",
+}
+
+var syncUsersOathCmd = &cobra.Command{
+	Use:   "users-oath",
+	Short: "Keep a pam_oath users.oath file updated from the accounts",
+	Long: `Keep a pam_oath users.oath file updated from the accounts of a running server with --remote,
+or of a data path, for hosts validating with pam_oath that can not reach otpd.
+The file is managed by otpd: users not in otpd are removed, the counters and last used codes
+pam_oath keeps in the file are preserved while the secret of the user does not change.
+Accounts pam_oath can not validate, e.g. SHA256 ones, are left out with a warning.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		file := conf.String("file")
+		if file == "" {
+			logger.L().Fatal("--file is required")
+		}
+		b, err := openAccounts()
+		if err != nil {
+			logger.L().Fatal("open accounts", zap.Error(err))
+		}
+		defer b.Close()
+
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		interval := conf.Duration("interval")
+		for {
+			err := syncUsersOath(b, file, conf.String("group"))
+			if conf.Bool("once") {
+				if err != nil {
+					b.Close()
+					logger.L().Fatal("sync users.oath", zap.Error(err))
+				}
+				return
+			}
+			if err != nil {
+				logger.L().Warn("sync users.oath", zap.Error(err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	},
+}
+
+// syncUsersOath rewrites the file when the accounts changed, under the lock pam_oath uses
+func syncUsersOath(b accountBackend, file, group string) error {
+	records, err := b.Export(group, nil)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockUsersOath(file)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	existing, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	data, skipped := transfer.MergeUsersOath(existing, records)
+	for _, err := range skipped {
+		logger.L().Warn("account left out of users.oath", zap.Error(err))
+	}
+	if bytes.Equal(data, existing) {
+		return nil
+	}
+
+	// 先写临时文件再改名，pam_oath不会读到写了一半的文件
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return err
+	}
+	logger.L().Info("users.oath updated", zap.String("file", file), zap.Int("accounts", len(records)-len(skipped)))
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(syncCmd)
+	syncCmd.AddCommand(syncUsersOathCmd)
+	flags := syncUsersOathCmd.PersistentFlags()
+	flags.StringP("file", "f", "/etc/users.oath", "users.oath file to keep updated")
+	flags.StringP("group", "g", "", "only accounts in this group")
+	flags.DurationP("interval", "", time.Minute, "how often the accounts are checked for changes")
+	flags.BoolP("once", "", false, "sync once and exit, e.g. from cron")
+	flags.StringP("remote", "r", "", "a running server, e.g: http://localhost:18181 or unix:///run/otpd.sock")
+	addClientFlags(flags)
+	addDataFlags(flags)
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockUsersOath takes the write lock pam_oath holds on <file>.lock while it rewrites the file
+func lockUsersOath(file string) (func(), error) {
+	f, err := os.OpenFile(file+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	lk := unix.Flock_t{Type: unix.F_WRLCK, Whence: 0}
+	if err := unix.FcntlFlock(f.Fd(), unix.F_SETLKW, &lk); err != nil {
+		f.Close()
+		return nil, err
+	}
+	// 关闭文件即释放fcntl锁
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,342 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/shumin1027/otpd/pkg/client"
+	"github.com/shumin1027/otpd/pkg/logger"
+	"github.com/shumin1027/otpd/pkg/otp"
+	"github.com/shumin1027/otpd/pkg/transfer"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// exportPassphraseEnv the environment variable of the passphrase of exports
+const exportPassphraseEnv = "OTPD_EXPORT_PASSPHRASE"
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export accounts with their secrets",
+	Long: `Export accounts with their secrets, from a running server with --remote or from a stopped data path.
+Formats: uri, one otpauth:// URI per line; json; csv with the columns
+name,issuer,secret,algorithm,digits,period,groups,disabled; migration, the otpauth-migration://
+URIs of the Google Authenticator "Transfer accounts" QR codes, one per --batch-size accounts,
+written as PNG images too with --qr-dir.
+The file contains secrets, encrypt it with --passphrase-file or OTPD_EXPORT_PASSPHRASE.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		file := conf.String("file")
+		if file == "" {
+			logger.L().Fatal("--file is required, - for stdout")
+		}
+		passphrase, err := readPassphrase(exportPassphraseEnv)
+		if err != nil {
+			logger.L().Fatal("read passphrase", zap.Error(err))
+		}
+		format := conf.String("format")
+		if _, err := transfer.Lookup(format); err != nil {
+			logger.L().Fatal("invalid --format", zap.Error(err))
+		}
+
+		var records []transfer.Record
+		withAccounts("export accounts", func(b accountBackend) error {
+			records, err = b.Export(conf.String("group"), conf.Strings("name"))
+			return err
+		})
+		var data []byte
+		if format == transfer.FormatMigration {
+			data, err = writeMigration(records, passphrase)
+		} else {
+			data, err = transfer.Write(records, format, passphrase)
+		}
+		if err != nil {
+			logger.L().Fatal("export accounts", zap.Error(err))
+		}
+
+		if file == "-" {
+			os.Stdout.Write(data)
+			return
+		}
+		// 导出文件包含密钥，不覆盖已有文件，只允许当前用户读写
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			logger.L().Fatal("create export file", zap.Error(err))
+		}
+		_, err = f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(file)
+			logger.L().Fatal("write export file", zap.Error(err))
+		}
+	},
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import accounts with their secrets",
+	Long: `Import accounts with their secrets into a running server with --remote or into a stopped data path.
+The format, one of those of export or the backup of an authenticator app: aegis, plain or an
+encrypted vault; andotp, a plain backup; freeotp, a FreeOTP+ export, is detected from the content
+unless --format is given. Encrypted exports and Aegis vaults are decrypted
+with --passphrase-file or OTPD_EXPORT_PASSPHRASE. Only TOTP keys of at least 80 bits are accepted.
+The tokens of an authenticator app are named issuer:label, other token types like hotp or steam are skipped.
+--user imports them as the credentials of a user: named user:issuer:label and in the group of the user,
+export --group user --format migration moves them to a new phone.
+Nothing is imported if a record is invalid, or if an account exists with --policy fail,
+--preview lists the accounts of the file and what would be done with them, invalid ones included.
+A google-authenticator file holds a single account named by --name, by default the name of
+the home directory of ~/.google_authenticator. Its WINDOW_SIZE and scratch codes are applied,
+RATE_LIMIT and DISALLOW_REUSE are not enforced and only kept for export: otpd applies
+--lockout.max-failures and --replay.window of the server to every account instead.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		file := conf.String("file")
+		if file == "" {
+			logger.L().Fatal("--file is required, - for stdin")
+		}
+		policy, err := transfer.ParsePolicy(conf.String("policy"))
+		if err != nil {
+			logger.L().Fatal("invalid --policy", zap.Error(err))
+		}
+		passphrase, err := readPassphrase(exportPassphraseEnv)
+		if err != nil {
+			logger.L().Fatal("read passphrase", zap.Error(err))
+		}
+		var data []byte
+		if file == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(file)
+		}
+		if err != nil {
+			logger.L().Fatal("read import file", zap.Error(err))
+		}
+		records, err := transfer.Read(data, conf.String("format"), passphrase)
+		if err != nil {
+			logger.L().Fatal("read import file", zap.Error(err))
+		}
+		if name := importName(file); name != "" {
+			if err := transfer.SetName(records, name); err != nil {
+				logger.L().Fatal("invalid --name", zap.Error(err))
+			}
+		}
+		if user := conf.String("user"); user != "" {
+			if err := transfer.SetUser(records, user); err != nil {
+				logger.L().Fatal("invalid --user", zap.Error(err))
+			}
+		}
+
+		opts := transfer.Options{Policy: policy, DryRun: conf.Bool("dry-run")}
+		withAccounts("import accounts", func(b accountBackend) error {
+			var result *transfer.Result
+			if conf.Bool("preview") {
+				result, err = b.Preview(records, policy)
+			} else {
+				result, err = b.Import(records, opts)
+			}
+			if result != nil {
+				if perr := printImportResult(result); err == nil {
+					err = perr
+				}
+			}
+			return err
+		})
+	},
+}
+
+// importName --name, or the owner of a ~/.google_authenticator file named after its home directory
+func importName(file string) string {
+	if name := conf.String("name"); name != "" {
+		return name
+	}
+	if filepath.Base(file) != ".google_authenticator" {
+		return ""
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(filepath.Dir(abs))
+}
+
+// writeMigration the migration URIs of --batch-size accounts each, and their QR codes in --qr-dir
+func writeMigration(records []transfer.Record, passphrase string) ([]byte, error) {
+	if len(records) == 0 {
+		return nil, errors.New("no account to export")
+	}
+	uris, err := transfer.MigrationURIs(records, conf.Int("batch-size"))
+	if err != nil {
+		return nil, err
+	}
+	if dir := conf.String("qr-dir"); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		for i, uri := range uris {
+			img, err := otp.QRCodePNG(uri, 400)
+			if err != nil {
+				return nil, err
+			}
+			name := filepath.Join(dir, fmt.Sprintf("migration-%d-of-%d.png", i+1, len(uris)))
+			if err := os.WriteFile(name, img, 0600); err != nil {
+				return nil, err
+			}
+			fmt.Fprintln(os.Stderr, name)
+		}
+	}
+	data := []byte(strings.Join(uris, "\n") + "\n")
+	if passphrase == "" {
+		return data, nil
+	}
+	return transfer.Seal(data, passphrase)
+}
+
+func (localAccounts) Export(group string, names []string) ([]transfer.Record, error) {
+	return transfer.Export(context.Background(), group, names...)
+}
+
+func (localAccounts) Import(records []transfer.Record, opts transfer.Options) (*transfer.Result, error) {
+	return transfer.Import(records, opts)
+}
+
+func (localAccounts) Preview(records []transfer.Record, policy transfer.Policy) (*transfer.Result, error) {
+	return transfer.Preview(records, policy)
+}
+
+// Export 服务端导出不加密，由命令行在本地加密
+func (r *remoteAccounts) Export(group string, names []string) ([]transfer.Record, error) {
+	query := url.Values{"format": []string{transfer.FormatJSON}, "name": names}
+	if group != "" {
+		query.Set("group", group)
+	}
+	resp, err := r.client.Do(context.Background(), http.MethodGet, "/admin/transfer/export", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var records []transfer.Record
+	return records, json.NewDecoder(resp.Body).Decode(&records)
+}
+
+// Import sends the records as json, the result is also returned when the server rejects the import
+func (r *remoteAccounts) Import(records []transfer.Record, opts transfer.Options) (*transfer.Result, error) {
+	query := url.Values{
+		"policy":  []string{string(opts.Policy)},
+		"dry_run": []string{strconv.FormatBool(opts.DryRun)},
+	}
+	return r.postRecords("/admin/transfer/import", query, records)
+}
+
+func (r *remoteAccounts) Preview(records []transfer.Record, policy transfer.Policy) (*transfer.Result, error) {
+	return r.postRecords("/admin/transfer/preview", url.Values{"policy": []string{string(policy)}}, records)
+}
+
+// postRecords 文件在本地解析和解密，以json发送给服务端
+func (r *remoteAccounts) postRecords(path string, query url.Values, records []transfer.Record) (*transfer.Result, error) {
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(records); err != nil {
+		return nil, err
+	}
+	query.Set("format", transfer.FormatJSON)
+	resp, err := r.client.Do(context.Background(), http.MethodPost, path, query, &body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var res client.Response
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(buf)))
+	}
+	var result *transfer.Result
+	if len(res.Inventory) > 0 && string(res.Inventory) != "null" {
+		result = &transfer.Result{}
+		if err := json.Unmarshal(res.Inventory, result); err != nil {
+			return nil, err
+		}
+	}
+	if !res.Success {
+		return result, errors.New(res.Error.Message)
+	}
+	return result, nil
+}
+
+func printImportResult(r *transfer.Result) error {
+	if outputJSON() {
+		return printJSON(r)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tISSUER\tTYPE\tGROUPS\tACTION\tERROR")
+	for _, e := range r.Entries {
+		typ := e.Type
+		if typ != "" {
+			typ = fmt.Sprintf("%s/%s/%d", e.Type, e.Algorithm, e.Digits)
+		}
+		if e.Period > 0 {
+			typ += fmt.Sprintf("/%ds", e.Period)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Name, e.Issuer, typ, strings.Join(e.Groups, ","), e.Action, e.Error)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	summary := fmt.Sprintf("%d records: %d created, %d overwritten, %d skipped", r.Total, r.Created, r.Overwritten, r.Skipped)
+	if r.Conflicts > 0 {
+		summary += fmt.Sprintf(", %d conflicts", r.Conflicts)
+	}
+	if r.Invalid > 0 {
+		summary += fmt.Sprintf(", %d invalid", r.Invalid)
+	}
+	if r.DryRun {
+		summary += " (dry run, nothing written)"
+	}
+	fmt.Println(summary)
+	return nil
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{exportCmd, importCmd} {
+		rootCmd.AddCommand(cmd)
+		flags := cmd.PersistentFlags()
+		flags.StringP("remote", "r", "", "a running server, e.g: http://localhost:18181 or unix:///run/otpd.sock")
+		flags.StringP("passphrase-file", "", "", "passphrase encrypting the file, or set "+exportPassphraseEnv)
+		addClientFlags(flags)
+		addDataFlags(flags)
+	}
+	flags := exportCmd.PersistentFlags()
+	flags.StringP("file", "f", "", "file to write, must not exist, - for stdout")
+	flags.StringP("format", "", transfer.FormatJSON, "file format, support "+strings.Join(transfer.Formats(), ", "))
+	flags.StringP("group", "g", "", "only accounts in this group")
+	flags.StringSliceP("name", "n", nil, "only these accounts")
+	flags.IntP("batch-size", "", transfer.DefaultMigrationBatchSize, "accounts per migration QR code")
+	flags.StringP("qr-dir", "", "", "also write the migration QR codes as PNG images to this directory")
+
+	flags = importCmd.PersistentFlags()
+	flags.StringP("file", "f", "", "file to import, - for stdin")
+	flags.StringP("format", "", "", "file format, detected from the content when empty, support "+strings.Join(transfer.Formats(), ", "))
+	flags.StringP("name", "n", "", "name of the account of a file holding a single one, like ~/.google_authenticator")
+	flags.StringP("user", "u", "", "import the accounts as the credentials of this user, named user:name and in the group user")
+	flags.StringP("policy", "", string(transfer.PolicySkip), "what to do with existing accounts: skip, overwrite or fail")
+	flags.BoolP("dry-run", "", false, "only print what would be imported")
+	flags.BoolP("preview", "", false, "list the accounts of the file and what would be done with them, invalid ones included")
+	flags.StringP("output", "o", "table", "output format, support table and json")
+}
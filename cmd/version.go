@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/shumin1027/otpd/app"
+	"github.com/shumin1027/otpd/pkg/logger"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print version information",
+	Long:  `Print build information of this binary, or of a running server with --remote`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var info interface{} = app.GetBuild()
+
+		if remote := conf.String("remote"); remote != "" {
+			c, err := newClient(remote)
+			if err != nil {
+				logger.L().Fatal("create client", zap.Error(err))
+			}
+			var v map[string]interface{}
+			if err := c.Get(context.Background(), "/version", nil, &v); err != nil {
+				logger.L().Fatal("query remote version", zap.Error(err))
+			}
+			info = v
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(info); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(versionCmd)
+	flags := versionCmd.PersistentFlags()
+	flags.StringP("remote", "r", "", "query a running server, e.g: http://localhost:18181 or unix:///run/otpd.sock")
+	addClientFlags(flags)
+}
@@ -0,0 +1,155 @@
+package http
+
+import (
+	"errors"
+	"net/url"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/shumin1027/otpd/pkg/cluster"
+	"github.com/shumin1027/otpd/pkg/http"
+	"github.com/shumin1027/otpd/pkg/otp"
+)
+
+// CreateAccountRequest an account to enroll
+type CreateAccountRequest struct {
+	Name   string   `json:"name"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// accountName the url escaped :name parameter
+func accountName(c *fiber.Ctx) (string, error) {
+	name, err := url.PathUnescape(c.Params("name"))
+	if err != nil || name == "" {
+		return "", errors.New("invalid account name")
+	}
+	return name, nil
+}
+
+// accountError 把账户管理的错误映射为对应的状态码
+func accountError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, otp.ErrNotFound):
+		return http.Fail(c, err.Error(), http.StatusNotFound)
+	case errors.Is(err, otp.ErrExists):
+		return http.Fail(c, err.Error(), http.StatusConflict)
+	case errors.Is(err, otp.ErrReserved):
+		return http.Fail(c, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, otp.ErrReadOnly), errors.Is(err, cluster.ErrNotLeader):
+		return http.Fail(c, err.Error(), http.StatusServiceUnavailable)
+	}
+	return http.Error(c, err)
+}
+
+// @Summary Create account
+// @Description enroll a new account, fails if the name is taken, export and report are reserved
+// @Accept application/json
+// @Produce application/json
+// @Tags admin
+// @Param account body CreateAccountRequest true "account to create"
+// @Router /admin/accounts [POST]
+// @Success	200 {object} otp.Account
+func CreateAccount(c *fiber.Ctx) error {
+	var req CreateAccountRequest
+	if err := c.BodyParser(&req); err != nil || req.Name == "" {
+		return http.Fail(c, "the name cannot be empty", http.StatusBadRequest)
+	}
+	account, err := otp.Create(req.Name, req.Groups)
+	if err != nil {
+		return accountError(c, err)
+	}
+	enrollments.Inc()
+	return http.Success(c, account)
+}
+
+// @Summary Show account
+// @Description an account without its secret
+// @Produce application/json
+// @Tags admin
+// @Param name path string true "account name"
+// @Router /admin/accounts/{name} [GET]
+// @Success	200 {object} AccountInfo
+func ShowAccount(c *fiber.Ctx) error {
+	name, err := accountName(c)
+	if err != nil {
+		return http.Fail(c, err.Error(), http.StatusBadRequest)
+	}
+	account, err := otp.Get(name)
+	if err != nil {
+		return http.Error(c, err)
+	}
+	if account == nil {
+		return accountError(c, otp.ErrNotFound)
+	}
+	return http.Success(c, NewAccountInfo(account))
+}
+
+// @Summary Delete account
+// @Description delete an account and its failure count
+// @Produce application/json
+// @Tags admin
+// @Param name path string true "account name"
+// @Router /admin/accounts/{name} [DELETE]
+// @Success	200 string string "ok"
+func DeleteAccount(c *fiber.Ctx) error {
+	name, err := accountName(c)
+	if err != nil {
+		return http.Fail(c, err.Error(), http.StatusBadRequest)
+	}
+	if err := otp.Delete(name); err != nil {
+		return accountError(c, err)
+	}
+	return http.Success(c, "ok")
+}
+
+// @Summary Disable account
+// @Description disabled accounts fail validation until enabled again
+// @Produce application/json
+// @Tags admin
+// @Param name path string true "account name"
+// @Router /admin/accounts/{name}/disable [POST]
+// @Success	200 {object} AccountInfo
+func DisableAccount(c *fiber.Ctx) error {
+	return setDisabled(c, true)
+}
+
+// @Summary Enable account
+// @Description enable a disabled account
+// @Produce application/json
+// @Tags admin
+// @Param name path string true "account name"
+// @Router /admin/accounts/{name}/enable [POST]
+// @Success	200 {object} AccountInfo
+func EnableAccount(c *fiber.Ctx) error {
+	return setDisabled(c, false)
+}
+
+func setDisabled(c *fiber.Ctx, disabled bool) error {
+	name, err := accountName(c)
+	if err != nil {
+		return http.Fail(c, err.Error(), http.StatusBadRequest)
+	}
+	account, err := otp.SetDisabled(name, disabled)
+	if err != nil {
+		return accountError(c, err)
+	}
+	return http.Success(c, NewAccountInfo(account))
+}
+
+// @Summary Rekey account
+// @Description replace the secret of an account, the previous authenticator stops working
+// @Produce application/json
+// @Tags admin
+// @Param name path string true "account name"
+// @Router /admin/accounts/{name}/rekey [POST]
+// @Success	200 {object} otp.Account
+func RekeyAccount(c *fiber.Ctx) error {
+	name, err := accountName(c)
+	if err != nil {
+		return http.Fail(c, err.Error(), http.StatusBadRequest)
+	}
+	account, err := otp.Rekey(name)
+	if err != nil {
+		return accountError(c, err)
+	}
+	return http.Success(c, account)
+}
@@ -0,0 +1,164 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/shumin1027/otpd/pkg/http"
+	"github.com/shumin1027/otpd/pkg/json"
+	log "github.com/shumin1027/otpd/pkg/logger"
+	"github.com/shumin1027/otpd/pkg/otp"
+	"go.uber.org/zap"
+)
+
+// maxListLimit upper bound of the limit query parameter
+const maxListLimit = 1000
+
+// AccountInfo an account without its secret
+type AccountInfo struct {
+	Name       string    `json:"name"`
+	Disabled   bool      `json:"disabled"`
+	Groups     []string  `json:"groups,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// NewAccountInfo the account without its secret
+func NewAccountInfo(a *otp.Account) AccountInfo {
+	return AccountInfo{
+		Name:       a.Name,
+		Disabled:   a.Disabled,
+		Groups:     a.Groups,
+		CreatedAt:  a.CreatedAt,
+		UpdatedAt:  a.UpdatedAt,
+		LastUsedAt: a.LastUsedAt,
+	}
+}
+
+// AccountList a page of accounts
+type AccountList struct {
+	Accounts []AccountInfo `json:"accounts"`
+	// Next cursor of the following page, empty when there are no more accounts
+	Next string `json:"next,omitempty"`
+}
+
+// @Summary List accounts
+// @Description list accounts, filtered by the account indexes
+// @Produce application/json
+// @Tags admin
+// @Param disabled query bool false "only disabled or enabled accounts"
+// @Param group query string false "only accounts in this group"
+// @Param unused_days query int false "only accounts not validated in this many days"
+// @Param limit query int false "max accounts returned, default 100"
+// @Param cursor query string false "next cursor of the previous page"
+// @Router /admin/accounts [GET]
+// @Success	200 {object} AccountList
+func ListAccounts(c *fiber.Ctx) error {
+	f := otp.Filter{
+		Group:  c.Query("group"),
+		Cursor: c.Query("cursor"),
+	}
+	if v := c.Query("disabled"); v != "" {
+		disabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return http.Fail(c, "invalid disabled", http.StatusBadRequest)
+		}
+		f.Disabled = &disabled
+	}
+	if v := c.Query("unused_days"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			return http.Fail(c, "invalid unused_days", http.StatusBadRequest)
+		}
+		f.UnusedSince = time.Now().AddDate(0, 0, -days)
+	}
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit < 1 || limit > maxListLimit {
+		return http.Fail(c, "limit must be between 1 and 1000", http.StatusBadRequest)
+	}
+	f.Limit = limit
+
+	list, next, err := otp.List(f)
+	if errors.Is(err, otp.ErrInvalidCursor) {
+		return http.Fail(c, err.Error(), http.StatusBadRequest)
+	}
+	if err != nil {
+		return http.Error(c, err)
+	}
+	result := AccountList{Accounts: make([]AccountInfo, 0, len(list)), Next: next}
+	for _, a := range list {
+		result.Accounts = append(result.Accounts, NewAccountInfo(a))
+	}
+	return http.Success(c, result)
+}
+
+// @Summary Export accounts
+// @Description stream all accounts without their secrets as newline delimited json
+// @Produce application/x-ndjson
+// @Tags admin
+// @Param group query string false "only accounts in this group"
+// @Router /admin/accounts/export [GET]
+// @Success	200 {object} AccountInfo
+func ExportAccounts(c *fiber.Ctx) error {
+	group := c.Query("group")
+	c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-closing:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		n := 0
+		err := otp.Each(ctx, func(a *otp.Account) error {
+			if group != "" && !a.InGroup(group) {
+				return nil
+			}
+			data, err := json.Marshal(NewAccountInfo(a))
+			if err != nil {
+				return err
+			}
+			w.Write(data)
+			w.WriteByte('\n')
+			n++
+			// 定期flush，客户端断开时返回错误并结束遍历
+			if n%exportFlushEvery == 0 {
+				return w.Flush()
+			}
+			return nil
+		})
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.L().Warn("export accounts interrupted", zap.Int("exported", n), zap.Error(err))
+		}
+	})
+	return nil
+}
+
+// exportFlushEvery accounts written between flushes of the export stream
+const exportFlushEvery = 100
+
+// @Summary Account report
+// @Description statistics of all accounts: disabled, unused, per group and per schema version
+// @Produce application/json
+// @Tags admin
+// @Router /admin/accounts/report [GET]
+// @Success	200 {object} otp.Report
+func AccountReport(c *fiber.Ctx) error {
+	report, err := otp.BuildReport(c.UserContext())
+	if err != nil {
+		return http.Error(c, err)
+	}
+	return http.Success(c, report)
+}
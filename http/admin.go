@@ -0,0 +1,166 @@
+package http
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/shumin1027/otpd/pkg/http"
+	log "github.com/shumin1027/otpd/pkg/logger"
+	"github.com/shumin1027/otpd/pkg/otp"
+	"github.com/shumin1027/otpd/pkg/store"
+	"go.uber.org/zap"
+)
+
+// HeaderBackupVersion version to pass as since for the next incremental backup
+const HeaderBackupVersion = "X-Backup-Version"
+
+// sealedTemp a temporary file encrypted with a random key only kept in memory,
+// the backup holds every secret and must not be written to disk in plain text
+type sealedTemp struct {
+	f     *os.File
+	block cipher.Block
+	iv    []byte
+	r     io.Reader
+}
+
+func newSealedTemp() (*sealedTemp, error) {
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp("", "otpd-backup-*")
+	if err != nil {
+		return nil, err
+	}
+	return &sealedTemp{f: f, block: block, iv: iv}, nil
+}
+
+// Writer encrypts what is written to the file
+func (t *sealedTemp) Writer() io.Writer {
+	return cipher.StreamWriter{S: cipher.NewCTR(t.block, t.iv), W: t.f}
+}
+
+// Rewind prepares the file to be read back decrypted, returns its size
+func (t *sealedTemp) Rewind() (int64, error) {
+	if _, err := t.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	fi, err := t.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	t.r = cipher.StreamReader{S: cipher.NewCTR(t.block, t.iv), R: t.f}
+	return fi.Size(), nil
+}
+
+func (t *sealedTemp) Read(p []byte) (int, error) {
+	return t.r.Read(p)
+}
+
+// Close removes the file, called once the response body has been sent
+func (t *sealedTemp) Close() error {
+	err := t.f.Close()
+	os.Remove(t.f.Name())
+	return err
+}
+
+// @Summary Backup
+// @Description stream a consistent snapshot of the store, entries newer than since only
+// @Produce application/octet-stream
+// @Tags admin
+// @Param since query int false "version of the previous backup, 0 for a full backup"
+// @Router /admin/backup [POST]
+// @Success	200 {file} binary
+func Backup(c *fiber.Ctx) error {
+	since, err := strconv.ParseUint(c.Query("since", "0"), 10, 64)
+	if err != nil {
+		return http.Fail(c, "invalid since version", http.StatusBadRequest)
+	}
+	b, ok := otp.Storage().(store.Backuper)
+	if !ok {
+		return http.Fail(c, "storage driver does not support backup", http.StatusNotImplemented)
+	}
+
+	// 先写入临时文件，拿到version后再返回，保证响应头中的version与内容一致
+	tmp, err := newSealedTemp()
+	if err != nil {
+		return http.Error(c, err)
+	}
+	version, err := b.Backup(tmp.Writer(), since)
+	var size int64
+	if err == nil {
+		size, err = tmp.Rewind()
+	}
+	if err != nil {
+		tmp.Close()
+		return http.Error(c, err)
+	}
+
+	log.L().Info("backup created", zap.Uint64("since", since), zap.Uint64("version", version), zap.Int64("size", size))
+	c.Set(HeaderBackupVersion, strconv.FormatUint(version, 10))
+	c.Set(fiber.HeaderContentType, fiber.MIMEOctetStream)
+	c.Context().SetBodyStream(tmp, int(size))
+	return nil
+}
+
+// @Summary Value log GC
+// @Description run value log GC until no file can be rewritten
+// @Produce application/json
+// @Tags admin
+// @Param discard_ratio query number false "rewrite files with at least this ratio of stale data, default 0.5"
+// @Router /admin/gc [POST]
+// @Success	200 {object} http.Response
+func RunGC(c *fiber.Ctx) error {
+	ratio, err := strconv.ParseFloat(c.Query("discard_ratio", "0.5"), 64)
+	if err != nil || ratio <= 0 || ratio >= 1 {
+		return http.Fail(c, "discard_ratio must be between 0 and 1", http.StatusBadRequest)
+	}
+	m, ok := otp.Storage().(store.Maintainer)
+	if !ok {
+		return http.Fail(c, "storage driver does not support gc", http.StatusNotImplemented)
+	}
+	rewrites, err := m.RunGC(ratio)
+	if err != nil {
+		return http.Error(c, err)
+	}
+	log.L().Info("value log gc triggered", zap.Float64("discard_ratio", ratio), zap.Int("rewrites", rewrites))
+	return http.Success(c, fiber.Map{"rewrites": rewrites})
+}
+
+// @Summary Flatten
+// @Description compact all LSM tables into one level, writes should be paused while it runs
+// @Produce application/json
+// @Tags admin
+// @Param workers query int false "compaction workers, default 1"
+// @Router /admin/flatten [POST]
+// @Success	200 {object} http.Response
+func Flatten(c *fiber.Ctx) error {
+	workers, err := strconv.Atoi(c.Query("workers", "1"))
+	if err != nil || workers < 1 {
+		return http.Fail(c, "invalid workers", http.StatusBadRequest)
+	}
+	m, ok := otp.Storage().(store.Maintainer)
+	if !ok {
+		return http.Fail(c, "storage driver does not support flatten", http.StatusNotImplemented)
+	}
+	start := time.Now()
+	if err := m.Flatten(workers); err != nil {
+		return http.Error(c, err)
+	}
+	log.L().Info("store flattened", zap.Int("workers", workers), zap.Duration("duration", time.Since(start)))
+	return http.Success(c, true)
+}
@@ -0,0 +1,105 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/shumin1027/otpd/pkg/http"
+	"github.com/shumin1027/otpd/pkg/otp"
+	"github.com/shumin1027/otpd/pkg/store"
+)
+
+func TestBackup(t *testing.T) {
+	if err := otp.Init(store.DriverBadger, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := otp.Create("alice", nil); err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New()
+	app.Post("/admin/backup", Backup)
+	resp, err := app.Test(httptest.NewRequest("POST", "/admin/backup", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otp.Storage().Close()
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(HeaderBackupVersion) == "" {
+		t.Fatalf("unexpected response %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// 临时文件加密存放，返回的内容解密后可以恢复
+	if err := otp.Init(store.DriverBadger, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer otp.Storage().Close()
+	if err := otp.Storage().(store.Backuper).Load(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := otp.Get("alice"); err != nil || a == nil {
+		t.Errorf("alice not restored: %v, %v", a, err)
+	}
+}
+
+func TestTransferImport(t *testing.T) {
+	if err := otp.Init(store.DriverBadger, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer otp.Storage().Close()
+	if _, err := otp.Create("alice", nil); err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New()
+	app.Post("/admin/transfer/import", TransferImport)
+	for _, c := range []struct {
+		body, policy string
+		status       int
+	}{
+		{"otpauth://totp/alice?secret=JBSWY3DPEHPK3PXP", "fail", fiber.StatusConflict},
+		{"otpauth://totp/alice?secret=invalid!", "fail", fiber.StatusBadRequest},
+		{"otpauth://totp/bob?secret=JBSWY3DPEHPK3PXP", "fail", fiber.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", "/admin/transfer/import?format=uri&policy="+c.policy, strings.NewReader(c.body))
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != c.status {
+			t.Errorf("import %s: expected %d, got %d", c.body, c.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestCreateAccount(t *testing.T) {
+	if err := otp.Init(store.DriverBadger, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer otp.Storage().Close()
+	app := fiber.New()
+	app.Post("/admin/accounts", CreateAccount)
+	for _, c := range []struct {
+		name string
+		code int
+	}{
+		{"alice", 0},
+		{"alice", fiber.StatusConflict},
+		{"export", fiber.StatusBadRequest},
+		{"report", fiber.StatusBadRequest},
+	} {
+		req := httptest.NewRequest("POST", "/admin/accounts", strings.NewReader(`{"name":"`+c.name+`"}`))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res http.Response
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Error.Code != c.code {
+			t.Errorf("create %s: expected code %d, got %+v", c.name, c.code, res)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package http
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/proxy"
+	"github.com/shumin1027/otpd/pkg/cluster"
+	"github.com/shumin1027/otpd/pkg/http"
+	log "github.com/shumin1027/otpd/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// HeaderForwardedBy id of the cluster node that forwarded the request to the leader
+const HeaderForwardedBy = "X-Otpd-Forwarded-By"
+
+// toLeader 集群模式下非leader节点把写请求转发给leader，只转发一次，避免选举期间循环转发
+func toLeader(c *fiber.Ctx) error {
+	node := cluster.Current()
+	if node == nil || node.IsLeader() {
+		return c.Next()
+	}
+	if by := c.Get(HeaderForwardedBy); by != "" {
+		return http.Fail(c, cluster.ErrNotLeader.Error(), http.StatusServiceUnavailable)
+	}
+	leader := node.LeaderHTTP()
+	if leader == "" {
+		return http.Fail(c, cluster.ErrNoLeader.Error(), http.StatusServiceUnavailable)
+	}
+	c.Request().Header.Set(HeaderForwardedBy, node.ID())
+	if err := proxy.Do(c, leader+c.OriginalURL()); err != nil {
+		log.L().Warn("forward request to leader", zap.String("leader", leader), zap.String("path", c.Path()), zap.Error(err))
+		return http.Fail(c, "forward to leader: "+err.Error(), http.StatusBadGateway)
+	}
+	return nil
+}
+
+// JoinRequest a server joining the cluster
+type JoinRequest struct {
+	// ID unique name of the server
+	ID string `json:"id"`
+	// Address raft address of the server
+	Address string `json:"address"`
+	// HTTP url writes are forwarded to when the server is the leader
+	HTTP string `json:"http"`
+}
+
+// @Summary Cluster status
+// @Description raft state and members of the cluster
+// @Produce application/json
+// @Tags admin
+// @Router /admin/cluster [GET]
+// @Success	200 {object} cluster.Status
+func ClusterStatus(c *fiber.Ctx) error {
+	node := cluster.Current()
+	if node == nil {
+		return http.Fail(c, "clustered mode is disabled", http.StatusNotFound)
+	}
+	return http.Success(c, node.Status())
+}
+
+// @Summary Join cluster
+// @Description add a voter to the cluster, forwarded to the leader
+// @Accept application/json
+// @Produce application/json
+// @Tags admin
+// @Param body body JoinRequest true "server"
+// @Router /admin/cluster/join [POST]
+// @Success	200 {object} cluster.Status
+func ClusterJoin(c *fiber.Ctx) error {
+	node := cluster.Current()
+	if node == nil {
+		return http.Fail(c, "clustered mode is disabled", http.StatusNotFound)
+	}
+	var req JoinRequest
+	if err := c.BodyParser(&req); err != nil || req.ID == "" || req.Address == "" {
+		return http.Fail(c, "server id and address are required", http.StatusBadRequest)
+	}
+	if err := node.Join(req.ID, req.Address, req.HTTP); err != nil {
+		return http.Fail(c, err.Error(), http.StatusConflict)
+	}
+	return http.Success(c, node.Status())
+}
+
+// @Summary Remove server
+// @Description remove a server from the cluster, forwarded to the leader
+// @Produce application/json
+// @Tags admin
+// @Param id query string true "server id"
+// @Router /admin/cluster/remove [POST]
+// @Success	200 {object} cluster.Status
+func ClusterRemove(c *fiber.Ctx) error {
+	node := cluster.Current()
+	if node == nil {
+		return http.Fail(c, "clustered mode is disabled", http.StatusNotFound)
+	}
+	id := c.Query("id")
+	if id == "" {
+		return http.Fail(c, "server id is required", http.StatusBadRequest)
+	}
+	if err := node.Remove(id); err != nil {
+		return http.Fail(c, err.Error(), http.StatusConflict)
+	}
+	return http.Success(c, node.Status())
+}
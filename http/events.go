@@ -0,0 +1,107 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/shumin1027/otpd/pkg/http"
+	"github.com/shumin1027/otpd/pkg/json"
+	log "github.com/shumin1027/otpd/pkg/logger"
+	"github.com/shumin1027/otpd/pkg/otp"
+	"github.com/shumin1027/otpd/pkg/store"
+	"go.uber.org/zap"
+)
+
+// heartbeat interval of the event stream comments, detects closed connections
+const heartbeat = 15 * time.Second
+
+// closing closed on shutdown to end the event streams, they never become idle by themselves
+var (
+	closing     = make(chan struct{})
+	closingOnce sync.Once
+)
+
+// AccountEvent an account change sent on the event stream
+type AccountEvent struct {
+	Op      store.Op     `json:"op"`
+	Name    string       `json:"name"`
+	Account *AccountInfo `json:"account,omitempty"`
+	Version uint64       `json:"version"`
+	Time    time.Time    `json:"time"`
+}
+
+// @Summary Account events
+// @Description stream account changes as server-sent events
+// @Produce text/event-stream
+// @Tags admin
+// @Router /v1/events [GET]
+// @Success	200 {object} AccountEvent
+func Events(c *fiber.Ctx) error {
+	if !otp.Watchable() {
+		return http.Fail(c, otp.ErrWatchUnsupported.Error(), http.StatusNotImplemented)
+	}
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		events := make(chan otp.AccountEvent, 64)
+		go func() {
+			err := otp.Watch(ctx, func(e otp.AccountEvent) error {
+				select {
+				case events <- e:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			if err != nil && ctx.Err() == nil {
+				log.L().Error("watch account events", zap.Error(err))
+			}
+			cancel()
+		}()
+
+		// 先发送一个注释，客户端据此确认订阅已建立
+		fmt.Fprint(w, ": connected\n\n")
+		if w.Flush() != nil {
+			return
+		}
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case e := <-events:
+				event := AccountEvent{Op: e.Op, Name: e.Name, Version: e.Version, Time: e.Time}
+				if e.Account != nil {
+					info := NewAccountInfo(e.Account)
+					event.Account = &info
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					log.L().Error("encode account event", zap.Error(err))
+					continue
+				}
+				fmt.Fprintf(w, "id: %d\nevent: account\ndata: %s\n\n", e.Version, data)
+			case <-ticker.C:
+				fmt.Fprint(w, ": ping\n\n")
+			case <-ctx.Done():
+				return
+			case <-closing:
+				return
+			}
+			// 客户端断开时Flush返回错误
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
+	return nil
+}
@@ -1,9 +1,14 @@
 package http
 
 import (
+	"errors"
+
 	"github.com/gofiber/fiber/v2"
+	"github.com/shumin1027/otpd/pkg/cluster"
 	"github.com/shumin1027/otpd/pkg/http"
+	log "github.com/shumin1027/otpd/pkg/logger"
 	"github.com/shumin1027/otpd/pkg/otp"
+	"go.uber.org/zap"
 )
 
 // @Summary Ping
@@ -37,9 +42,13 @@ func GetOTPKeyByNmae(c *fiber.Ctx) error {
 	}
 
 	err = account.Save()
+	if errors.Is(err, otp.ErrReadOnly) || errors.Is(err, cluster.ErrNotLeader) {
+		return http.Fail(c, err.Error(), http.StatusServiceUnavailable)
+	}
 	if err != nil {
 		return http.Error(c, err)
 	}
+	enrollments.Inc()
 
 	return http.Success(c, account)
 }
@@ -71,13 +80,31 @@ func Validate(c *fiber.Ctx) error {
 		return http.Fail(c, "the passcode cannot be empty", http.StatusBadRequest)
 	}
 
-	account, err := otp.Get(name)
+	account, key, err := otp.LookupKey(name)
 	if err != nil || account == nil {
+		validations.WithLabelValues(resultUnknownAccount).Inc()
 		return http.Fail(c, "no valid account found", http.StatusBadRequest)
 	}
+	if account.Disabled {
+		validations.WithLabelValues(resultDisabled).Inc()
+		return http.Fail(c, "the account is disabled", http.StatusBadRequest)
+	}
+	if otp.Locked(name) {
+		validations.WithLabelValues(resultLocked).Inc()
+		return http.Fail(c, "the account is locked, try again later", http.StatusBadRequest)
+	}
 
-	key, _ := account.Key()
-
-	ok := otp.Validate(passcode, key.Secret())
-	return http.Success(c, ok)
+	ok := otp.ValidateKey(passcode, key, account.Options.Window())
+	// 记录使用过的验证码和失败次数，并使用应急码，follower上转发给leader
+	result, err := otp.RecordValidation(name, passcode, ok)
+	if err != nil {
+		// 无法确认验证码是否已被使用，拒绝本次校验
+		log.L().Error("record validation", zap.String("name", name), zap.Error(err))
+		validations.WithLabelValues(resultError).Inc()
+		e := http.ErrServiceUnavailable
+		e.Message = "the validation could not be recorded, try again later"
+		return c.Status(http.StatusServiceUnavailable).JSON(http.Response{Success: false, Error: e})
+	}
+	validations.WithLabelValues(string(result)).Inc()
+	return http.Success(c, result == otp.ResultOK)
 }
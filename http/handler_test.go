@@ -0,0 +1,95 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/shumin1027/otpd/pkg/http"
+	"github.com/shumin1027/otpd/pkg/otp"
+	"github.com/shumin1027/otpd/pkg/store"
+)
+
+// validate 调用/validate，返回状态码和校验结果
+func validate(t *testing.T, app *fiber.App, name, passcode string) (int, bool) {
+	t.Helper()
+	q := url.Values{"name": {name}, "passcode": {passcode}}
+	resp, err := app.Test(httptest.NewRequest("GET", "/validate?"+q.Encode(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body http.Response
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	ok, _ := body.Inventory.(bool)
+	return resp.StatusCode, ok
+}
+
+func TestValidate(t *testing.T) {
+	if err := otp.Init(store.DriverMemory, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer otp.Storage().Close()
+	account, err := otp.Create("alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := account.Key()
+	passcode := otp.GeneratePassCode(key.Secret())
+
+	app := fiber.New()
+	app.Get("/validate", Validate)
+
+	// 无法记录验证码时拒绝校验，不能绕过重放保护
+	otp.SetRecorder(func(string, string, bool) (otp.Result, error) {
+		return otp.ResultError, errors.New("leader unreachable")
+	})
+	code, ok := validate(t, app, "alice", passcode)
+	otp.SetRecorder(otp.Record)
+	if code != fiber.StatusServiceUnavailable || ok {
+		t.Fatalf("expected 503, got %d %v", code, ok)
+	}
+
+	if code, ok := validate(t, app, "alice", passcode); code != fiber.StatusOK || !ok {
+		t.Fatalf("expected valid passcode, got %d %v", code, ok)
+	}
+	if code, ok := validate(t, app, "alice", passcode); code != fiber.StatusOK || ok {
+		t.Fatalf("expected replay to be rejected, got %d %v", code, ok)
+	}
+}
+
+func TestValidateKeyParams(t *testing.T) {
+	if err := otp.Init(store.DriverMemory, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer otp.Storage().Close()
+	// 导入的账户可能使用其它算法、位数和周期
+	const url = "otpauth://totp/Example:erin?secret=JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP&issuer=Example&algorithm=SHA256&digits=8&period=60"
+	if err := (&otp.Account{Name: "erin", OTP: url}).Save(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := otp.ParseCodeURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passcode, err := p.Code(uint64(p.Step(time.Now())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Get("/validate", Validate)
+	// 按默认参数生成的验证码无效
+	if code, ok := validate(t, app, "erin", otp.GeneratePassCode("JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP")); code != fiber.StatusOK || ok {
+		t.Fatalf("expected a default passcode to be rejected, got %d %v", code, ok)
+	}
+	if code, ok := validate(t, app, "erin", passcode); code != fiber.StatusOK || !ok {
+		t.Fatalf("expected the sha256 8 digit passcode to be valid, got %d %v", code, ok)
+	}
+}
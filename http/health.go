@@ -0,0 +1,113 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwt"
+	self "github.com/shumin1027/otpd/app"
+	"github.com/shumin1027/otpd/pkg/cluster"
+	"github.com/shumin1027/otpd/pkg/health"
+	"github.com/shumin1027/otpd/pkg/http"
+	"github.com/shumin1027/otpd/pkg/otp"
+	"github.com/shumin1027/otpd/pkg/replication"
+	"github.com/shumin1027/otpd/pkg/store"
+)
+
+var readiness = health.NewChecker(5 * time.Second)
+
+// registerChecks registers the readiness checks for the running config
+func registerChecks(cfg Config) {
+	readiness.Register("storage", func(ctx context.Context) (interface{}, error) {
+		stor := otp.Storage()
+		if stor == nil {
+			return nil, errors.New("store not opened")
+		}
+		detail := map[string]interface{}{
+			"driver":    stor.Driver(),
+			"in_memory": stor.Dir() == "",
+		}
+		if sizer, ok := stor.(store.Sizer); ok {
+			lsm, vlog := sizer.Size()
+			detail["lsm_size"] = lsm
+			detail["vlog_size"] = vlog
+		}
+		return detail, stor.Probe()
+	})
+
+	if stor := otp.Storage(); stor != nil && stor.Dir() != "" {
+		readiness.Register("disk", health.DiskCheck(stor.Dir(), cfg.MinFreeDisk))
+	}
+
+	if SecretKey != nil {
+		readiness.Register("signing_key", func(ctx context.Context) (interface{}, error) {
+			// 用签名密钥签发一个token，确认密钥可用
+			_, err := jwt.Sign(jwt.New(), jwa.HS256, SecretKey)
+			return map[string]string{"type": string(SecretKey.KeyType())}, err
+		})
+	}
+
+	// leader不可用时follower仍可在本地校验，只报告复制状态，不影响就绪
+	readiness.Register("replication", func(ctx context.Context) (interface{}, error) {
+		return replication.Current(), nil
+	})
+
+	// 集群没有leader时无法提交写入，校验也会失败
+	if cluster.Current() != nil {
+		readiness.Register("cluster", func(ctx context.Context) (interface{}, error) {
+			node := cluster.Current()
+			if node == nil {
+				return nil, errors.New("cluster node stopped")
+			}
+			status := node.Status()
+			if status.Leader == "" {
+				return status, cluster.ErrNoLeader
+			}
+			return status, nil
+		})
+	}
+
+	readiness.Register("config", func(ctx context.Context) (interface{}, error) {
+		detail := map[string]interface{}{
+			"tcp":  !cfg.DisableTCP,
+			"tls":  cfg.TLS.Enabled(),
+			"unix": cfg.Unix.Path != "",
+		}
+		if cfg.DisableTCP && cfg.Unix.Path == "" {
+			return detail, errors.New("no listener configured")
+		}
+		return detail, nil
+	})
+}
+
+// @Summary Liveness
+// @Description liveness probe, reports the process is running
+// @Produce application/json
+// @Tags health
+// @Router /healthz [GET]
+// @Success	200 {object} health.Report
+func Healthz(c *fiber.Ctx) error {
+	return c.Status(http.StatusOK).JSON(fiber.Map{
+		"status": health.StatusUp,
+		"uptime": time.Since(self.StartTime).String(),
+	})
+}
+
+// @Summary Readiness
+// @Description readiness probe, checks storage, disk, signing key and config
+// @Produce application/json
+// @Tags health
+// @Router /readyz [GET]
+// @Success	200 {object} health.Report
+// @Failure	503 {object} health.Report
+func Readyz(c *fiber.Ctx) error {
+	report := readiness.Run(c.UserContext())
+	status := http.StatusOK
+	if !report.Up() {
+		status = http.StatusServiceUnavailable
+	}
+	return c.Status(status).JSON(report)
+}
@@ -0,0 +1,69 @@
+package http
+
+import (
+	stdtls "crypto/tls"
+	"errors"
+	"net"
+
+	"github.com/shumin1027/otpd/pkg/http"
+	log "github.com/shumin1027/otpd/pkg/logger"
+	"github.com/shumin1027/otpd/pkg/peercred"
+	"github.com/shumin1027/otpd/pkg/tls"
+	"go.uber.org/zap"
+)
+
+// listen creates the tcp listener, wrapped with tls if configured, and the unix socket listener
+func listen(cfg Config) ([]net.Listener, error) {
+	lns := make([]net.Listener, 0, 2)
+	closeAll := func() {
+		for _, ln := range lns {
+			ln.Close()
+		}
+	}
+
+	if !cfg.DisableTCP {
+		ln, err := listenTCP(cfg)
+		if err != nil {
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+
+	if cfg.Unix.Path != "" {
+		ln, err := peercred.Listen(cfg.Unix)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		log.L().Info("listening on unix socket", zap.String("path", cfg.Unix.Path))
+		lns = append(lns, ln)
+	}
+
+	if len(lns) == 0 {
+		return nil, errors.New("no listener configured, enable tcp or set a unix socket path")
+	}
+	return lns, nil
+}
+
+func listenTCP(cfg Config) (net.Listener, error) {
+	ln, err := net.Listen(http.NetworkTCP, cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.TLS.Enabled() {
+		return ln, nil
+	}
+
+	reloader, err := tls.NewReloader(cfg.TLS)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	reloader.OnReload = func() {
+		log.L().Info("tls certificate reloaded", zap.String("cert", cfg.TLS.CertFile))
+	}
+	reloader.OnError = func(err error) {
+		log.L().Error("tls certificate reload failed", zap.Error(err))
+	}
+	return stdtls.NewListener(ln, reloader.ServerConfig()), nil
+}
@@ -0,0 +1,80 @@
+package http
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/shumin1027/otpd/pkg/otp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+// validation results, see otp.Result
+const (
+	resultOK             = string(otp.ResultOK)
+	resultBadCode        = string(otp.ResultBadCode)
+	resultReplay         = string(otp.ResultReplay)
+	resultLocked         = string(otp.ResultLocked)
+	resultError          = string(otp.ResultError)
+	resultUnknownAccount = "unknown_account"
+	resultDisabled       = "disabled"
+)
+
+var (
+	validations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otpd_validations_total",
+		Help: "Passcode validations by result.",
+	}, []string{"result"})
+	enrollments = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "otpd_enrollments_total",
+		Help: "Accounts enrolled with a new OTP key.",
+	})
+	latency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "otpd_http_request_duration_seconds",
+		Help:    "HTTP request latency by route.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"method", "route", "status"})
+
+	metricsHandler = fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
+)
+
+func init() {
+	// 预先创建所有结果，保证抓取时每个结果都有值
+	for _, result := range []string{resultOK, resultBadCode, resultReplay, resultLocked, resultError, resultUnknownAccount, resultDisabled} {
+		validations.WithLabelValues(result)
+	}
+}
+
+// instrument records the latency of every request by matched route
+func instrument() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+		// 错误由fiber的ErrorHandler写入响应，此时状态码还未设置
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			if e, ok := err.(*fiber.Error); ok {
+				status = e.Code
+			}
+		}
+		// 使用路由模板而不是原始路径，避免label数量膨胀
+		route := c.Route().Path
+		latency.WithLabelValues(c.Method(), route, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// @Summary Metrics
+// @Description prometheus metrics in text exposition format
+// @Produce text/plain
+// @Tags metrics
+// @Router /metrics [GET]
+// @Success	200 string string "metrics"
+func Metrics(c *fiber.Ctx) error {
+	metricsHandler(c.Context())
+	return nil
+}
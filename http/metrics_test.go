@@ -0,0 +1,51 @@
+package http
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	app := fiber.New()
+	app.Use(instrument())
+	app.Get("/fail", func(c *fiber.Ctx) error {
+		return errors.New("boom")
+	})
+	app.Get("/missing", func(c *fiber.Ctx) error {
+		return fiber.ErrNotFound
+	})
+	app.Get("/metrics", Metrics)
+
+	for _, path := range []string{"/fail", "/missing"} {
+		if _, err := app.Test(httptest.NewRequest("GET", path, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := testutil.ToFloat64(validations.WithLabelValues(resultReplay))
+	validations.WithLabelValues(resultReplay).Inc()
+	if got := testutil.ToFloat64(validations.WithLabelValues(resultReplay)); got != before+1 {
+		t.Errorf("unexpected replay count %v", got)
+	}
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/metrics", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{
+		`otpd_validations_total{result="replay"}`,
+		// 记录的状态码与ErrorHandler写入的相同
+		`otpd_http_request_duration_seconds_count{method="GET",route="/fail",status="500"} 1`,
+		`otpd_http_request_duration_seconds_count{method="GET",route="/missing",status="404"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package auth
 
 import (
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"os/user"
+	"strconv"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
@@ -12,21 +14,29 @@ import (
 	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/shumin1027/otpd/pkg/pam"
+	"github.com/shumin1027/otpd/pkg/peercred"
+	"github.com/shumin1027/otpd/pkg/tls"
 )
 
 type AuthSchema string
 
 const (
-	AuthSchemaNone   = "None"
-	AuthSchemaBasic  = "Basic"
-	AuthSchemaBearer = "Bearer"
-	AuthSchemaOther  = "Other"
+	AuthSchemaNone     = "None"
+	AuthSchemaBasic    = "Basic"
+	AuthSchemaBearer   = "Bearer"
+	AuthSchemaTLS      = "TLS"
+	AuthSchemaPeerCred = "PeerCred"
+	AuthSchemaOther    = "Other"
 )
 
 type AuthResult struct {
 	AuthSchema AuthSchema
 	Token      jwt.Token
 	User       *user.User
+	// Username mapped from the client certificate or the unix socket peer.
+	Username string
+	// Cred unix socket peer credentials, only set for AuthSchemaPeerCred.
+	Cred *peercred.Cred
 }
 
 // Config defines the config for BasicAuth middleware
@@ -74,6 +84,16 @@ type Config struct {
 	// - "param:<name>"
 	// - "cookie:<name>"
 	TokenLookup string
+
+	// ClientCertIdentity maps a verified client certificate to a username,
+	// requests without Authorization header but with a verified client certificate use AuthSchemaTLS.
+	// Optional. Default: nil, client certificates are ignored.
+	ClientCertIdentity tls.Identity
+
+	// TrustedUIDs unix socket peers running as one of these uids are authenticated
+	// as their local user, requests without Authorization header from such peers use AuthSchemaPeerCred.
+	// Optional. Default: nil, peer credentials are ignored.
+	TrustedUIDs []uint32
 }
 
 // New auth middleware
@@ -146,6 +166,13 @@ func New(config ...Config) fiber.Handler {
 		}
 		// Get auth schema from request
 		authSchema := getAuthSchema(c)
+		if authSchema == AuthSchemaNone {
+			if cred, ok := peercred.FromConn(c.Context().Conn()); ok && trusted(cfg.TrustedUIDs, cred.UID) {
+				authSchema = AuthSchemaPeerCred
+			} else if cfg.ClientCertIdentity != nil && clientCert(c) != nil {
+				authSchema = AuthSchemaTLS
+			}
+		}
 
 		if authSchema == AuthSchemaNone {
 			// 执行NoneAuthHandler
@@ -164,6 +191,35 @@ func New(config ...Config) fiber.Handler {
 			return cfg.ErrorHandler(c, fmt.Errorf("AuthSchema:%s not allowed", authSchema))
 		}
 
+		if authSchema == AuthSchemaTLS {
+			username, err := cfg.ClientCertIdentity(clientCert(c))
+			if err != nil {
+				return cfg.ErrorHandler(c, err)
+			}
+			res := &AuthResult{
+				AuthSchema: AuthSchemaTLS,
+				Username:   username,
+			}
+			c.Locals(cfg.ContextKey, res)
+			return cfg.SuccessHandler(c)
+		}
+
+		if authSchema == AuthSchemaPeerCred {
+			cred, _ := peercred.FromConn(c.Context().Conn())
+			u, err := user.LookupId(strconv.FormatUint(uint64(cred.UID), 10))
+			if err != nil {
+				return cfg.ErrorHandler(c, fmt.Errorf("uid:%d not found", cred.UID))
+			}
+			res := &AuthResult{
+				AuthSchema: AuthSchemaPeerCred,
+				User:       u,
+				Username:   u.Username,
+				Cred:       cred,
+			}
+			c.Locals(cfg.ContextKey, res)
+			return cfg.SuccessHandler(c)
+		}
+
 		var auth string
 		var err error
 
@@ -304,6 +360,20 @@ func bearerAuthVerifyByJwt(auth string, alg jwa.SignatureAlgorithm, key jwk.Key,
 	return token, nil
 }
 
+func trusted(uids []uint32, uid uint32) bool {
+	for _, u := range uids {
+		if u == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// clientCert returns the verified client certificate of the connection
+func clientCert(c *fiber.Ctx) *x509.Certificate {
+	return tls.PeerCertificate(c.Context().TLSConnectionState())
+}
+
 func getAuthSchema(c *fiber.Ctx) AuthSchema {
 	auth := c.Get(fiber.HeaderAuthorization)
 	if auth == "" {
@@ -0,0 +1,62 @@
+package http
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/shumin1027/otpd/pkg/http"
+	log "github.com/shumin1027/otpd/pkg/logger"
+	"github.com/shumin1027/otpd/pkg/otp"
+	"github.com/shumin1027/otpd/pkg/replication"
+	"go.uber.org/zap"
+)
+
+// @Summary Replication status
+// @Description role of this instance and, on a follower, the progress of the replication
+// @Produce application/json
+// @Tags admin
+// @Router /admin/replication [GET]
+// @Success	200 {object} replication.Status
+func ReplicationStatus(c *fiber.Ctx) error {
+	return http.Success(c, replication.Current())
+}
+
+// @Summary Promote
+// @Description stop following the leader and accept writes, stop the old leader first
+// @Produce application/json
+// @Tags admin
+// @Router /admin/replication/promote [POST]
+// @Success	200 {object} replication.Status
+func Promote(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := replication.Promote(ctx); err != nil {
+		return http.Fail(c, err.Error(), http.StatusConflict)
+	}
+	return http.Success(c, replication.Current())
+}
+
+// @Summary Record validation
+// @Description apply replay protection and lockout for a validation served by a follower
+// @Accept application/json
+// @Produce application/json
+// @Tags admin
+// @Param body body replication.RecordRequest true "validation"
+// @Router /admin/replication/record [POST]
+// @Success	200 {object} replication.RecordResult
+func RecordValidation(c *fiber.Ctx) error {
+	if replication.IsFollower() {
+		return http.Fail(c, "not the leader", http.StatusMisdirectedRequest)
+	}
+	var req replication.RecordRequest
+	if err := c.BodyParser(&req); err != nil || req.Name == "" {
+		return http.Fail(c, "invalid validation record", http.StatusBadRequest)
+	}
+	result, err := otp.Record(req.Name, req.Passcode, req.OK)
+	if err != nil {
+		log.L().Error("record forwarded validation", zap.String("name", req.Name), zap.Error(err))
+		return http.Error(c, err)
+	}
+	return http.Success(c, replication.RecordResult{Result: result})
+}
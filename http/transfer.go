@@ -0,0 +1,197 @@
+package http
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/shumin1027/otpd/pkg/cluster"
+	"github.com/shumin1027/otpd/pkg/http"
+	log "github.com/shumin1027/otpd/pkg/logger"
+	"github.com/shumin1027/otpd/pkg/otp"
+	"github.com/shumin1027/otpd/pkg/transfer"
+	"go.uber.org/zap"
+)
+
+// HeaderPassphrase passphrase encrypting an export, or decrypting an import
+const HeaderPassphrase = "X-Otpd-Passphrase"
+
+// @Summary Export accounts with secrets
+// @Description export accounts with their secrets as otpauth uris, json or csv, encrypted when a passphrase is given
+// @Produce application/octet-stream
+// @Tags admin
+// @Param format query string false "uri, json, csv, migration, google-authenticator or users-oath, default json"
+// @Param group query string false "only accounts in this group"
+// @Param name query []string false "only these accounts, repeatable"
+// @Param X-Otpd-Passphrase header string false "encrypt the export with this passphrase"
+// @Router /admin/transfer/export [GET]
+// @Success	200 {file} binary
+func TransferExport(c *fiber.Ctx) error {
+	records, err := transfer.Export(context.Background(), c.Query("group"), queryNames(c)...)
+	if err != nil {
+		return http.Error(c, err)
+	}
+	data, err := transfer.Write(records, c.Query("format", transfer.FormatJSON), c.Get(HeaderPassphrase))
+	if err != nil {
+		return http.Fail(c, err.Error(), http.StatusBadRequest)
+	}
+	log.L().Info("accounts exported", zap.Int("accounts", len(records)), zap.String("group", c.Query("group")))
+	c.Set(fiber.HeaderContentType, fiber.MIMEOctetStream)
+	return c.Send(data)
+}
+
+// @Summary Import accounts
+// @Description import accounts with their secrets, the file is the request body. Nothing is imported
+// @Description if a record is invalid, or an account exists with policy fail, the result lists the records.
+// @Accept application/octet-stream
+// @Produce application/json
+// @Tags admin
+// @Param format query string false "a format of export, aegis, andotp or freeotp, detected from the content by default"
+// @Param name query string false "name of the account of a file holding a single one, like ~/.google_authenticator, whose RATE_LIMIT and DISALLOW_REUSE are not enforced"
+// @Param user query string false "import the accounts as the credentials of this user, named user:name and in the group user"
+// @Param policy query string false "skip, overwrite or fail, what to do with existing accounts, default skip"
+// @Param dry_run query bool false "only report what would be imported"
+// @Param X-Otpd-Passphrase header string false "passphrase of an encrypted file or Aegis vault"
+// @Router /admin/transfer/import [POST]
+// @Success	200 {object} transfer.Result
+// @Failure	400 {object} transfer.Result
+// @Failure	409 {object} transfer.Result
+func TransferImport(c *fiber.Ctx) error {
+	policy, err := transfer.ParsePolicy(c.Query("policy"))
+	if err != nil {
+		return http.Fail(c, err.Error(), http.StatusBadRequest)
+	}
+	dryRun, err := strconv.ParseBool(c.Query("dry_run", "false"))
+	if err != nil {
+		return http.Fail(c, "invalid dry_run", http.StatusBadRequest)
+	}
+	records, err := transfer.Read(c.Body(), c.Query("format"), c.Get(HeaderPassphrase))
+	if err != nil {
+		return http.Fail(c, err.Error(), http.StatusBadRequest)
+	}
+	if name := c.Query("name"); name != "" {
+		if err := transfer.SetName(records, name); err != nil {
+			return http.Fail(c, err.Error(), http.StatusBadRequest)
+		}
+	}
+	if user := c.Query("user"); user != "" {
+		if err := transfer.SetUser(records, user); err != nil {
+			return http.Fail(c, err.Error(), http.StatusBadRequest)
+		}
+	}
+
+	result, err := transfer.Import(records, transfer.Options{Policy: policy, DryRun: dryRun})
+	switch {
+	case errors.Is(err, transfer.ErrInvalid), errors.Is(err, transfer.ErrConflict):
+		// 导入被拒绝时同样返回每条记录的结果
+		e := http.ErrBadRequest
+		if errors.Is(err, transfer.ErrConflict) {
+			e = http.ErrConflict
+		}
+		e.Message = err.Error()
+		return c.Status(e.Code).JSON(http.Response{Inventory: result, Error: e})
+	case errors.Is(err, otp.ErrReadOnly), errors.Is(err, cluster.ErrNotLeader):
+		return http.Fail(c, err.Error(), http.StatusServiceUnavailable)
+	case err != nil:
+		return http.Error(c, err)
+	}
+	if !dryRun {
+		log.L().Info("accounts imported", zap.Int("created", result.Created), zap.Int("overwritten", result.Overwritten), zap.Int("skipped", result.Skipped))
+	}
+	return http.Success(c, result)
+}
+
+// @Summary Preview an import
+// @Description list the accounts of a file as import would handle them, with their issuer, type and
+// @Description the action on the existing accounts, without secrets. Invalid records are listed too,
+// @Description tokens otpd can not validate, like hotp or steam, are skipped.
+// @Accept application/octet-stream
+// @Produce application/json
+// @Tags admin
+// @Param format query string false "a format of import, like aegis, andotp or freeotp, detected from the content by default"
+// @Param name query string false "name of the account of a file holding a single one, like ~/.google_authenticator, whose RATE_LIMIT and DISALLOW_REUSE are not enforced"
+// @Param user query string false "import the accounts as the credentials of this user, named user:name and in the group user"
+// @Param policy query string false "skip, overwrite or fail, what to do with existing accounts, default skip"
+// @Param X-Otpd-Passphrase header string false "passphrase of an encrypted file or Aegis vault"
+// @Router /admin/transfer/preview [POST]
+// @Success	200 {object} transfer.Result
+func TransferPreview(c *fiber.Ctx) error {
+	policy, err := transfer.ParsePolicy(c.Query("policy"))
+	if err != nil {
+		return http.Fail(c, err.Error(), http.StatusBadRequest)
+	}
+	records, err := transfer.Read(c.Body(), c.Query("format"), c.Get(HeaderPassphrase))
+	if err != nil {
+		return http.Fail(c, err.Error(), http.StatusBadRequest)
+	}
+	if name := c.Query("name"); name != "" {
+		if err := transfer.SetName(records, name); err != nil {
+			return http.Fail(c, err.Error(), http.StatusBadRequest)
+		}
+	}
+	if user := c.Query("user"); user != "" {
+		if err := transfer.SetUser(records, user); err != nil {
+			return http.Fail(c, err.Error(), http.StatusBadRequest)
+		}
+	}
+	result, err := transfer.Preview(records, policy)
+	if err != nil {
+		return http.Error(c, err)
+	}
+	return http.Success(c, result)
+}
+
+// queryNames the repeated name query parameter
+func queryNames(c *fiber.Ctx) []string {
+	var names []string
+	for _, v := range c.Context().QueryArgs().PeekMulti("name") {
+		names = append(names, string(v))
+	}
+	return names
+}
+
+// MigrationBatch a Google Authenticator "Transfer accounts" QR code
+type MigrationBatch struct {
+	URI string `json:"uri"`
+	// QRCode PNG data uri, like the QR code of an account
+	QRCode string `json:"qr_code"`
+}
+
+// @Summary Google Authenticator migration QR codes
+// @Description the accounts as otpauth-migration uris and QR codes, scanned one after the other with "Transfer accounts"
+// @Produce application/json
+// @Tags admin
+// @Param group query string false "only accounts in this group"
+// @Param name query []string false "only these accounts, repeatable"
+// @Param batch_size query int false "accounts per QR code, default 10"
+// @Router /admin/transfer/migration [GET]
+// @Success	200 {array} MigrationBatch
+func TransferMigration(c *fiber.Ctx) error {
+	batchSize, err := strconv.Atoi(c.Query("batch_size", strconv.Itoa(transfer.DefaultMigrationBatchSize)))
+	if err != nil || batchSize <= 0 {
+		return http.Fail(c, "invalid batch_size", http.StatusBadRequest)
+	}
+	records, err := transfer.Export(context.Background(), c.Query("group"), queryNames(c)...)
+	if err != nil {
+		return http.Error(c, err)
+	}
+	if len(records) == 0 {
+		return http.Fail(c, "no account matched", http.StatusNotFound)
+	}
+	uris, err := transfer.MigrationURIs(records, batchSize)
+	if err != nil {
+		return http.Fail(c, err.Error(), http.StatusBadRequest)
+	}
+	batches := make([]MigrationBatch, 0, len(uris))
+	for _, uri := range uris {
+		img, err := otp.QRCodePNG(uri, 400)
+		if err != nil {
+			return http.Error(c, err)
+		}
+		batches = append(batches, MigrationBatch{URI: uri, QRCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(img)})
+	}
+	log.L().Info("migration qr codes generated", zap.Int("accounts", len(records)), zap.Int("batches", len(batches)))
+	return http.Success(c, batches)
+}
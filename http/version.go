@@ -0,0 +1,65 @@
+package http
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	self "github.com/shumin1027/otpd/app"
+	"github.com/shumin1027/otpd/pkg/http"
+	"github.com/shumin1027/otpd/pkg/json"
+	"github.com/shumin1027/otpd/pkg/otp"
+)
+
+// VersionInfo build and runtime information of the running server
+type VersionInfo struct {
+	Build             self.Build      `json:"build"`
+	StartTime         time.Time       `json:"start_time"`
+	Uptime            string          `json:"uptime"`
+	Features          map[string]bool `json:"features"`
+	JSON              string          `json:"json"`
+	Storage           StorageInfo     `json:"storage"`
+	ConfigFingerprint string          `json:"config_fingerprint"`
+}
+
+// StorageInfo storage mode of the running server, the data path is not exposed
+type StorageInfo struct {
+	Driver string `json:"driver"`
+	Mode   string `json:"mode"`
+}
+
+// version builds the version info for the running config
+func version(cfg Config) VersionInfo {
+	storage := StorageInfo{Mode: "in-memory"}
+	if stor := otp.Storage(); stor != nil {
+		storage.Driver = stor.Driver()
+		if stor.Dir() != "" {
+			storage.Mode = "disk"
+		}
+	}
+	return VersionInfo{
+		Build:     self.GetBuild(),
+		StartTime: self.StartTime,
+		Uptime:    time.Since(self.StartTime).Round(time.Second).String(),
+		Features: map[string]bool{
+			"tls":         cfg.TLS.Enabled(),
+			"mutual_tls":  cfg.TLS.ClientCAFile != "",
+			"unix_socket": cfg.Unix.Path != "",
+			"tcp":         !cfg.DisableTCP,
+		},
+		JSON:              json.Engine,
+		Storage:           storage,
+		ConfigFingerprint: cfg.Fingerprint,
+	}
+}
+
+// @Summary Version
+// @Description build and runtime information
+// @Produce application/json
+// @Tags version
+// @Router /version [GET]
+// @Success	200 {object} VersionInfo
+func Version(cfg Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return http.Success(c, version(cfg))
+	}
+}
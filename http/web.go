@@ -1,12 +1,13 @@
 package http
 
 import (
+	"bytes"
 	"context"
+	stdtls "crypto/tls"
 	"fmt"
+	"net"
 	"os"
-	"os/signal"
 	"strings"
-	"syscall"
 	"time"
 
 	self "github.com/shumin1027/otpd/app"
@@ -15,6 +16,7 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/gofiber/fiber/v2/middleware/proxy"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/lestrrat-go/jwx/jwt"
@@ -22,6 +24,8 @@ import (
 	"github.com/shumin1027/otpd/http/middleware/auth"
 	"github.com/shumin1027/otpd/pkg/http"
 	log "github.com/shumin1027/otpd/pkg/logger"
+	"github.com/shumin1027/otpd/pkg/peercred"
+	"github.com/shumin1027/otpd/pkg/tls"
 	"go.uber.org/zap"
 )
 
@@ -29,27 +33,70 @@ var app = fiber.New(fiber.Config{
 	AppName: self.Name,
 })
 
-const SECRET = "a72cd591-5b57-4ffe-b6e3-e99c317ff43c"
+// minSigningKeySize HS256密钥至少256位
+const minSigningKeySize = 32
 
+// SecretKey key verifying Bearer tokens, nil when no key is configured and Bearer is refused
 var SecretKey jwk.Key
 
-func init() {
-	key, err := jwk.New([]byte(SECRET))
+// loadSigningKey reads the HS256 key of Bearer tokens, surrounding whitespace is ignored
+func loadSigningKey(file string) (jwk.Key, error) {
+	data, err := os.ReadFile(file)
 	if err != nil {
-		panic(any("error for gen secret key"))
+		return nil, err
 	}
-	SecretKey = key
+	data = bytes.TrimSpace(data)
+	if len(data) < minSigningKeySize {
+		return nil, fmt.Errorf("signing key %s is shorter than %d bytes", file, minSigningKeySize)
+	}
+	return jwk.New(data)
+}
+
+// Config web server config
+type Config struct {
+	// Addr tcp listening address, e.g: 0.0.0.0:18181
+	Addr string
+	// TLS serve https when cert and key are set
+	TLS tls.Config
+	// TLSIdentity client certificate field mapped to username, support cn, san-dns, san-email and san-uri
+	TLSIdentity string
+	// DisableTCP serve only on the unix socket
+	DisableTCP bool
+	// Unix unix socket listener, disabled when path is empty
+	Unix peercred.Config
+	// TrustedUIDs unix socket peers authenticated by their uid
+	TrustedUIDs []uint32
+	// AdminUsers users allowed to call the admin APIs
+	AdminUsers []string
+	// JWTKeyFile file holding the HS256 key of Bearer tokens, Bearer is refused when empty
+	JWTKeyFile string
+	// ForwardTLS tls config used to forward writes to a https cluster leader
+	ForwardTLS *stdtls.Config
+	// MinFreeDisk readiness fails when the data directory has less free bytes
+	MinFreeDisk uint64
+	// Fingerprint hash of the effective configuration, reported by /version
+	Fingerprint string
 }
 
+// Start serves on the configured listeners and returns, call Shutdown to stop the server
 // OTP Server API
 // @title OTP Server API
 // @version 1.0
 // @Description OTP Server API
 // @host localhost:18181
 // @BasePath /
-func Start(addr string) {
+func Start(cfg Config) error {
+	if cfg.JWTKeyFile != "" {
+		key, err := loadSigningKey(cfg.JWTKeyFile)
+		if err != nil {
+			return err
+		}
+		SecretKey = key
+	}
+
 	app.Use(cors.New())
 	app.Use(recover.New())
+	app.Use(instrument())
 	app.Use(logger.New(logger.Config{
 		Format:       "${time} ${locals:requestid} ${status} - ${latency} ${method} ${path}\n",
 		TimeFormat:   "2006/01/02 15:04:05",
@@ -57,7 +104,7 @@ func Start(addr string) {
 		TimeInterval: 500 * time.Millisecond,
 	}))
 
-	//app.Use(authentication())
+	//app.Use(authentication(cfg))
 
 	app.Get("/swagger/*", swagger.HandlerDefault)
 	app.Get("/stack", func(c *fiber.Ctx) error {
@@ -65,28 +112,89 @@ func Start(addr string) {
 	})
 
 	app.Get("/ping", Ping)
-	app.Get("/key", GetOTPKeyByNmae)
-	app.Get("/validate", Validate)
+	app.Get("/healthz", Healthz)
+	app.Get("/readyz", Readyz)
+	app.Get("/version", Version(cfg))
+	app.Get("/metrics", Metrics)
+	// 集群模式下写请求转发给leader
+	app.Get("/key", toLeader, GetOTPKeyByNmae)
+	app.Get("/validate", toLeader, Validate)
 	app.Get("/passcode", GetPassCodeByNmae)
 
-	go func() {
-		// service connections
-		log.S().Fatal(app.Listen(addr))
-	}()
+	// 管理接口需要认证，且用户在AdminUsers中
+	authn := authentication(cfg)
+	app.Get("/v1/events", authn, adminOnly(cfg), Events)
+
+	admin := app.Group("/admin", authn, adminOnly(cfg))
+	admin.Post("/backup", Backup)
+	admin.Post("/gc", RunGC)
+	admin.Post("/flatten", Flatten)
+	admin.Get("/accounts", ListAccounts)
+	admin.Get("/accounts/export", ExportAccounts)
+	admin.Get("/accounts/report", AccountReport)
+	admin.Post("/accounts", toLeader, CreateAccount)
+	admin.Get("/accounts/:name", ShowAccount)
+	admin.Delete("/accounts/:name", toLeader, DeleteAccount)
+	admin.Post("/accounts/:name/disable", toLeader, DisableAccount)
+	admin.Post("/accounts/:name/enable", toLeader, EnableAccount)
+	admin.Post("/accounts/:name/rekey", toLeader, RekeyAccount)
+	admin.Get("/transfer/export", TransferExport)
+	admin.Get("/transfer/migration", TransferMigration)
+	admin.Post("/transfer/import", toLeader, TransferImport)
+	admin.Post("/transfer/preview", TransferPreview)
+	admin.Get("/replication", ReplicationStatus)
+	admin.Post("/replication/promote", Promote)
+	admin.Post("/replication/record", RecordValidation)
+	admin.Get("/cluster", ClusterStatus)
+	admin.Post("/cluster/join", toLeader, ClusterJoin)
+	admin.Post("/cluster/remove", toLeader, ClusterRemove)
+
+	if cfg.ForwardTLS != nil {
+		proxy.WithTlsConfig(cfg.ForwardTLS)
+	}
+	registerChecks(cfg)
+
+	lns, err := listen(cfg)
+	if err != nil {
+		return err
+	}
 
-	graceful(app)
+	for _, ln := range lns {
+		go func(ln net.Listener) {
+			// service connections, Shutdown后Listener返回nil
+			if err := app.Listener(ln); err != nil {
+				log.L().Fatal("server stopped", zap.String("addr", ln.Addr().String()), zap.Error(err))
+			}
+		}(ln)
+	}
+	return nil
 }
 
-func authentication() fiber.Handler {
+func authentication(cfg Config) fiber.Handler {
+	var identity tls.Identity
+	if cfg.TLS.ClientCAFile != "" {
+		var err error
+		identity, err = tls.NewIdentity(cfg.TLSIdentity)
+		if err != nil {
+			log.S().Fatal(err)
+		}
+	}
+	schemas := []auth.AuthSchema{auth.AuthSchemaBasic, auth.AuthSchemaTLS, auth.AuthSchemaPeerCred}
+	// 没有配置签名密钥时不接受Bearer，否则任何人都能签发token
+	if SecretKey != nil {
+		schemas = append(schemas, auth.AuthSchemaBearer)
+	}
 	return auth.New(auth.Config{
-		ContextKey:      "auth",
-		SigningKey:      SecretKey,
-		JWTParseOptions: []jwt.ParseOption{jwt.WithSubject("AccessToken")},
-		AuthSchemas:     []auth.AuthSchema{auth.AuthSchemaBasic, auth.AuthSchemaBearer},
+		ContextKey:         "auth",
+		SigningKey:         SecretKey,
+		JWTParseOptions:    []jwt.ParseOption{jwt.WithSubject("AccessToken")},
+		AuthSchemas:        schemas,
+		ClientCertIdentity: identity,
+		TrustedUIDs:        cfg.TrustedUIDs,
 		Filter: func(c *fiber.Ctx) bool {
 			//在验证token之前会调用此方法,如果返回true,则不验证token,直接调用接口
 			uri := string(c.Request().RequestURI())
-			if strings.HasPrefix(uri, "/validate") || strings.HasPrefix(uri, "/swagger") || uri == "/ping" || uri == "/version" || uri == "/stack" {
+			if strings.HasPrefix(uri, "/validate") || strings.HasPrefix(uri, "/swagger") || uri == "/ping" || uri == "/healthz" || uri == "/readyz" || uri == "/metrics" || uri == "/version" || uri == "/stack" {
 				return true
 			} else {
 				return false
@@ -111,32 +219,42 @@ func authentication() fiber.Handler {
 						c.Locals("username", username.(string))
 					}
 				}
+			case auth.AuthSchemaTLS, auth.AuthSchemaPeerCred:
+				{
+					c.Locals("username", result.Username)
+				}
 			}
 			return c.Next()
 		},
 	})
 }
 
-func graceful(app *fiber.App) {
-	// Wait for interrupt signal to gracefully shutdown the server with
-	// a timeout of 5 seconds.
-	quit := make(chan os.Signal, 1)
-	// kill (no param) default send syscall.SIGTERM
-	// kill -2 is syscall.SIGINT
-	// kill -9 is syscall. SIGKILL but can"t be catch, so don't need add it
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	log.S().Info("shutdown server ...")
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := app.Shutdown(); err != nil {
-		log.S().Fatal(fmt.Sprintf("server shutdown:%s", err.Error()))
+// adminOnly allows authenticated users listed in AdminUsers
+func adminOnly(cfg Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		username, _ := c.Locals("username").(string)
+		for _, u := range cfg.AdminUsers {
+			if u == username {
+				return c.Next()
+			}
+		}
+		return c.Status(http.StatusForbidden).SendString("admin privileges required")
 	}
+}
 
-	log.S().Info("running cleanup tasks ...")
-	// Your cleanup tasks go here
-
-	<-ctx.Done()
-	log.S().Info("server exiting")
+// Shutdown stops accepting connections and waits for in-flight requests to finish or ctx to expire
+func Shutdown(ctx context.Context) error {
+	closingOnce.Do(func() {
+		close(closing)
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- app.Shutdown()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -0,0 +1,74 @@
+package http
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+func TestAdminBearer(t *testing.T) {
+	defer func() { SecretKey = nil }()
+	bearer := func(secret string) string {
+		key, err := jwk.New([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		token := jwt.New()
+		token.Set(jwt.SubjectKey, "AccessToken")
+		token.Set("username", "root")
+		signed, err := jwt.Sign(token, jwa.HS256, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + string(signed)
+	}
+	status := func(authorization string) int {
+		cfg := Config{AdminUsers: []string{"root"}}
+		app := fiber.New()
+		app.Get("/admin", authentication(cfg), adminOnly(cfg), func(c *fiber.Ctx) error {
+			return c.SendString("ok")
+		})
+		req := httptest.NewRequest("GET", "/admin", nil)
+		req.Header.Set(fiber.HeaderAuthorization, authorization)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	// 没有配置签名密钥时拒绝所有Bearer token
+	if got := status(bearer("a72cd591-5b57-4ffe-b6e3-e99c317ff43c")); got != fiber.StatusUnauthorized {
+		t.Errorf("bearer without a signing key: %d", got)
+	}
+
+	secret := "0123456789abcdef0123456789abcdef"
+	file := filepath.Join(t.TempDir(), "jwt.key")
+	if err := os.WriteFile(file, []byte(secret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := loadSigningKey(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SecretKey = key
+	if got := status(bearer(secret)); got != fiber.StatusOK {
+		t.Errorf("bearer signed with the key: %d", got)
+	}
+	if got := status(bearer("ffffffffffffffffffffffffffffffff")); got != fiber.StatusUnauthorized {
+		t.Errorf("bearer signed with another key: %d", got)
+	}
+
+	if err := os.WriteFile(file, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSigningKey(file); err == nil {
+		t.Error("expected an error for a short key")
+	}
+}
@@ -0,0 +1,409 @@
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shumin1027/otpd/pkg/json"
+	"golang.org/x/crypto/scrypt"
+)
+
+/*
+备份文件格式:
+
+	magic "OTPDBAK1"
+	uint32 header长度 + header(json)
+	若干chunk: uint32 长度 + 数据，长度为0的chunk表示结束；加密时每个chunk单独使用AES-GCM封装
+	trailer: magic "OTPDEND1" + uint64 version，下次增量备份从该version开始
+
+chunk内是(可选gzip压缩的)store原始备份流。
+*/
+
+const (
+	magic        = "OTPDBAK1"
+	trailerMagic = "OTPDEND1"
+	chunkSize    = 64 << 10
+
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+
+	EncryptionNone   = "none"
+	EncryptionAESGCM = "aes-256-gcm"
+)
+
+// scrypt parameters used to derive the encryption key from the passphrase
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var (
+	ErrBadMagic        = errors.New("not an otpd backup file")
+	ErrPassphrase      = errors.New("backup is encrypted, passphrase required")
+	ErrWrongPassphrase = errors.New("wrong passphrase or corrupted backup")
+)
+
+// Header describes how a backup file was written
+type Header struct {
+	Created     time.Time `json:"created"`
+	Driver      string    `json:"driver"`
+	Since       uint64    `json:"since"`
+	Compression string    `json:"compression"`
+	Encryption  string    `json:"encryption"`
+	Salt        []byte    `json:"salt,omitempty"`
+	NoncePrefix []byte    `json:"nonce_prefix,omitempty"`
+}
+
+// Options backup file options
+type Options struct {
+	Driver     string
+	Since      uint64
+	Compress   bool
+	Passphrase string
+}
+
+// DeriveKey derives an AES-256-GCM cipher from the passphrase with scrypt, also used for account exports
+func DeriveKey(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(prefix []byte, counter uint64) []byte {
+	n := make([]byte, 12)
+	copy(n, prefix[:4])
+	binary.BigEndian.PutUint64(n[4:], counter)
+	return n
+}
+
+// chunkWriter frames and optionally encrypts the data written to it
+type chunkWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint64
+	buf     []byte
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		m := chunkSize - len(c.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		c.buf = append(c.buf, p[:m]...)
+		p = p[m:]
+		if len(c.buf) == chunkSize {
+			if err := c.flush(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (c *chunkWriter) flush(final bool) error {
+	data := c.buf
+	if c.aead != nil {
+		// 最后一个chunk的附加数据不同，防止文件被截断后仍能解密
+		ad := []byte{0}
+		if final {
+			ad[0] = 1
+		}
+		data = c.aead.Seal(nil, nonce(c.prefix, c.counter), data, ad)
+		c.counter++
+	}
+	if len(data) > 0 {
+		if err := binary.Write(c.w, binary.BigEndian, uint32(len(data))); err != nil {
+			return err
+		}
+		if _, err := c.w.Write(data); err != nil {
+			return err
+		}
+	}
+	c.buf = c.buf[:0]
+	return nil
+}
+
+// Writer writes a backup file, the raw store backup is written to it
+type Writer struct {
+	w     io.Writer
+	chunk *chunkWriter
+	gz    *gzip.Writer
+}
+
+// NewWriter writes the header and returns a writer for the store backup stream
+func NewWriter(w io.Writer, opts Options) (*Writer, error) {
+	h := Header{
+		Created:     time.Now(),
+		Driver:      opts.Driver,
+		Since:       opts.Since,
+		Compression: CompressionNone,
+		Encryption:  EncryptionNone,
+	}
+	chunk := &chunkWriter{w: w, buf: make([]byte, 0, chunkSize)}
+	if opts.Passphrase != "" {
+		h.Encryption = EncryptionAESGCM
+		h.Salt = make([]byte, 16)
+		h.NoncePrefix = make([]byte, 4)
+		if _, err := rand.Read(h.Salt); err != nil {
+			return nil, err
+		}
+		if _, err := rand.Read(h.NoncePrefix); err != nil {
+			return nil, err
+		}
+		aead, err := DeriveKey(opts.Passphrase, h.Salt)
+		if err != nil {
+			return nil, err
+		}
+		chunk.aead = aead
+		chunk.prefix = h.NoncePrefix
+	}
+	if opts.Compress {
+		h.Compression = CompressionGzip
+	}
+
+	buf, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, magic); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(buf))); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(buf); err != nil {
+		return nil, err
+	}
+
+	bw := &Writer{w: w, chunk: chunk}
+	if opts.Compress {
+		bw.gz = gzip.NewWriter(chunk)
+	}
+	return bw, nil
+}
+
+func (bw *Writer) Write(p []byte) (int, error) {
+	if bw.gz != nil {
+		return bw.gz.Write(p)
+	}
+	return bw.chunk.Write(p)
+}
+
+// Close flushes the remaining data and writes the trailer with the version
+// to start the next incremental backup from.
+func (bw *Writer) Close(version uint64) error {
+	if bw.gz != nil {
+		if err := bw.gz.Close(); err != nil {
+			return err
+		}
+	}
+	if err := bw.chunk.flush(true); err != nil {
+		return err
+	}
+	// 结束标记
+	if err := binary.Write(bw.w, binary.BigEndian, uint32(0)); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(bw.w, trailerMagic); err != nil {
+		return err
+	}
+	return binary.Write(bw.w, binary.BigEndian, version)
+}
+
+// chunkReader reads and optionally decrypts framed chunks
+type chunkReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint64
+	buf     []byte
+	final   bool
+	done    bool
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *chunkReader) next() error {
+	var size uint32
+	if err := binary.Read(c.r, binary.BigEndian, &size); err != nil {
+		return errors.Wrap(err, "read chunk")
+	}
+	if size == 0 {
+		// 加密时最后一个chunk必须已经读到，否则文件被截断或篡改
+		if c.aead != nil && !c.final {
+			return ErrWrongPassphrase
+		}
+		c.done = true
+		return nil
+	}
+	if size > chunkSize+64 {
+		return fmt.Errorf("invalid chunk size %d", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return errors.Wrap(err, "read chunk")
+	}
+	if c.aead != nil {
+		if c.final {
+			return ErrWrongPassphrase
+		}
+		n := nonce(c.prefix, c.counter)
+		c.counter++
+		plain, err := c.aead.Open(nil, n, data, []byte{0})
+		if err != nil {
+			plain, err = c.aead.Open(nil, n, data, []byte{1})
+			if err != nil {
+				return ErrWrongPassphrase
+			}
+			c.final = true
+		}
+		data = plain
+	}
+	c.buf = data
+	return nil
+}
+
+// Reader reads a backup file, yielding the raw store backup stream
+type Reader struct {
+	Header  Header
+	r       *bufio.Reader
+	chunk   *chunkReader
+	body    io.Reader
+	version uint64
+	trailer bool
+}
+
+// NewReader reads the header, passphrase is required if the backup is encrypted
+func NewReader(r io.Reader, passphrase string) (*Reader, error) {
+	br := bufio.NewReader(r)
+	m := make([]byte, len(magic))
+	if _, err := io.ReadFull(br, m); err != nil || string(m) != magic {
+		return nil, ErrBadMagic
+	}
+	var size uint32
+	if err := binary.Read(br, binary.BigEndian, &size); err != nil {
+		return nil, errors.Wrap(err, "read header")
+	}
+	if size > 1<<20 {
+		return nil, ErrBadMagic
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return nil, errors.Wrap(err, "read header")
+	}
+	var h Header
+	if err := json.Unmarshal(buf, &h); err != nil {
+		return nil, errors.Wrap(err, "decode header")
+	}
+
+	chunk := &chunkReader{r: br}
+	switch h.Encryption {
+	case EncryptionNone, "":
+	case EncryptionAESGCM:
+		if passphrase == "" {
+			return nil, ErrPassphrase
+		}
+		if len(h.NoncePrefix) != 4 {
+			return nil, errors.New("invalid nonce prefix")
+		}
+		aead, err := DeriveKey(passphrase, h.Salt)
+		if err != nil {
+			return nil, err
+		}
+		chunk.aead = aead
+		chunk.prefix = h.NoncePrefix
+	default:
+		return nil, fmt.Errorf("unsupported backup encryption: %s", h.Encryption)
+	}
+
+	rd := &Reader{Header: h, r: br, chunk: chunk, body: chunk}
+	switch h.Compression {
+	case CompressionNone, "":
+	case CompressionGzip:
+		// gzip头在第一个chunk里，延迟到第一次Read再解析
+		rd.body = &lazyGzip{r: chunk}
+	default:
+		return nil, fmt.Errorf("unsupported backup compression: %s", h.Compression)
+	}
+	return rd, nil
+}
+
+func (rd *Reader) Read(p []byte) (int, error) {
+	n, err := rd.body.Read(p)
+	if err == io.EOF {
+		if terr := rd.readTrailer(); terr != nil {
+			return n, terr
+		}
+	}
+	return n, err
+}
+
+func (rd *Reader) readTrailer() error {
+	if rd.trailer {
+		return nil
+	}
+	// 确保chunk都已读完，gzip可能在结束标记之前就返回EOF
+	if _, err := io.Copy(io.Discard, rd.chunk); err != nil {
+		return err
+	}
+	m := make([]byte, len(trailerMagic))
+	if _, err := io.ReadFull(rd.r, m); err != nil || string(m) != trailerMagic {
+		return errors.New("backup trailer missing, file is truncated")
+	}
+	if err := binary.Read(rd.r, binary.BigEndian, &rd.version); err != nil {
+		return errors.Wrap(err, "read trailer")
+	}
+	rd.trailer = true
+	return nil
+}
+
+// Version the version to start the next incremental backup from, available after the body is read
+func (rd *Reader) Version() uint64 {
+	return rd.version
+}
+
+type lazyGzip struct {
+	r  io.Reader
+	gz *gzip.Reader
+}
+
+func (l *lazyGzip) Read(p []byte) (int, error) {
+	if l.gz == nil {
+		gz, err := gzip.NewReader(l.r)
+		if err != nil {
+			return 0, err
+		}
+		l.gz = gz
+	}
+	return l.gz.Read(p)
+}
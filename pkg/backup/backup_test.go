@@ -0,0 +1,76 @@
+package backup
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func roundTrip(t *testing.T, opts Options, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(42); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("otpd backup data "), 10000)
+	for _, opts := range []Options{
+		{},
+		{Compress: true},
+		{Passphrase: "secret"},
+		{Compress: true, Passphrase: "secret", Since: 7},
+	} {
+		file := roundTrip(t, opts, data)
+		r, err := NewReader(bytes.NewReader(file), opts.Passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%+v: data mismatch", opts)
+		}
+		if r.Version() != 42 || r.Header.Since != opts.Since {
+			t.Fatalf("%+v: unexpected version %d, since %d", opts, r.Version(), r.Header.Since)
+		}
+	}
+}
+
+func TestBackupPassphrase(t *testing.T) {
+	file := roundTrip(t, Options{Passphrase: "secret"}, []byte("data"))
+	if _, err := NewReader(bytes.NewReader(file), ""); err != ErrPassphrase {
+		t.Fatalf("expected ErrPassphrase, got %v", err)
+	}
+	r, err := NewReader(bytes.NewReader(file), "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != ErrWrongPassphrase {
+		t.Fatalf("expected ErrWrongPassphrase, got %v", err)
+	}
+}
+
+func TestBackupTruncated(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 3*chunkSize)
+	file := roundTrip(t, Options{Passphrase: "secret"}, data)
+	// 去掉最后一个chunk和trailer
+	truncated := file[:len(file)-chunkSize/2]
+	r, err := NewReader(bytes.NewReader(truncated), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Fatal("expected error for truncated backup")
+	}
+}
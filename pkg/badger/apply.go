@@ -0,0 +1,75 @@
+package badger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pkg/errors"
+	"github.com/shumin1027/otpd/pkg/store"
+)
+
+var _ store.Applier = (*Store)(nil)
+
+// bitDelete badger内部的删除标记位，Backup输出的Meta中会保留
+const bitDelete byte = 1 << 0
+
+// Apply 读取Backup的输出并以普通写入的方式应用，与Load不同，版本号由本地重新分配，
+// 不会与本地之后的写入冲突，且会触发Subscribe。返回写入的key数量
+func (s *Store) Apply(r io.Reader, skip []byte) (int, error) {
+	br := bufio.NewReaderSize(r, 16<<10)
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	// 同一个key的多个版本从新到旧排列，只应用最新的版本
+	applied := make(map[string]bool)
+	now := uint64(time.Now().Unix())
+	var buf []byte
+	for {
+		var sz uint64
+		err := binary.Read(br, binary.LittleEndian, &sz)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return len(applied), errors.Wrap(err, "read entry size")
+		}
+		if uint64(cap(buf)) < sz {
+			buf = make([]byte, sz)
+		}
+		buf = buf[:sz]
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return len(applied), errors.Wrap(err, "read entries")
+		}
+		var list badger.KVList
+		if err := list.Unmarshal(buf); err != nil {
+			return len(applied), errors.Wrap(err, "decode entries")
+		}
+
+		for _, kv := range list.Kv {
+			if applied[string(kv.Key)] || (len(skip) > 0 && bytes.HasPrefix(kv.Key, skip)) {
+				continue
+			}
+			applied[string(kv.Key)] = true
+			key := append([]byte(nil), kv.Key...)
+			deleted := len(kv.Meta) > 0 && kv.Meta[0]&bitDelete > 0
+			if deleted || (kv.ExpiresAt > 0 && kv.ExpiresAt <= now) {
+				err = wb.Delete(key)
+			} else {
+				e := badger.NewEntry(key, append([]byte(nil), kv.Value...))
+				if len(kv.UserMeta) > 0 {
+					e = e.WithMeta(kv.UserMeta[0])
+				}
+				e.ExpiresAt = kv.ExpiresAt
+				err = wb.SetEntry(e)
+			}
+			if err != nil {
+				return len(applied), err
+			}
+		}
+	}
+	return len(applied), wb.Flush()
+}
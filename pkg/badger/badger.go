@@ -1,22 +1,40 @@
 package badger
 
 import (
+	"bytes"
+	"io"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/pkg/errors"
+	"github.com/shumin1027/otpd/pkg/store"
 	"go.uber.org/zap"
 )
 
 // Store is a wrapper around a badger DB
 type Store struct {
-	db *badger.DB
+	db  *badger.DB
+	dir string
+
+	mu      sync.RWMutex
+	indexes map[string][]*index // bucket name -> indexes
 }
 
-var stor *Store
+var (
+	_ store.Store      = (*Store)(nil)
+	_ store.Backuper   = (*Store)(nil)
+	_ store.Maintainer = (*Store)(nil)
+)
 
 func Open(dbPath string, logger *zap.Logger) (*Store, error) {
+	return OpenEncrypted(dbPath, Encryption{}, logger)
+}
+
+// OpenEncrypted opens the store encrypted with enc.Key, returns ErrEncryptionKey if the key is wrong
+func OpenEncrypted(dbPath string, enc Encryption, logger *zap.Logger) (*Store, error) {
 	opts := badger.DefaultOptions("")
 
 	opts.Logger = NewLogger(logger)
@@ -29,23 +47,27 @@ func Open(dbPath string, logger *zap.Logger) (*Store, error) {
 		opts.Dir = dbPath
 		opts.ValueDir = dbPath
 	}
-	db, err := badger.Open(opts) //文件只能被一个进程使用，如果不调用Close则下次无法Open。手动释放锁的办法：把LOCK文件删掉
-	if err != nil {
-		panic(err)
-	}
-	stor = &Store{db}
+	opts = enc.apply(opts)
+	db, err := open(opts) //文件只能被一个进程使用，如果不调用Close则下次无法Open。手动释放锁的办法：把LOCK文件删掉
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return stor, err
+	stor := &Store{db: db, dir: opts.Dir, indexes: make(map[string][]*index)}
+	registerMetrics(stor)
+	return stor, nil
 }
 
 func (s *Store) CreateBucket(name string) *Bucket {
-	return &Bucket{
-		name:   name,
-		prefix: name + ":",
-		stor:   stor,
-	}
+	return CreateBucket(name, s)
+}
+
+// Bucket implements store.Store
+func (s *Store) Bucket(name string) store.Bucket {
+	return s.CreateBucket(name)
+}
+
+func (s *Store) Driver() string {
+	return store.DriverBadger
 }
 
 func (s *Store) Set(k, v []byte) error {
@@ -66,46 +88,50 @@ func (s *Store) SetWithTTL(k, v []byte, expireAt int64) error {
 	return err
 }
 
-//BatchSet 多个写操作使用一个事务
+//BatchSet 多个写操作使用一个事务，事务过大时先提交已写入的部分，再开一个新事务继续写入
 func (s *Store) BatchSet(keys, values [][]byte) error {
 	if len(keys) != len(values) {
 		return errors.New("key value not the same length")
 	}
-
-	// Start a writable transaction.
-	txn := s.db.NewTransaction(true)
-	defer txn.Discard()
-
+	entries := make([]*badger.Entry, len(keys))
 	for i, key := range keys {
-		value := values[i]
-		// Use the transaction...
-		err := txn.Set(key, value)
-		return err
+		entries[i] = badger.NewEntry(key, values[i])
 	}
-	// Commit the transaction and check for error.
-	err := txn.Commit()
-	return err
+	return s.batchSet(entries)
 }
 
-//BatchSet 多个写操作使用一个事务
+//BatchSetWithTTL 同BatchSet，每个key在对应的expireAt过期
 func (s *Store) BatchSetWithTTL(keys, values [][]byte, expireAts []int64) error {
-	if len(keys) != len(values) {
+	if len(keys) != len(values) || len(keys) != len(expireAts) {
 		return errors.New("key value not the same length")
 	}
-	// Start a writable transaction.
-	txn := s.db.NewTransaction(true)
-	defer txn.Discard()
+	entries := make([]*badger.Entry, len(keys))
 	for i, key := range keys {
-		value := values[i]
 		duration := time.Duration(expireAts[i]-time.Now().Unix()) * time.Second
-		// Use the transaction...
-		e := badger.NewEntry(key, value).WithTTL(duration)
+		entries[i] = badger.NewEntry(key, values[i]).WithTTL(duration)
+	}
+	return s.batchSet(entries)
+}
+
+func (s *Store) batchSet(entries []*badger.Entry) error {
+	txn := s.db.NewTransaction(true)
+	defer func() {
+		txn.Discard()
+	}()
+	for _, e := range entries {
 		err := txn.SetEntry(e)
-		return err
+		if err == badger.ErrTxnTooBig {
+			if err := txn.Commit(); err != nil {
+				return err
+			}
+			txn = s.db.NewTransaction(true)
+			err = txn.SetEntry(e)
+		}
+		if err != nil {
+			return err
+		}
 	}
-	// Commit the transaction and check for error.
-	err := txn.Commit()
-	return err
+	return txn.Commit()
 }
 
 //Get 如果key不存在会返回error:Key not found
@@ -278,18 +304,144 @@ func (s *Store) IterKeysByPrefix(prefix string, fn func(k []byte) error) int64 {
 	return atomic.LoadInt64(&total)
 }
 
+//ScanByPrefix 从start开始按key顺序遍历prefix下的key，fn返回false时停止
+func (s *Store) ScanByPrefix(prefix, start []byte, fn func(k, v []byte) bool) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(start); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if !fn(item.KeyCopy(nil), val) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+//Update 在一个读写事务中读取并重写k，保留原有的过期时间
+func (s *Store) Update(k []byte, fn func(v []byte, ok bool) ([]byte, error)) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		var old []byte
+		var expiresAt uint64
+		item, err := txn.Get(k)
+		found := err == nil
+		switch err {
+		case nil:
+			if old, err = item.ValueCopy(nil); err != nil {
+				return err
+			}
+			expiresAt = item.ExpiresAt()
+		case badger.ErrKeyNotFound:
+		default:
+			return err
+		}
+		v, err := fn(old, found)
+		if err != nil {
+			return err
+		}
+		e := badger.NewEntry(k, v)
+		e.ExpiresAt = expiresAt
+		return txn.SetEntry(e)
+	})
+}
+
 func (s *Store) CheckAndGC() {
+	s.RunGC(0.5)
+}
+
+//RunGC 循环执行value log GC，直到没有可回收的文件，返回重写的文件数
+func (s *Store) RunGC(discardRatio float64) (int, error) {
+	if s.dir == "" {
+		// 内存模式没有value log
+		return 0, nil
+	}
+	start := time.Now()
+	defer func() {
+		gcDuration.Observe(time.Since(start).Seconds())
+	}()
+	rewrites := 0
 	for {
-		if err := s.db.RunValueLogGC(0.5); err == badger.ErrNoRewrite || err == badger.ErrRejected {
-			break
+		err := s.db.RunValueLogGC(discardRatio)
+		if err == badger.ErrNoRewrite || err == badger.ErrRejected {
+			gcRuns.WithLabelValues("no_rewrite").Inc()
+			return rewrites, nil
 		}
+		if err != nil {
+			gcRuns.WithLabelValues("error").Inc()
+			return rewrites, err
+		}
+		gcRuns.WithLabelValues("rewritten").Inc()
+		rewrites++
 	}
 }
 
+//Flatten 强制压缩LSM tree，使所有table处于同一层，恢复备份后建议执行
+func (s *Store) Flatten(workers int) error {
+	err := s.db.Flatten(workers)
+	if err != nil {
+		flattens.WithLabelValues("error").Inc()
+		return err
+	}
+	flattens.WithLabelValues("ok").Inc()
+	return nil
+}
+
+// Dir 数据目录，内存模式下为空
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Probe 写入并读回一个短期key，用于检查存储是否可读写
+func (s *Store) Probe() error {
+	k := []byte("__health:probe")
+	v := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry(k, v).WithTTL(time.Minute))
+	})
+	if err != nil {
+		return errors.Wrap(err, "write probe")
+	}
+	got, err := s.Get(k)
+	if err != nil {
+		return errors.Wrap(err, "read probe")
+	}
+	if !bytes.Equal(got, v) {
+		return errors.New("probe value mismatch")
+	}
+	return nil
+}
+
 func (s *Store) Size() (int64, int64) {
 	return s.db.Size()
 }
 
+//Backup 在一个只读事务快照上导出版本大于since的数据，可在运行中调用。
+//返回下次增量备份使用的since，即本次导出的最大版本。
+//badger v3的迭代器按SinceTs跳过版本小于等于since的数据，所以不需要加1
+func (s *Store) Backup(w io.Writer, since uint64) (uint64, error) {
+	version, err := s.db.Backup(w, since)
+	if err != nil {
+		return 0, err
+	}
+	// 没有新数据时badger返回0
+	if version < since {
+		return since, nil
+	}
+	return version, nil
+}
+
+//Load 导入Backup导出的数据，导入期间不应有其他写入
+func (s *Store) Load(r io.Reader) error {
+	return s.db.Load(r, 256)
+}
+
 //Clean 清空所有数据
 func (s *Store) Clean() error {
 	return s.db.DropAll()
@@ -297,5 +449,6 @@ func (s *Store) Clean() error {
 
 //Close 把内存中的数据flush到磁盘，同时释放文件锁
 func (s *Store) Close() error {
+	unregisterMetrics(s)
 	return s.db.Close()
 }
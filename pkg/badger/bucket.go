@@ -1,13 +1,15 @@
 package badger
 
 import (
-	"context"
 	"github.com/dgraph-io/badger/v3"
-	"github.com/dgraph-io/badger/v3/pb"
-	"github.com/dgraph-io/ristretto/z"
-	"log"
-	"runtime"
-	"sync/atomic"
+	"github.com/pkg/errors"
+	"github.com/shumin1027/otpd/pkg/store"
+)
+
+var (
+	_ store.Bucket  = (*Bucket)(nil)
+	_ store.Indexer = (*Bucket)(nil)
+	_ store.Streamer = (*Bucket)(nil)
 )
 
 type Bucket struct {
@@ -25,17 +27,26 @@ func CreateBucket(name string, stor *Store) *Bucket {
 }
 
 func (s *Bucket) Set(k, v []byte) error {
+	if indexes := s.stor.indexesOf(s.name); len(indexes) > 0 {
+		return s.writeIndexed(indexes, [][]byte{k}, [][]byte{v}, nil, false)
+	}
 	k = []byte(s.prefix + string(k))
 	return s.stor.Set(k, v)
 }
 
 func (s *Bucket) SetWithTTL(k, v []byte, expireAt int64) error {
+	if indexes := s.stor.indexesOf(s.name); len(indexes) > 0 {
+		return s.writeIndexed(indexes, [][]byte{k}, [][]byte{v}, []int64{expireAt}, false)
+	}
 	k = []byte(s.prefix + string(k))
 	return s.stor.SetWithTTL(k, v, expireAt)
 }
 
 //BatchSet 多个写操作使用一个事务
 func (s *Bucket) BatchSet(keys, values [][]byte) error {
+	if indexes := s.stor.indexesOf(s.name); len(indexes) > 0 {
+		return s.writeIndexed(indexes, keys, values, nil, false)
+	}
 	for i := 0; i < len(keys); i++ {
 		k := keys[i]
 		k = []byte(s.prefix + string(k))
@@ -46,6 +57,9 @@ func (s *Bucket) BatchSet(keys, values [][]byte) error {
 
 //BatchSet 多个写操作使用一个事务
 func (s *Bucket) BatchSetWithTTL(keys, values [][]byte, expireAts []int64) error {
+	if indexes := s.stor.indexesOf(s.name); len(indexes) > 0 {
+		return s.writeIndexed(indexes, keys, values, expireAts, false)
+	}
 	for i := 0; i < len(keys); i++ {
 		k := keys[i]
 		k = []byte(s.prefix + string(k))
@@ -54,10 +68,14 @@ func (s *Bucket) BatchSetWithTTL(keys, values [][]byte, expireAts []int64) error
 	return s.stor.BatchSetWithTTL(keys, values, expireAts)
 }
 
-//Get 如果key不存在会返回error:Key not found
+//Get 如果key不存在会返回store.ErrNotFound
 func (s *Bucket) Get(k []byte) ([]byte, error) {
 	k = []byte(s.prefix + string(k))
-	return s.stor.Get(k)
+	v, err := s.stor.Get(k)
+	if err == badger.ErrKeyNotFound {
+		return nil, store.ErrNotFound
+	}
+	return v, err
 }
 
 //BatchGet 返回的values与传入的keys顺序保持一致。如果key不存在或读取失败则对应的value是空数组
@@ -72,12 +90,18 @@ func (s *Bucket) BatchGet(keys [][]byte) ([][]byte, error) {
 
 //Delete
 func (s *Bucket) Delete(k []byte) error {
+	if indexes := s.stor.indexesOf(s.name); len(indexes) > 0 {
+		return s.writeIndexed(indexes, [][]byte{k}, [][]byte{nil}, nil, true)
+	}
 	k = []byte(s.prefix + string(k))
 	return s.stor.Delete(k)
 }
 
 //BatchDelete
 func (s *Bucket) BatchDelete(keys [][]byte) error {
+	if indexes := s.stor.indexesOf(s.name); len(indexes) > 0 {
+		return s.writeIndexed(indexes, keys, make([][]byte, len(keys)), nil, true)
+	}
 	for i := 0; i < len(keys); i++ {
 		k := keys[i]
 		k = []byte(s.prefix + string(k))
@@ -92,76 +116,82 @@ func (s *Bucket) Has(k []byte) bool {
 	return s.stor.Has(k)
 }
 
-//IterDB 遍历整个DB
+//Iter 遍历bucket，传给fn的key不含bucket前缀
 func (s *Bucket) Iter(fn func(k, v []byte) error) int64 {
-	return s.stor.IterByPrefix(s.prefix, fn)
+	return s.stor.IterByPrefix(s.prefix, func(k, v []byte) error {
+		return fn(k[len(s.prefix):], v)
+	})
 }
 
 //IterKey 只遍历key。key是全部存在LSM tree上的，只需要读内存，所以很快
 func (s *Bucket) IterKeys(fn func(k []byte) error) int64 {
-	return s.stor.IterKeysByPrefix(s.prefix, fn)
-}
-
-func (s *Bucket) Stream(fn func(k []byte, v []byte) error) int64 {
-	var total int64
-	stream := s.stor.db.NewStream()
-	// -- Optional settings
-	stream.NumGo = runtime.NumCPU() * 2   // Set number of goroutines to use for iteration.
-	stream.Prefix = []byte(s.prefix)      // Leave nil for iteration over the whole DB.
-	stream.LogPrefix = "Badger.Streaming" // For identifying stream logs. Outputs to Logger.
-
-	stream.KeyToList = func(key []byte, itr *badger.Iterator) (*pb.KVList, error) {
-		item := itr.Item()
-		val, err := item.ValueCopy(nil)
-		if err != nil {
-			return nil, err
-		}
-		err = fn(key, val)
-		if err != nil {
-			return nil, err
-		}
-		atomic.AddInt64(&total, 1)
-		return stream.ToList(key, itr)
-	}
-	stream.Send = func(buf *z.Buffer) error {
-		return nil
+	return s.stor.IterKeysByPrefix(s.prefix, func(k []byte) error {
+		return fn(k[len(s.prefix):])
+	})
+}
+
+//Scan 从start开始按key顺序遍历bucket，传给fn的key不含bucket前缀
+func (s *Bucket) Scan(start []byte, fn func(k, v []byte) bool) error {
+	prefix := []byte(s.prefix)
+	return s.stor.ScanByPrefix(prefix, append(prefix, start...), func(k, v []byte) bool {
+		return fn(k[len(prefix):], v)
+	})
+}
+
+//Update 在一个事务中读取并重写k
+func (s *Bucket) Update(k []byte, fn func(v []byte, ok bool) ([]byte, error)) error {
+	if indexes := s.stor.indexesOf(s.name); len(indexes) > 0 {
+		return s.stor.db.Update(func(txn *badger.Txn) error {
+			var old []byte
+			var expiresAt uint64
+			item, err := txn.Get([]byte(s.prefix + string(k)))
+			found := err == nil
+			switch err {
+			case nil:
+				if old, err = item.ValueCopy(nil); err != nil {
+					return err
+				}
+				expiresAt = item.ExpiresAt()
+			case badger.ErrKeyNotFound:
+			default:
+				return err
+			}
+			v, err := fn(old, found)
+			if err != nil {
+				return err
+			}
+			return writeIndexed(txn, indexes, s.prefix, k, v, expiresAt, false)
+		})
 	}
-	// Run the stream
-	if err := stream.Orchestrate(context.Background()); err != nil {
-		log.Panic(err)
+	k = []byte(s.prefix + string(k))
+	return s.stor.Update(k, fn)
+}
+
+//writeIndexed 在一个事务中写入或删除多个key并更新索引
+func (s *Bucket) writeIndexed(indexes []*index, keys, values [][]byte, expireAts []int64, del bool) error {
+	if len(keys) != len(values) {
+		return errors.New("key value not the same length")
 	}
-	// Done.
-	return atomic.LoadInt64(&total)
-}
-
-func (s *Bucket) Chan(ch chan<- interface{}) int64 {
-	var total int64
-	stream := s.stor.db.NewStream()
-	// -- Optional settings
-	stream.NumGo = runtime.NumCPU() * 2   // Set number of goroutines to use for iteration.
-	stream.Prefix = []byte(s.prefix)      // Leave nil for iteration over the whole DB.
-	stream.LogPrefix = "Badger.Streaming" // For identifying stream logs. Outputs to Logger.
-
-	stream.KeyToList = func(key []byte, itr *badger.Iterator) (*pb.KVList, error) {
-		item := itr.Item()
-		val, err := item.ValueCopy(nil)
-		if err != nil {
-			return nil, err
+	return s.stor.db.Update(func(txn *badger.Txn) error {
+		for i, k := range keys {
+			var expiresAt uint64
+			if expireAts != nil {
+				expiresAt = uint64(expireAts[i])
+			}
+			if err := writeIndexed(txn, indexes, s.prefix, k, values[i], expiresAt, del); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+}
 
-		// send value to channel
-		ch <- val
+//AddIndex 注册索引，写入bucket时在同一个事务中维护索引
+func (s *Bucket) AddIndex(idx store.Index) error {
+	return s.stor.AddIndex(s.name, idx)
+}
 
-		atomic.AddInt64(&total, 1)
-		return stream.ToList(key, itr)
-	}
-	stream.Send = func(buf *z.Buffer) error {
-		return nil
-	}
-	// Run the stream
-	if err := stream.Orchestrate(context.Background()); err != nil {
-		log.Panic(err)
-	}
-	// Done.
-	return atomic.LoadInt64(&total)
+//IndexScan 按索引值范围查询，传给fn的是bucket内的key
+func (s *Bucket) IndexScan(name string, start, end []byte, fn func(k []byte) bool) error {
+	return s.stor.IndexScan(s.name, name, start, end, fn)
 }
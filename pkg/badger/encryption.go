@@ -0,0 +1,114 @@
+package badger
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pkg/errors"
+)
+
+// ErrEncryptionKey returned by Open when the key does not match the one the data was written with
+var ErrEncryptionKey = errors.New("wrong encryption key, or the data is encrypted and no key was given")
+
+// Encryption encrypts the data files at rest, see badger.Options.EncryptionKey
+type Encryption struct {
+	// Key AES key of 16, 24 or 32 bytes, encryption is disabled when empty
+	Key []byte
+	// RotationDuration how often a new data key is generated, default to 10 days
+	RotationDuration time.Duration
+}
+
+// indexCacheSize 加密后每次读取都要解密索引，缓存解密后的索引
+const indexCacheSize = 100 << 20
+
+func (e Encryption) apply(opts badger.Options) badger.Options {
+	if len(e.Key) == 0 {
+		return opts
+	}
+	opts.EncryptionKey = e.Key
+	if e.RotationDuration > 0 {
+		opts.EncryptionKeyRotationDuration = e.RotationDuration
+	}
+	opts.IndexCacheSize = indexCacheSize
+	return opts
+}
+
+// ParseKey decodes an encryption key written as hex, base64 or raw bytes,
+// surrounding whitespace is ignored
+func ParseKey(data []byte) ([]byte, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, errors.New("empty encryption key")
+	}
+	if key, err := hex.DecodeString(string(data)); err == nil && validKeySize(len(key)) {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(string(data)); err == nil && validKeySize(len(key)) {
+		return key, nil
+	}
+	if validKeySize(len(data)) {
+		return data, nil
+	}
+	return nil, fmt.Errorf("encryption key must be 16, 24 or 32 bytes, as hex, base64 or raw, got %d bytes", len(data))
+}
+
+func validKeySize(n int) bool {
+	return n == 16 || n == 24 || n == 32
+}
+
+// RotateKey re-encrypts the data keys of a stopped store with newKey, the data files are not rewritten.
+// oldKey is empty to encrypt a store written without a key, the existing files stay unencrypted
+// until compacted. Fails with ErrEncryptionKey if oldKey is wrong.
+func RotateKey(dir string, oldKey, newKey []byte) error {
+	if len(newKey) == 0 {
+		return errors.New("new encryption key is required")
+	}
+	if !validKeySize(len(newKey)) {
+		return errors.Errorf("encryption key must be 16, 24 or 32 bytes, got %d", len(newKey))
+	}
+	// 先用旧key打开一次，校验key并确认没有其他进程在使用该目录
+	opts := Encryption{Key: oldKey}.apply(badger.DefaultOptions(dir).WithLogger(nil))
+	db, err := open(opts)
+	if err != nil {
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return errors.Wrap(err, "close badger")
+	}
+
+	kr, err := badger.OpenKeyRegistry(badger.KeyRegistryOptions{
+		Dir:           dir,
+		ReadOnly:      true,
+		EncryptionKey: oldKey,
+	})
+	if err != nil {
+		return errors.Wrap(err, "open key registry")
+	}
+	err = badger.WriteKeyRegistry(kr, badger.KeyRegistryOptions{
+		Dir:           dir,
+		EncryptionKey: newKey,
+	})
+	return errors.Wrap(err, "write key registry")
+}
+
+// open opens badger, a key mismatch is reported as ErrEncryptionKey instead of badger's error
+func open(opts badger.Options) (db *badger.DB, err error) {
+	defer func() {
+		// badger对部分非法配置直接panic，转换为错误
+		if r := recover(); r != nil {
+			db, err = nil, errors.Errorf("open badger: %v", r)
+		}
+	}()
+	db, err = badger.Open(opts)
+	if errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+		return nil, ErrEncryptionKey
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "open badger")
+	}
+	return db, nil
+}
@@ -0,0 +1,65 @@
+package badger
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestRotateKey(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 16)
+
+	s, err := OpenEncrypted(dir, Encryption{Key: oldKey}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateBucket("otp").Set([]byte("alice"), []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	for _, key := range [][]byte{nil, newKey} {
+		if _, err := OpenEncrypted(dir, Encryption{Key: key}, zap.NewNop()); err != ErrEncryptionKey {
+			t.Fatalf("key %x: expected ErrEncryptionKey, got %v", key, err)
+		}
+	}
+	if err := RotateKey(dir, newKey, newKey); err != ErrEncryptionKey {
+		t.Fatalf("rotate with a wrong key: %v", err)
+	}
+	if err := RotateKey(dir, oldKey, newKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenEncrypted(dir, Encryption{Key: oldKey}, zap.NewNop()); err != ErrEncryptionKey {
+		t.Fatalf("old key still accepted: %v", err)
+	}
+	s, err = OpenEncrypted(dir, Encryption{Key: newKey}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, err := s.CreateBucket("otp").Get([]byte("alice")); err != nil || string(v) != "secret" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	for _, data := range []string{
+		"000102030405060708090a0b0c0d0e0f\n",
+		"AAECAwQFBgcICQoLDA0ODw==",
+	} {
+		key, err := ParseKey([]byte(data))
+		if err != nil || len(key) != 16 || key[15] != 15 {
+			t.Fatalf("%q: %x, %v", data, key, err)
+		}
+	}
+	if key, err := ParseKey([]byte("0123456789abcdefghijklmn")); err != nil || len(key) != 24 {
+		t.Fatalf("raw key: %x, %v", key, err)
+	}
+	if _, err := ParseKey([]byte("short")); err == nil {
+		t.Fatal("expected an error for a short key")
+	}
+}
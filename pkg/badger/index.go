@@ -0,0 +1,197 @@
+package badger
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pkg/errors"
+	"github.com/shumin1027/otpd/pkg/store"
+)
+
+// 索引存放在独立的前缀下，不会出现在bucket的遍历结果中
+//   - 索引项: \x00idx:<bucket>:<index>:<value>\x00<key> -> <key>
+//   - 索引版本: \x00idxmeta:<bucket>:<index> -> <version>
+const (
+	indexPrefix     = "\x00idx:"
+	indexMetaPrefix = "\x00idxmeta:"
+)
+
+type index struct {
+	store.Index
+	prefix []byte
+}
+
+func (idx *index) keys(k, v []byte) [][]byte {
+	values := idx.Values(k, v)
+	keys := make([][]byte, 0, len(values))
+	for _, value := range values {
+		keys = append(keys, append(append([]byte(nil), idx.prefix...), store.IndexKey(value, k)...))
+	}
+	return keys
+}
+
+func (s *Store) indexesOf(bucket string) []*index {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.indexes[bucket]
+}
+
+// AddIndex 注册bucket的索引，索引不存在或版本变化时根据已有数据重建
+func (s *Store) AddIndex(bucket string, idx store.Index) error {
+	if idx.Name == "" || idx.Values == nil {
+		return errors.New("index name and values are required")
+	}
+	ix := &index{Index: idx, prefix: []byte(indexPrefix + bucket + ":" + idx.Name + ":")}
+
+	s.mu.Lock()
+	indexes := make([]*index, 0, len(s.indexes[bucket])+1)
+	for _, old := range s.indexes[bucket] {
+		if old.Name != idx.Name {
+			indexes = append(indexes, old)
+		}
+	}
+	s.indexes[bucket] = append(indexes, ix)
+	s.mu.Unlock()
+
+	metaKey := []byte(indexMetaPrefix + bucket + ":" + idx.Name)
+	version := []byte(strconv.Itoa(idx.Version))
+	if v, err := s.Get(metaKey); err == nil && bytes.Equal(v, version) {
+		return nil
+	}
+	if err := s.rebuildIndex(bucket, ix); err != nil {
+		return errors.Wrapf(err, "build index %s of bucket %s", idx.Name, bucket)
+	}
+	return s.Set(metaKey, version)
+}
+
+// rebuildIndex 删除旧的索引项，遍历bucket重新生成
+func (s *Store) rebuildIndex(bucket string, ix *index) error {
+	if err := s.db.DropPrefix(ix.prefix); err != nil {
+		return err
+	}
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	prefix := []byte(bucket + ":")
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			k := item.KeyCopy(nil)[len(prefix):]
+			for _, key := range ix.keys(k, v) {
+				e := badger.NewEntry(key, k)
+				e.ExpiresAt = item.ExpiresAt()
+				if err := wb.SetEntry(e); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return wb.Flush()
+}
+
+// writeIndexed 在txn中写入或删除一个key，同时更新它的索引项
+func writeIndexed(txn *badger.Txn, indexes []*index, prefix string, k, v []byte, expiresAt uint64, del bool) error {
+	fullKey := []byte(prefix + string(k))
+	var oldKeys [][]byte
+	item, err := txn.Get(fullKey)
+	switch err {
+	case nil:
+		old, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		for _, ix := range indexes {
+			oldKeys = append(oldKeys, ix.keys(k, old)...)
+		}
+	case badger.ErrKeyNotFound:
+	default:
+		return err
+	}
+
+	var newKeys [][]byte
+	if !del {
+		for _, ix := range indexes {
+			newKeys = append(newKeys, ix.keys(k, v)...)
+		}
+	}
+	for _, old := range oldKeys {
+		if !containsKey(newKeys, old) {
+			if err := txn.Delete(old); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range newKeys {
+		e := badger.NewEntry(key, k)
+		e.ExpiresAt = expiresAt
+		if err := txn.SetEntry(e); err != nil {
+			return err
+		}
+	}
+
+	if del {
+		return txn.Delete(fullKey)
+	}
+	e := badger.NewEntry(fullKey, v)
+	e.ExpiresAt = expiresAt
+	return txn.SetEntry(e)
+}
+
+func containsKey(keys [][]byte, k []byte) bool {
+	for _, key := range keys {
+		if bytes.Equal(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// IndexScan 按索引值在[start, end)范围内遍历，end为nil表示没有上界
+func (s *Store) IndexScan(bucket, name string, start, end []byte, fn func(k []byte) bool) error {
+	var ix *index
+	for _, i := range s.indexesOf(bucket) {
+		if i.Name == name {
+			ix = i
+		}
+	}
+	if ix == nil {
+		return errors.Errorf("unknown index %s of bucket %s", name, bucket)
+	}
+	return s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = ix.prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		seek := append(append([]byte(nil), ix.prefix...), start...)
+		var stop []byte
+		if end != nil {
+			stop = append(append([]byte(nil), ix.prefix...), end...)
+		}
+		for it.Seek(seek); it.ValidForPrefix(ix.prefix); it.Next() {
+			item := it.Item()
+			if stop != nil && bytes.Compare(item.Key(), stop) >= 0 {
+				return nil
+			}
+			k, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if !fn(k) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
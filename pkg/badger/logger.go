@@ -16,14 +16,14 @@ func NewLogger(logger *zap.Logger) *Logger {
 // impl interface badger.Logger
 
 func (l *Logger) Errorf(template string, args ...interface{}) {
-	l.logger.Errorf(template, args)
+	l.logger.Errorf(template, args...)
 }
 func (l *Logger) Warningf(template string, args ...interface{}) {
-	l.logger.Warnf(template, args)
+	l.logger.Warnf(template, args...)
 }
 func (l *Logger) Infof(template string, args ...interface{}) {
-	l.logger.Infof(template, args)
+	l.logger.Infof(template, args...)
 }
 func (l *Logger) Debugf(template string, args ...interface{}) {
-	l.logger.Debugf(template, args)
+	l.logger.Debugf(template, args...)
 }
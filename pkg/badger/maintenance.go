@@ -0,0 +1,85 @@
+package badger
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Maintenance runs value log GC on the store periodically
+type Maintenance struct {
+	stor         *Store
+	interval     time.Duration
+	discardRatio float64
+	logger       *zap.Logger
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewMaintenance creates the background maintenance, call Start to run it
+func NewMaintenance(s *Store, interval time.Duration, discardRatio float64, logger *zap.Logger) *Maintenance {
+	return &Maintenance{
+		stor:         s,
+		interval:     interval,
+		discardRatio: discardRatio,
+		logger:       logger.With(zap.String("mod", "maintenance")),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// Start runs the maintenance loop in a goroutine
+func (m *Maintenance) Start() {
+	go m.run()
+}
+
+func (m *Maintenance) run() {
+	defer close(m.done)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	m.logger.Info("value log gc scheduled", zap.Duration("interval", m.interval), zap.Float64("discard_ratio", m.discardRatio))
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.gc()
+		}
+	}
+}
+
+func (m *Maintenance) gc() {
+	start := time.Now()
+	rewrites, err := m.stor.RunGC(m.discardRatio)
+	if err != nil {
+		m.logger.Error("value log gc failed", zap.Error(err))
+		return
+	}
+	lsm, vlog := m.stor.Size()
+	logf := m.logger.Info
+	if rewrites == 0 {
+		logf = m.logger.Debug
+	}
+	logf("value log gc finished",
+		zap.Int("rewrites", rewrites),
+		zap.Duration("duration", time.Since(start)),
+		zap.Int64("lsm_size", lsm),
+		zap.Int64("vlog_size", vlog))
+}
+
+// Stop stops the loop and waits for a running GC to finish or ctx to expire
+func (m *Maintenance) Stop(ctx context.Context) error {
+	m.once.Do(func() {
+		close(m.stop)
+	})
+	select {
+	case <-m.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
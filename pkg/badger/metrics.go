@@ -0,0 +1,72 @@
+package badger
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	gcRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otpd_badger_gc_runs_total",
+		Help: "Value log GC runs by result.",
+	}, []string{"result"})
+	gcDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "otpd_badger_gc_duration_seconds",
+		Help:    "Duration of value log GC cycles.",
+		Buckets: []float64{.01, .1, 1, 10, 60, 300},
+	})
+	flattens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otpd_badger_flatten_total",
+		Help: "LSM tree flattens by result.",
+	}, []string{"result"})
+)
+
+// measured 大小指标报告最近打开的store，同一个collector只能注册一次
+var measured struct {
+	sync.RWMutex
+	store *Store
+}
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "otpd_badger_lsm_size_bytes",
+		Help: "Size of the badger LSM tree in bytes.",
+	}, func() float64 {
+		lsm, _ := measuredSize()
+		return float64(lsm)
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "otpd_badger_vlog_size_bytes",
+		Help: "Size of the badger value log in bytes.",
+	}, func() float64 {
+		_, vlog := measuredSize()
+		return float64(vlog)
+	})
+}
+
+func measuredSize() (int64, int64) {
+	measured.RLock()
+	defer measured.RUnlock()
+	if measured.store == nil {
+		return 0, 0
+	}
+	return measured.store.Size()
+}
+
+// registerMetrics exposes the LSM and value log sizes of the store
+func registerMetrics(s *Store) {
+	measured.Lock()
+	measured.store = s
+	measured.Unlock()
+}
+
+// unregisterMetrics stops reporting the sizes of a closed store
+func unregisterMetrics(s *Store) {
+	measured.Lock()
+	if measured.store == s {
+		measured.store = nil
+	}
+	measured.Unlock()
+}
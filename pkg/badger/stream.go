@@ -0,0 +1,80 @@
+package badger
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/shumin1027/otpd/pkg/store"
+)
+
+// Stream 使用badger Stream并发读取bucket，fn在多个goroutine中被调用，需要自行加锁。
+// badger只记录KeyToList返回的错误并跳过该key，且只在发送结果时检查ctx，
+// 因此出错时取消ctx，之后的key直接跳过，不再读取value和调用fn
+func (s *Bucket) Stream(ctx context.Context, fn func(k, v []byte) error) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		total    int64
+		once     sync.Once
+		firstErr error
+	)
+	stop := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	stream := s.stor.db.NewStream()
+	stream.NumGo = runtime.NumCPU() * 2
+	stream.Prefix = []byte(s.prefix)
+	stream.LogPrefix = "Badger.Streaming." + s.name
+	stream.KeyToList = func(key []byte, itr *badger.Iterator) (*pb.KVList, error) {
+		item := itr.Item()
+		if ctx.Err() != nil || item.IsDeletedOrExpired() {
+			return nil, nil
+		}
+		val, err := item.ValueCopy(nil)
+		if err == nil {
+			err = fn(key[len(s.prefix):], val)
+		}
+		if err != nil {
+			stop(err)
+			return nil, nil
+		}
+		atomic.AddInt64(&total, 1)
+		// 不需要输出，返回空列表
+		return nil, nil
+	}
+	stream.Send = func(buf *z.Buffer) error {
+		return nil
+	}
+
+	// Orchestrate等待所有KeyToList返回后才返回，之后读取firstErr是安全的
+	err := stream.Orchestrate(ctx)
+	if firstErr != nil {
+		err = firstErr
+	}
+	if err == store.ErrStop {
+		err = nil
+	}
+	return atomic.LoadInt64(&total), err
+}
+
+// Chan sends the entries of the bucket to ch, a slow receiver slows down the iteration
+func (s *Bucket) Chan(ctx context.Context, ch chan<- store.KV) (int64, error) {
+	return s.Stream(ctx, func(k, v []byte) error {
+		select {
+		case ch <- store.KV{Key: k, Value: v}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
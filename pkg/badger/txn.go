@@ -0,0 +1,80 @@
+package badger
+
+import (
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/shumin1027/otpd/pkg/store"
+)
+
+var _ store.Transactional = (*Store)(nil)
+
+// maxTxnRetries 事务冲突时的最大重试次数，每次重试前等待的时间递增
+const maxTxnRetries = 10
+
+// Txn implements store.Transactional, conflicting transactions are retried,
+// returns store.ErrConflict if they still conflict after maxTxnRetries.
+// Writes exceeding the badger transaction size return store.ErrTxnTooBig,
+// use BatchSet to write more keys than fit into one transaction.
+func (s *Store) Txn(fn func(tx store.Tx) error) error {
+	for i := 0; ; i++ {
+		err := s.db.Update(func(txn *badger.Txn) error {
+			return fn(&tx{stor: s, txn: txn})
+		})
+		switch err {
+		case badger.ErrConflict:
+			if i+1 >= maxTxnRetries {
+				return store.ErrConflict
+			}
+			time.Sleep(time.Duration(i+1) * time.Millisecond)
+			continue
+		case badger.ErrTxnTooBig:
+			return store.ErrTxnTooBig
+		}
+		return err
+	}
+}
+
+type tx struct {
+	stor *Store
+	txn  *badger.Txn
+}
+
+func (t *tx) Bucket(name string) store.TxBucket {
+	return &txBucket{tx: t, name: name, prefix: name + ":"}
+}
+
+// txBucket 写入时在同一个事务中维护bucket的索引
+type txBucket struct {
+	tx     *tx
+	name   string
+	prefix string
+}
+
+func (b *txBucket) Get(k []byte) ([]byte, error) {
+	item, err := b.tx.txn.Get([]byte(b.prefix + string(k)))
+	if err == badger.ErrKeyNotFound {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+func (b *txBucket) Has(k []byte) bool {
+	_, err := b.tx.txn.Get([]byte(b.prefix + string(k)))
+	return err == nil
+}
+
+func (b *txBucket) Set(k, v []byte) error {
+	return writeIndexed(b.tx.txn, b.tx.stor.indexesOf(b.name), b.prefix, k, v, 0, false)
+}
+
+func (b *txBucket) SetWithTTL(k, v []byte, expireAt int64) error {
+	return writeIndexed(b.tx.txn, b.tx.stor.indexesOf(b.name), b.prefix, k, v, uint64(expireAt), false)
+}
+
+func (b *txBucket) Delete(k []byte) error {
+	return writeIndexed(b.tx.txn, b.tx.stor.indexesOf(b.name), b.prefix, k, nil, 0, true)
+}
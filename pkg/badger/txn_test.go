@@ -0,0 +1,150 @@
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/shumin1027/otpd/pkg/store"
+	"go.uber.org/zap"
+)
+
+func openMemory(t *testing.T) *Store {
+	s, err := Open("", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestBatchSet(t *testing.T) {
+	s := openMemory(t)
+	var keys, values [][]byte
+	for i := 0; i < 100; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("k%03d", i)))
+		values = append(values, []byte(strconv.Itoa(i)))
+	}
+	if err := s.BatchSet(keys, values); err != nil {
+		t.Fatal(err)
+	}
+	expireAts := make([]int64, len(keys))
+	for i := range expireAts {
+		expireAts[i] = time.Now().Add(time.Hour).Unix()
+	}
+	ttlKeys := make([][]byte, len(keys))
+	for i, k := range keys {
+		ttlKeys[i] = append([]byte("ttl:"), k...)
+	}
+	if err := s.BatchSetWithTTL(ttlKeys, values, expireAts); err != nil {
+		t.Fatal(err)
+	}
+	// 之前只写入第一个key且从未提交
+	for i := range keys {
+		for _, k := range [][]byte{keys[i], ttlKeys[i]} {
+			if v, err := s.Get(k); err != nil || !bytes.Equal(v, values[i]) {
+				t.Fatalf("%s: got %q, %v", k, v, err)
+			}
+		}
+	}
+}
+
+func TestTxnConflict(t *testing.T) {
+	s := openMemory(t)
+	counter := s.CreateBucket("counter")
+	counter.Set([]byte("n"), []byte("1"))
+
+	// 第一次执行读取后其它写入修改了同一个key，提交冲突后重新执行
+	runs := 0
+	err := s.Txn(func(tx store.Tx) error {
+		runs++
+		b := tx.Bucket("counter")
+		v, err := b.Get([]byte("n"))
+		if err != nil {
+			return err
+		}
+		if runs == 1 {
+			if err := counter.Set([]byte("n"), []byte("10")); err != nil {
+				return err
+			}
+		}
+		n, _ := strconv.Atoi(string(v))
+		return b.Set([]byte("n"), []byte(strconv.Itoa(n+1)))
+	})
+	if err != nil || runs != 2 {
+		t.Fatalf("got %v after %d runs", err, runs)
+	}
+	if v, _ := counter.Get([]byte("n")); string(v) != "11" {
+		t.Fatalf("got %q", v)
+	}
+
+	// 一直冲突时返回ErrConflict
+	runs = 0
+	err = s.Txn(func(tx store.Tx) error {
+		runs++
+		if _, err := tx.Bucket("counter").Get([]byte("n")); err != nil {
+			return err
+		}
+		counter.Set([]byte("n"), []byte(strconv.Itoa(runs)))
+		return tx.Bucket("counter").Set([]byte("n"), []byte("0"))
+	})
+	if err != store.ErrConflict || runs != maxTxnRetries {
+		t.Fatalf("got %v after %d runs", err, runs)
+	}
+}
+
+func TestTxnTooBig(t *testing.T) {
+	s := openMemory(t)
+	err := s.AddIndex("big", store.Index{Name: "size", Values: func(k, v []byte) [][]byte {
+		if string(k) != "huge" {
+			return [][]byte{[]byte(strconv.Itoa(len(v)))}
+		}
+		// 索引条目数超过一个事务的上限
+		values := make([][]byte, s.db.MaxBatchCount())
+		for i := range values {
+			values[i] = []byte(strconv.Itoa(i))
+		}
+		return values
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 超过事务大小时整个事务不提交，数据与索引都不写入
+	value := bytes.Repeat([]byte{'x'}, 64<<10)
+	n := int(s.db.MaxBatchSize()/int64(len(value))) * 2
+	err = s.Txn(func(tx store.Tx) error {
+		for i := 0; i < n; i++ {
+			if err := tx.Bucket("big").Set([]byte(strconv.Itoa(i)), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != store.ErrTxnTooBig {
+		t.Fatalf("expected ErrTxnTooBig, got %v", err)
+	}
+	keys := 0
+	s.CreateBucket("big").IterKeys(func(k []byte) error {
+		keys++
+		return nil
+	})
+	indexed := 0
+	s.IndexScan("big", "size", nil, nil, func(k []byte) bool {
+		indexed++
+		return true
+	})
+	if keys != 0 || indexed != 0 {
+		t.Fatalf("expected nothing written, got %d keys and %d index entries", keys, indexed)
+	}
+
+	// 单个写入超过事务大小
+	err = s.Txn(func(tx store.Tx) error {
+		return tx.Bucket("big").Set([]byte("huge"), []byte{'x'})
+	})
+	if err != store.ErrTxnTooBig {
+		t.Fatalf("expected ErrTxnTooBig, got %v", err)
+	}
+}
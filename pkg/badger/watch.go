@@ -0,0 +1,39 @@
+package badger
+
+import (
+	"context"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/shumin1027/otpd/pkg/store"
+)
+
+var _ store.Watcher = (*Bucket)(nil)
+
+// Watch subscribes to the bucket prefix, badger does not publish the delete
+// marker so an empty value is reported as OpDelete. Expired keys are not reported.
+func (s *Bucket) Watch(ctx context.Context, fn func(store.Event) error) error {
+	prefix := []byte(s.prefix)
+	err := s.stor.db.Subscribe(ctx, func(kvs *badger.KVList) error {
+		for _, kv := range kvs.Kv {
+			e := store.Event{
+				Op:      store.OpPut,
+				Key:     kv.Key[len(prefix):],
+				Value:   kv.Value,
+				Version: kv.Version,
+			}
+			if len(kv.Value) == 0 {
+				e.Op = store.OpDelete
+				e.Value = nil
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, []pb.Match{{Prefix: prefix}})
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return nil
+	}
+	return err
+}
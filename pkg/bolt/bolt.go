@@ -0,0 +1,378 @@
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/shumin1027/otpd/pkg/logger"
+	"github.com/shumin1027/otpd/pkg/store"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+var (
+	_ store.Store         = (*Store)(nil)
+	_ store.Transactional = (*Store)(nil)
+)
+
+// purgeInterval how often expired values are deleted, reads skip them in the meantime
+const purgeInterval = 10 * time.Minute
+
+// Store a single file embedded store backed by bbolt, suited for small deployments
+type Store struct {
+	db   *bolt.DB
+	path string
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open opens or creates the database file, path may be a directory, in which case otpd.db inside it is used
+func Open(path string) (*Store, error) {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		path = filepath.Join(path, "otpd.db")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, errors.Wrap(err, "create data dir")
+	}
+	// 文件锁同样只允许一个进程打开，超时避免无限等待
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "open bolt")
+	}
+	s := &Store{db: db, path: path, stop: make(chan struct{}), done: make(chan struct{})}
+	go s.purgeLoop()
+	return s, nil
+}
+
+func (s *Store) Bucket(name string) store.Bucket {
+	return &Bucket{name: []byte(name), stor: s}
+}
+
+func (s *Store) Driver() string {
+	return store.DriverBolt
+}
+
+// Dir directory holding the database file
+func (s *Store) Dir() string {
+	return filepath.Dir(s.path)
+}
+
+// Path database file path
+func (s *Store) Path() string {
+	return s.path
+}
+
+func (s *Store) Probe() error {
+	b := s.Bucket("__health")
+	v := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := b.SetWithTTL([]byte("probe"), v, time.Now().Add(time.Minute).Unix()); err != nil {
+		return errors.Wrap(err, "write probe")
+	}
+	got, err := b.Get([]byte("probe"))
+	if err != nil {
+		return errors.Wrap(err, "read probe")
+	}
+	if !bytes.Equal(got, v) {
+		return errors.New("probe value mismatch")
+	}
+	return nil
+}
+
+// Size file size of the database, bolt has no separate value log
+func (s *Store) Size() (int64, int64) {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return 0, 0
+	}
+	return fi.Size(), 0
+}
+
+func (s *Store) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.db.Close()
+}
+
+func (s *Store) purgeLoop() {
+	defer close(s.done)
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if n, err := s.purge(time.Now().Unix()); err != nil {
+				log.L().Warn("purge expired values", zap.Error(err))
+			} else if n > 0 {
+				log.L().Debug("expired values purged", zap.Int("count", n))
+			}
+		}
+	}
+}
+
+// purge deletes the values expired at now from all buckets
+func (s *Store) purge(now int64) (int, error) {
+	var total int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bkt *bolt.Bucket) error {
+			// 遍历时不能删除，先收集过期的key
+			var keys [][]byte
+			err := bkt.ForEach(func(k, buf []byte) error {
+				if expired(buf, now) {
+					keys = append(keys, append([]byte(nil), k...))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				if err := bkt.Delete(k); err != nil {
+					return err
+				}
+			}
+			total += len(keys)
+			return nil
+		})
+	})
+	return total, err
+}
+
+// bolt没有TTL，每个value前8字节存过期时间(unix秒，0表示不过期)，读取时判断，定期清理
+const headerSize = 8
+
+func encode(v []byte, expireAt int64) []byte {
+	buf := make([]byte, headerSize+len(v))
+	binary.BigEndian.PutUint64(buf, uint64(expireAt))
+	copy(buf[headerSize:], v)
+	return buf
+}
+
+// decode returns a copy of the value, ok is false if the value expired or is malformed
+func decode(buf []byte, now int64) ([]byte, bool) {
+	if len(buf) < headerSize {
+		return nil, false
+	}
+	if expired(buf, now) {
+		return nil, false
+	}
+	return append([]byte(nil), buf[headerSize:]...), true
+}
+
+func expired(buf []byte, now int64) bool {
+	if len(buf) < headerSize {
+		return false
+	}
+	expireAt := int64(binary.BigEndian.Uint64(buf))
+	return expireAt > 0 && expireAt <= now
+}
+
+// Bucket a bolt bucket
+type Bucket struct {
+	name []byte
+	stor *Store
+}
+
+func (b *Bucket) Set(k, v []byte) error {
+	return b.set(k, v, 0)
+}
+
+func (b *Bucket) SetWithTTL(k, v []byte, expireAt int64) error {
+	return b.set(k, v, expireAt)
+}
+
+func (b *Bucket) set(k, v []byte, expireAt int64) error {
+	return b.stor.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists(b.name)
+		if err != nil {
+			return err
+		}
+		return bkt.Put(k, encode(v, expireAt))
+	})
+}
+
+func (b *Bucket) Get(k []byte) ([]byte, error) {
+	var val []byte
+	err := b.stor.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(b.name)
+		if bkt == nil {
+			return store.ErrNotFound
+		}
+		v, ok := decode(bkt.Get(k), time.Now().Unix())
+		if !ok {
+			return store.ErrNotFound
+		}
+		val = v
+		return nil
+	})
+	return val, err
+}
+
+func (b *Bucket) Has(k []byte) bool {
+	_, err := b.Get(k)
+	return err == nil
+}
+
+func (b *Bucket) Delete(k []byte) error {
+	return b.stor.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(b.name)
+		if bkt == nil {
+			return nil
+		}
+		return bkt.Delete(k)
+	})
+}
+
+func (b *Bucket) Iter(fn func(k, v []byte) error) int64 {
+	var total int64
+	now := time.Now().Unix()
+	b.stor.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(b.name)
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(k, buf []byte) error {
+			v, ok := decode(buf, now)
+			if !ok {
+				return nil
+			}
+			// bolt的key只在事务内有效，拷贝后再交给fn
+			if err := fn(append([]byte(nil), k...), v); err == nil {
+				total++
+			}
+			return nil
+		})
+	})
+	return total
+}
+
+func (b *Bucket) IterKeys(fn func(k []byte) error) int64 {
+	var total int64
+	now := time.Now().Unix()
+	b.stor.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(b.name)
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(k, buf []byte) error {
+			if _, ok := decode(buf, now); !ok {
+				return nil
+			}
+			if err := fn(append([]byte(nil), k...)); err == nil {
+				total++
+			}
+			return nil
+		})
+	})
+	return total
+}
+
+func (b *Bucket) Scan(start []byte, fn func(k, v []byte) bool) error {
+	now := time.Now().Unix()
+	return b.stor.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(b.name)
+		if bkt == nil {
+			return nil
+		}
+		c := bkt.Cursor()
+		for k, buf := c.Seek(start); k != nil; k, buf = c.Next() {
+			v, ok := decode(buf, now)
+			if !ok {
+				continue
+			}
+			if !fn(append([]byte(nil), k...), v) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func (b *Bucket) Update(k []byte, fn func(v []byte, ok bool) ([]byte, error)) error {
+	return b.stor.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists(b.name)
+		if err != nil {
+			return err
+		}
+		var expireAt int64
+		buf := bkt.Get(k)
+		old, ok := decode(buf, time.Now().Unix())
+		if ok {
+			expireAt = int64(binary.BigEndian.Uint64(buf))
+		}
+		v, err := fn(old, ok)
+		if err != nil {
+			return err
+		}
+		return bkt.Put(k, encode(v, expireAt))
+	})
+}
+
+// Txn implements store.Transactional, bolt allows a single writer so transactions never conflict
+func (s *Store) Txn(fn func(tx store.Tx) error) error {
+	return s.db.Update(func(btx *bolt.Tx) error {
+		return fn(&tx{tx: btx, now: time.Now().Unix()})
+	})
+}
+
+type tx struct {
+	tx  *bolt.Tx
+	now int64
+}
+
+func (t *tx) Bucket(name string) store.TxBucket {
+	return &txBucket{tx: t, name: []byte(name)}
+}
+
+// txBucket 只在写入时创建bucket，只读的事务不会留下空bucket
+type txBucket struct {
+	tx   *tx
+	name []byte
+}
+
+func (b *txBucket) Get(k []byte) ([]byte, error) {
+	bkt := b.tx.tx.Bucket(b.name)
+	if bkt == nil {
+		return nil, store.ErrNotFound
+	}
+	v, ok := decode(bkt.Get(k), b.tx.now)
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return v, nil
+}
+
+func (b *txBucket) Has(k []byte) bool {
+	_, err := b.Get(k)
+	return err == nil
+}
+
+func (b *txBucket) Set(k, v []byte) error {
+	return b.put(k, v, 0)
+}
+
+func (b *txBucket) SetWithTTL(k, v []byte, expireAt int64) error {
+	return b.put(k, v, expireAt)
+}
+
+func (b *txBucket) put(k, v []byte, expireAt int64) error {
+	bkt, err := b.tx.tx.CreateBucketIfNotExists(b.name)
+	if err != nil {
+		return err
+	}
+	return bkt.Put(k, encode(v, expireAt))
+}
+
+func (b *txBucket) Delete(k []byte) error {
+	bkt := b.tx.tx.Bucket(b.name)
+	if bkt == nil {
+		return nil
+	}
+	return bkt.Delete(k)
+}
@@ -0,0 +1,47 @@
+package bolt
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestPurge(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "otpd.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	now := time.Now().Unix()
+	b := s.Bucket("failures")
+	if err := b.SetWithTTL([]byte("expired"), []byte("1"), now-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetWithTTL([]byte("live"), []byte("2"), now+60); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Bucket("otp").Set([]byte("alice"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := s.purge(now)
+	if err != nil || n != 1 {
+		t.Fatalf("expected one value purged, got %d, %v", n, err)
+	}
+	// 过期的key已从文件中删除，而不只是读取时被跳过
+	var keys []string
+	s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bkt *bolt.Bucket) error {
+			return bkt.ForEach(func(k, v []byte) error {
+				keys = append(keys, string(name)+"/"+string(k))
+				return nil
+			})
+		})
+	})
+	if len(keys) != 2 || keys[0] != "failures/live" || keys[1] != "otp/alice" {
+		t.Errorf("unexpected keys left %v", keys)
+	}
+}
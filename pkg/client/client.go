@@ -0,0 +1,193 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shumin1027/otpd/pkg/json"
+)
+
+// Config client config
+type Config struct {
+	// URL server address, e.g: http://localhost:18181, https://otpd:18181 or unix:///run/otpd.sock
+	URL string
+	// CAFile CA bundle to verify the server certificate
+	CAFile string
+	// CertFile client certificate for mutual tls
+	CertFile string
+	// KeyFile client private key for mutual tls
+	KeyFile string
+	// Insecure skip server certificate verification
+	Insecure bool
+	// Username and Password basic auth credentials
+	Username string
+	Password string
+	// Token bearer token, takes precedence over basic auth
+	Token string
+	// Timeout request timeout, default to 10s
+	Timeout time.Duration
+}
+
+// Client calls the otpd http api
+type Client struct {
+	cfg  Config
+	base *url.URL
+	http *http.Client
+}
+
+// Response the unified response of the otpd api, inventory is decoded lazily
+type Response struct {
+	Success   bool            `json:"success"`
+	Inventory json.RawMessage `json:"inventory"`
+	Error     struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func New(cfg Config) (*Client, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("server url is empty")
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	base, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse server url")
+	}
+
+	transport := &http.Transport{}
+	switch base.Scheme {
+	case "unix":
+		// unix:///run/otpd.sock, 请求通过socket发送，host不参与路由
+		path := base.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		base = &url.URL{Scheme: "http", Host: "otpd"}
+	case "https":
+		tlsConfig, err := TLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	case "http":
+	default:
+		return nil, fmt.Errorf("unsupported url scheme: %s", base.Scheme)
+	}
+
+	return &Client{
+		cfg:  cfg,
+		base: base,
+		http: &http.Client{Transport: transport, Timeout: cfg.Timeout},
+	}, nil
+}
+
+// TLSConfig builds the tls config verifying the server and presenting the client certificate of cfg
+func TLSConfig(cfg Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.Insecure}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read ca file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load client key pair")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Do sends a request and returns the raw http response, the caller must close the body
+func (c *Client) Do(ctx context.Context, method, path string, query url.Values, body interface{}) (*http.Response, error) {
+	u := *c.base
+	// path may contain escaped segments, e.g. an account name with spaces
+	raw := strings.TrimSuffix(u.EscapedPath(), "/") + path
+	p, err := url.PathUnescape(raw)
+	if err != nil {
+		return nil, err
+	}
+	u.Path, u.RawPath = p, raw
+	u.RawQuery = query.Encode()
+
+	var reader io.Reader
+	if body != nil {
+		if r, ok := body.(io.Reader); ok {
+			reader = r
+		} else {
+			buf, err := json.Marshal(body)
+			if err != nil {
+				return nil, err
+			}
+			reader = bytes.NewReader(buf)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+	} else if c.cfg.Username != "" {
+		req.SetBasicAuth(c.cfg.Username, c.cfg.Password)
+	}
+	return c.http.Do(req)
+}
+
+// Call sends a request and decodes the inventory of a successful response into out
+func (c *Client) Call(ctx context.Context, method, path string, query url.Values, body interface{}, out interface{}) error {
+	resp, err := c.Do(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var r Response
+	if err := json.Unmarshal(buf, &r); err != nil {
+		// 非统一报文格式，例如5xx时直接返回的错误信息
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(buf)))
+	}
+	if !r.Success {
+		if r.Error.Message == "" {
+			return fmt.Errorf("%s", resp.Status)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, r.Error.Message)
+	}
+	if out == nil || len(r.Inventory) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Inventory, out)
+}
+
+func (c *Client) Get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	return c.Call(ctx, http.MethodGet, path, query, nil, out)
+}
@@ -0,0 +1,410 @@
+package cluster
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/pkg/errors"
+	"github.com/shumin1027/otpd/pkg/badger"
+	"github.com/shumin1027/otpd/pkg/store"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.uber.org/zap"
+)
+
+// peersBucket 节点ID到http地址的映射，随raft日志复制，用于把写请求转发给leader
+const peersBucket = "\x00cluster"
+
+var (
+	// ErrNotLeader returned by writes on a node that is not the leader
+	ErrNotLeader = errors.New("not the cluster leader")
+	// ErrNoLeader no leader is known, e.g. during an election
+	ErrNoLeader = errors.New("no cluster leader")
+)
+
+// Config raft settings of a node
+type Config struct {
+	// ID unique name of the node in the cluster
+	ID string
+	// Bind raft listening address, e.g: 0.0.0.0:18182
+	Bind string
+	// Advertise raft address other nodes connect to, default to Bind
+	Advertise string
+	// HTTP url other nodes forward http writes to, e.g: https://otpd-1:18181
+	HTTP string
+	// Dir directory of the raft log and snapshots
+	Dir string
+	// Bootstrap form a single node cluster if this node has no raft state yet
+	Bootstrap bool
+	// ApplyTimeout how long a write waits to be committed, default to 5s
+	ApplyTimeout time.Duration
+	// ServerTLS and ClientTLS secure the raft transport with mutual TLS,
+	// the server must verify client certificates
+	ServerTLS *tls.Config
+	ClientTLS *tls.Config
+	// Insecure use a plaintext unauthenticated transport, only on a trusted network
+	Insecure bool
+}
+
+// Server a member of the cluster
+type Server struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	HTTP    string `json:"http,omitempty"`
+	Voter   bool   `json:"voter"`
+	Leader  bool   `json:"leader"`
+}
+
+// Status raft state of this node
+type Status struct {
+	ID           string    `json:"id"`
+	State        string    `json:"state"`
+	Leader       string    `json:"leader,omitempty"`
+	LeaderHTTP   string    `json:"leader_http,omitempty"`
+	Servers      []Server  `json:"servers"`
+	LastIndex    uint64    `json:"last_index"`
+	AppliedIndex uint64    `json:"applied_index"`
+	LastContact  time.Time `json:"last_contact,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// Node a member of a raft cluster replicating the writes to a local badger store
+type Node struct {
+	cfg    Config
+	local  *badger.Store
+	raft   *raft.Raft
+	trans  *raft.NetworkTransport
+	logs   *raftboltdb.BoltStore
+	logger *zap.Logger
+	store  *Store
+
+	// leader 成为leader并完成Barrier后置1，本地状态已包含之前提交的所有日志
+	leader   int32
+	updateMu sync.Mutex
+	notify   chan bool
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+var (
+	mu      sync.Mutex
+	current *Node
+)
+
+// New opens the raft log in cfg.Dir and joins the cluster, local must be a badger store on disk.
+// Committed writes are applied to local, snapshots are badger backups.
+func New(cfg Config, local *badger.Store, logger *zap.Logger) (*Node, error) {
+	if local.Dir() == "" {
+		return nil, errors.New("clustered mode requires a data path on disk")
+	}
+	if cfg.ID == "" || cfg.Bind == "" || cfg.Dir == "" {
+		return nil, errors.New("cluster id, bind address and dir must be set")
+	}
+	if cfg.Advertise == "" {
+		cfg.Advertise = cfg.Bind
+	}
+	if cfg.ApplyTimeout <= 0 {
+		cfg.ApplyTimeout = 5 * time.Second
+	}
+	if !cfg.Insecure && (cfg.ServerTLS == nil || cfg.ClientTLS == nil) {
+		return nil, errors.New("the raft transport requires tls, or must be explicitly insecure")
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", cfg.Advertise)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve advertise address")
+	}
+	if advertise.IP == nil || advertise.IP.IsUnspecified() {
+		return nil, fmt.Errorf("advertise address %s is not reachable by other nodes", cfg.Advertise)
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "create raft dir")
+	}
+
+	n := &Node{
+		cfg:    cfg,
+		local:  local,
+		logger: logger.With(zap.String("mod", "cluster"), zap.String("id", cfg.ID)),
+		notify: make(chan bool, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	n.store = &Store{node: n, local: local}
+	hclogger := newHCLogger(n.logger)
+
+	n.logs, err = raftboltdb.NewBoltStore(filepath.Join(cfg.Dir, "raft.db"))
+	if err != nil {
+		return nil, errors.Wrap(err, "open raft log")
+	}
+	snaps, err := raft.NewFileSnapshotStoreWithLogger(cfg.Dir, 2, hclogger)
+	if err != nil {
+		n.logs.Close()
+		return nil, errors.Wrap(err, "open raft snapshots")
+	}
+	if cfg.Insecure {
+		n.trans, err = raft.NewTCPTransportWithLogger(cfg.Bind, advertise, 3, 10*time.Second, hclogger)
+	} else {
+		var stream *tlsStreamLayer
+		if stream, err = newTLSStreamLayer(cfg.Bind, advertise, cfg.ServerTLS, cfg.ClientTLS); err == nil {
+			n.trans = raft.NewNetworkTransportWithLogger(stream, 3, 10*time.Second, hclogger)
+		}
+	}
+	if err != nil {
+		n.logs.Close()
+		return nil, errors.Wrap(err, "listen raft transport")
+	}
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(cfg.ID)
+	conf.Logger = hclogger
+	conf.NotifyCh = n.notify
+
+	if cfg.Bootstrap {
+		exists, err := raft.HasExistingState(n.logs, n.logs, snaps)
+		if err != nil {
+			n.close()
+			return nil, errors.Wrap(err, "read raft state")
+		}
+		if !exists {
+			err := raft.BootstrapCluster(conf, n.logs, n.logs, snaps, n.trans, raft.Configuration{
+				Servers: []raft.Server{{ID: conf.LocalID, Address: n.trans.LocalAddr()}},
+			})
+			if err != nil {
+				n.close()
+				return nil, errors.Wrap(err, "bootstrap cluster")
+			}
+			n.logger.Info("bootstrapped single node cluster")
+		}
+	}
+
+	n.raft, err = raft.NewRaft(conf, &fsm{local: local}, n.logs, n.logs, snaps, n.trans)
+	if err != nil {
+		n.close()
+		return nil, errors.Wrap(err, "start raft")
+	}
+	go n.run()
+
+	mu.Lock()
+	current = n
+	mu.Unlock()
+	n.logger.Info("cluster node started", zap.String("bind", cfg.Bind), zap.String("advertise", string(n.trans.LocalAddr())), zap.Bool("tls", !cfg.Insecure))
+	return n, nil
+}
+
+// Current returns the node of this instance, nil when not clustered
+func Current() *Node {
+	mu.Lock()
+	defer mu.Unlock()
+	return current
+}
+
+// Store returns the store to use for accounts, see Store
+func (n *Node) Store() store.Store {
+	return n.store
+}
+
+func (n *Node) ID() string {
+	return n.cfg.ID
+}
+
+// IsLeader whether this node is the leader and has applied all committed writes
+func (n *Node) IsLeader() bool {
+	return atomic.LoadInt32(&n.leader) == 1
+}
+
+// run 跟踪leader变化，成为leader后先Barrier再接受Update，并登记自己的http地址
+func (n *Node) run() {
+	defer close(n.done)
+	for {
+		select {
+		case <-n.stop:
+			return
+		case leader := <-n.notify:
+			if !leader {
+				atomic.StoreInt32(&n.leader, 0)
+				n.logger.Info("lost leadership")
+				continue
+			}
+			if err := n.raft.Barrier(n.cfg.ApplyTimeout).Error(); err != nil {
+				n.logger.Error("barrier after election", zap.Error(err))
+				continue
+			}
+			atomic.StoreInt32(&n.leader, 1)
+			n.logger.Info("became leader")
+			if err := n.setPeer(n.cfg.ID, n.cfg.HTTP); err != nil {
+				n.logger.Error("register http address", zap.Error(err))
+			}
+		}
+	}
+}
+
+// apply commits a command and returns the error of applying it
+func (n *Node) apply(cmd command) error {
+	if !n.IsLeader() {
+		return ErrNotLeader
+	}
+	buf, err := msgpack.Marshal(&cmd)
+	if err != nil {
+		return err
+	}
+	f := n.raft.Apply(buf, n.cfg.ApplyTimeout)
+	if err := f.Error(); err != nil {
+		if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+			return ErrNotLeader
+		}
+		return errors.Wrap(err, "commit write")
+	}
+	if err, ok := f.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+func (n *Node) setPeer(id, url string) error {
+	peers := n.local.CreateBucket(peersBucket)
+	if v, err := peers.Get([]byte(id)); err == nil && string(v) == url {
+		return nil
+	}
+	if url == "" {
+		return n.apply(command{Op: opDelete, Bucket: peersBucket, Key: []byte(id)})
+	}
+	return n.apply(command{Op: opSet, Bucket: peersBucket, Key: []byte(id), Value: []byte(url)})
+}
+
+func (n *Node) peerHTTP(id string) string {
+	v, err := n.local.CreateBucket(peersBucket).Get([]byte(id))
+	if err != nil {
+		return ""
+	}
+	return string(v)
+}
+
+// LeaderHTTP url of the leader to forward writes to, empty if no leader is known
+func (n *Node) LeaderHTTP() string {
+	_, id := n.raft.LeaderWithID()
+	if id == "" {
+		return ""
+	}
+	return n.peerHTTP(string(id))
+}
+
+// Join adds a voter to the cluster, only on the leader.
+// A server with the same id or address is replaced.
+func (n *Node) Join(id, address, url string) error {
+	if !n.IsLeader() {
+		return ErrNotLeader
+	}
+	if id == "" || address == "" {
+		return errors.New("server id and address are required")
+	}
+	f := n.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return err
+	}
+	member := false
+	for _, srv := range f.Configuration().Servers {
+		if srv.ID == raft.ServerID(id) && srv.Address == raft.ServerAddress(address) {
+			member = true
+			continue
+		}
+		if srv.ID == raft.ServerID(id) || srv.Address == raft.ServerAddress(address) {
+			if err := n.raft.RemoveServer(srv.ID, 0, 0).Error(); err != nil {
+				return errors.Wrapf(err, "remove server %s", srv.ID)
+			}
+		}
+	}
+	if !member {
+		if err := n.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(address), 0, 0).Error(); err != nil {
+			return errors.Wrapf(err, "add voter %s", id)
+		}
+	}
+	n.logger.Info("server joined", zap.String("server", id), zap.String("address", address), zap.String("http", url))
+	return n.setPeer(id, url)
+}
+
+// Remove removes a server from the cluster, only on the leader
+func (n *Node) Remove(id string) error {
+	if !n.IsLeader() {
+		return ErrNotLeader
+	}
+	if err := n.raft.RemoveServer(raft.ServerID(id), 0, 0).Error(); err != nil {
+		return errors.Wrapf(err, "remove server %s", id)
+	}
+	n.logger.Info("server removed", zap.String("server", id))
+	if id == n.cfg.ID {
+		return nil
+	}
+	return n.setPeer(id, "")
+}
+
+// Status returns the raft state and the members of the cluster
+func (n *Node) Status() Status {
+	status := Status{
+		ID:           n.cfg.ID,
+		State:        n.raft.State().String(),
+		LastIndex:    n.raft.LastIndex(),
+		AppliedIndex: n.raft.AppliedIndex(),
+		LastContact:  n.raft.LastContact(),
+		Servers:      []Server{},
+	}
+	_, leader := n.raft.LeaderWithID()
+	status.Leader = string(leader)
+	if leader != "" {
+		status.LeaderHTTP = n.peerHTTP(string(leader))
+	}
+	f := n.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	for _, srv := range f.Configuration().Servers {
+		status.Servers = append(status.Servers, Server{
+			ID:      string(srv.ID),
+			Address: string(srv.Address),
+			HTTP:    n.peerHTTP(string(srv.ID)),
+			Voter:   srv.Suffrage == raft.Voter,
+			Leader:  srv.ID == leader,
+		})
+	}
+	sort.Slice(status.Servers, func(i, j int) bool {
+		return status.Servers[i].ID < status.Servers[j].ID
+	})
+	return status
+}
+
+// shutdown stops raft, the local store is closed by Store.Close
+func (n *Node) shutdown() error {
+	var err error
+	n.once.Do(func() {
+		close(n.stop)
+		<-n.done
+		atomic.StoreInt32(&n.leader, 0)
+		err = n.raft.Shutdown().Error()
+		if cerr := n.close(); err == nil {
+			err = cerr
+		}
+		mu.Lock()
+		if current == n {
+			current = nil
+		}
+		mu.Unlock()
+	})
+	return err
+}
+
+func (n *Node) close() error {
+	err := n.trans.Close()
+	if cerr := n.logs.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,214 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/shumin1027/otpd/pkg/badger"
+	"github.com/shumin1027/otpd/pkg/store"
+	"go.uber.org/zap"
+)
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// testTLS 自签名的节点证书兼作CA，返回raft传输的服务端和客户端配置
+func testTLS(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "node"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	server := &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+	client := &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool}
+	return server, client
+}
+
+func TestTLSStreamLayer(t *testing.T) {
+	server, client := testTLS(t)
+	addr := freeAddr(t)
+	advertise, _ := net.ResolveTCPAddr("tcp", addr)
+	l, err := newTLSStreamLayer(addr, advertise, server, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	conn, err := l.Dial(raft.ServerAddress(addr), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+	conn.Close()
+
+	// 没有集群证书的连接读不到任何数据
+	anon, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		anon.SetDeadline(time.Now().Add(5 * time.Second))
+		anon.Write([]byte("ping"))
+		_, err = io.ReadFull(anon, buf)
+		anon.Close()
+	}
+	if err == nil {
+		t.Fatal("a client without certificate was accepted")
+	}
+
+	if _, err := newTLSStreamLayer(addr, advertise, &tls.Config{}, client); err == nil {
+		t.Fatal("expected error when client certificates are not verified")
+	}
+}
+
+func TestSingleNode(t *testing.T) {
+	dir := t.TempDir()
+	local, err := badger.Open(filepath.Join(dir, "data"), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		ID:        "node1",
+		Bind:      freeAddr(t),
+		HTTP:      "http://127.0.0.1:18181",
+		Dir:       filepath.Join(dir, "raft"),
+		Bootstrap: true,
+	}
+	if _, err := New(cfg, local, zap.NewNop()); err == nil {
+		t.Fatal("expected error without tls")
+	}
+	cfg.ServerTLS, cfg.ClientTLS = testTLS(t)
+	n, err := New(cfg, local, zap.NewNop())
+	if err != nil {
+		local.Close()
+		t.Fatal(err)
+	}
+	s := n.Store()
+	defer s.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !n.IsLeader() {
+		if time.Now().After(deadline) {
+			t.Fatal("no leader elected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b := s.Bucket("otp")
+	if err := b.Set([]byte("alice"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	err = b.Update([]byte("alice"), func(v []byte, ok bool) ([]byte, error) {
+		if !ok || string(v) != "1" {
+			t.Fatalf("unexpected value %q, %v", v, ok)
+		}
+		return []byte("2"), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b.Get([]byte("alice")); err != nil || string(v) != "2" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+	if err := b.Delete([]byte("alice")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Get([]byte("alice")); err != store.ErrNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	err = s.(store.Transactional).Txn(func(tx store.Tx) error {
+		if err := tx.Bucket("otp").Set([]byte("bob"), []byte("1")); err != nil {
+			return err
+		}
+		if v, err := tx.Bucket("otp").Get([]byte("bob")); err != nil || string(v) != "1" {
+			t.Errorf("read own write: %q, %v", v, err)
+		}
+		return tx.Bucket("failures").Delete([]byte("bob"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b.Get([]byte("bob")); err != nil || string(v) != "1" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+
+	status := n.Status()
+	if status.Leader != "node1" || len(status.Servers) != 1 || status.LeaderHTTP != "http://127.0.0.1:18181" {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	src, _ := badger.Open(filepath.Join(t.TempDir(), "src"), zap.NewNop())
+	defer src.Close()
+	dst, _ := badger.Open(filepath.Join(t.TempDir(), "dst"), zap.NewNop())
+	defer dst.Close()
+
+	src.CreateBucket("otp").Set([]byte("alice"), []byte("1"))
+	dst.CreateBucket("otp").Set([]byte("bob"), []byte("1"))
+
+	snap, err := (&fsm{local: src}).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := snap.(*snapshot).data
+	if err := (&fsm{local: dst}).Restore(io.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := dst.CreateBucket("otp").Get([]byte("alice")); err != nil || string(v) != "1" {
+		t.Fatalf("got %q, %v", v, err)
+	}
+	if dst.CreateBucket("otp").Has([]byte("bob")) {
+		t.Fatal("restore kept entries missing from the snapshot")
+	}
+}
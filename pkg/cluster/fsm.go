@@ -0,0 +1,115 @@
+package cluster
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"github.com/shumin1027/otpd/pkg/badger"
+	"github.com/shumin1027/otpd/pkg/store"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// operations of a replicated write
+const (
+	opSet uint8 = iota + 1
+	opDelete
+	// opUpdate sets the value keeping the expiry of the key, see store.Bucket.Update
+	opUpdate
+	// opTxn applies Ops atomically, see store.Transactional
+	opTxn
+)
+
+// command a write replicated through the raft log
+type command struct {
+	Op       uint8  `msgpack:"op"`
+	Bucket   string `msgpack:"b"`
+	Key      []byte `msgpack:"k"`
+	Value    []byte `msgpack:"v,omitempty"`
+	ExpireAt int64  `msgpack:"e,omitempty"`
+	// Ops writes of an opTxn, only opSet and opDelete
+	Ops []command `msgpack:"ops,omitempty"`
+}
+
+// fsm applies committed commands to the local badger store
+type fsm struct {
+	local *badger.Store
+}
+
+var _ raft.FSM = (*fsm)(nil)
+
+// Apply returns the error of the write, if any, as the response of the log entry
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	var cmd command
+	if err := msgpack.Unmarshal(l.Data, &cmd); err != nil {
+		return errors.Wrap(err, "decode command")
+	}
+	if cmd.Op == opTxn {
+		return f.local.Txn(func(tx store.Tx) error {
+			for _, op := range cmd.Ops {
+				b := tx.Bucket(op.Bucket)
+				var err error
+				switch op.Op {
+				case opSet:
+					err = b.SetWithTTL(op.Key, op.Value, op.ExpireAt)
+				case opDelete:
+					err = b.Delete(op.Key)
+				default:
+					err = errors.Errorf("unknown transaction op: %d", op.Op)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	b := f.local.CreateBucket(cmd.Bucket)
+	switch cmd.Op {
+	case opSet:
+		if cmd.ExpireAt > 0 {
+			return b.SetWithTTL(cmd.Key, cmd.Value, cmd.ExpireAt)
+		}
+		return b.Set(cmd.Key, cmd.Value)
+	case opDelete:
+		return b.Delete(cmd.Key)
+	case opUpdate:
+		return b.Update(cmd.Key, func([]byte, bool) ([]byte, error) {
+			return cmd.Value, nil
+		})
+	}
+	return errors.Errorf("unknown command op: %d", cmd.Op)
+}
+
+// Snapshot 数据量很小，直接在FSM线程中导出到内存，保证快照与日志索引一致
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	var buf bytes.Buffer
+	if _, err := f.local.Backup(&buf, 0); err != nil {
+		return nil, errors.Wrap(err, "backup store")
+	}
+	return &snapshot{data: buf.Bytes()}, nil
+}
+
+// Restore replaces the local store with the snapshot
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	if err := f.local.Clean(); err != nil {
+		return errors.Wrap(err, "clean store")
+	}
+	return errors.Wrap(f.local.Load(rc), "load snapshot")
+}
+
+type snapshot struct {
+	data []byte
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s.data); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
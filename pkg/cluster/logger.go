@@ -0,0 +1,45 @@
+package cluster
+
+import (
+	"bytes"
+
+	"github.com/hashicorp/go-hclog"
+	"go.uber.org/zap"
+)
+
+// logWriter 把hashicorp/raft输出的hclog文本按级别转给zap
+type logWriter struct {
+	logger *zap.Logger
+}
+
+func newHCLogger(logger *zap.Logger) hclog.Logger {
+	return hclog.New(&hclog.LoggerOptions{
+		Name:   "raft",
+		Level:  hclog.Info,
+		Output: &logWriter{logger: logger},
+	})
+}
+
+// Write 行格式: 2006-01-02T15:04:05.000Z [INFO]  raft: message: key=value
+func (w *logWriter) Write(p []byte) (int, error) {
+	line := bytes.TrimSpace(p)
+	level := "INFO"
+	if i := bytes.IndexByte(line, '['); i >= 0 {
+		if j := bytes.IndexByte(line[i:], ']'); j > 0 {
+			level = string(line[i+1 : i+j])
+			line = bytes.TrimSpace(line[i+j+1:])
+		}
+	}
+	msg := string(line)
+	switch level {
+	case "TRACE", "DEBUG":
+		w.logger.Debug(msg)
+	case "WARN":
+		w.logger.Warn(msg)
+	case "ERROR":
+		w.logger.Error(msg)
+	default:
+		w.logger.Info(msg)
+	}
+	return len(p), nil
+}
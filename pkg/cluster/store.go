@@ -0,0 +1,236 @@
+package cluster
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shumin1027/otpd/pkg/badger"
+	"github.com/shumin1027/otpd/pkg/store"
+)
+
+var (
+	_ store.Store         = (*Store)(nil)
+	_ store.Sizer         = (*Store)(nil)
+	_ store.Backuper      = (*Store)(nil)
+	_ store.Maintainer    = (*Store)(nil)
+	_ store.Transactional = (*Store)(nil)
+	_ store.Bucket        = (*Bucket)(nil)
+	_ store.Indexer       = (*Bucket)(nil)
+	_ store.Watcher       = (*Bucket)(nil)
+	_ store.Streamer      = (*Bucket)(nil)
+)
+
+// ErrLoadUnsupported a clustered store is only restored from raft snapshots
+var ErrLoadUnsupported = errors.New("clustered store can not load backups, restore a stopped node instead")
+
+// Store reads from the local badger store and writes through the raft log
+type Store struct {
+	node  *Node
+	local *badger.Store
+}
+
+// Bucket implements store.Store
+func (s *Store) Bucket(name string) store.Bucket {
+	return &Bucket{
+		name:  name,
+		node:  s.node,
+		local: s.local.CreateBucket(name),
+	}
+}
+
+func (s *Store) Driver() string {
+	return s.local.Driver()
+}
+
+func (s *Store) Dir() string {
+	return s.local.Dir()
+}
+
+// Probe checks the local store, writes of the probe are not replicated
+func (s *Store) Probe() error {
+	return s.local.Probe()
+}
+
+// Close leaves raft running on the other nodes and closes the local store
+func (s *Store) Close() error {
+	err := s.node.shutdown()
+	if cerr := s.local.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *Store) Size() (int64, int64) {
+	return s.local.Size()
+}
+
+// Backup backs up the local store, the data is the same on every node up to the applied index
+func (s *Store) Backup(w io.Writer, since uint64) (uint64, error) {
+	return s.local.Backup(w, since)
+}
+
+func (s *Store) Load(r io.Reader) error {
+	return ErrLoadUnsupported
+}
+
+func (s *Store) RunGC(discardRatio float64) (int, error) {
+	return s.local.RunGC(discardRatio)
+}
+
+func (s *Store) Flatten(workers int) error {
+	return s.local.Flatten(workers)
+}
+
+// Txn 只能在leader上执行，fn读取本地数据并暂存写入，成功后作为一条日志提交，
+// 与Update相同，持有锁保证读到的值在提交前不被其他Update或Txn修改
+func (s *Store) Txn(fn func(tx store.Tx) error) error {
+	s.node.updateMu.Lock()
+	defer s.node.updateMu.Unlock()
+	if !s.node.IsLeader() {
+		return ErrNotLeader
+	}
+	t := &tx{stor: s, writes: make(map[string]int)}
+	if err := fn(t); err != nil {
+		return err
+	}
+	if len(t.ops) == 0 {
+		return nil
+	}
+	return s.node.apply(command{Op: opTxn, Ops: t.ops})
+}
+
+// tx stages the writes of a transaction in order, writes holds the index of the last write of every key
+type tx struct {
+	stor   *Store
+	ops    []command
+	writes map[string]int
+}
+
+func (t *tx) Bucket(name string) store.TxBucket {
+	return &txBucket{tx: t, name: name, local: t.stor.local.CreateBucket(name)}
+}
+
+type txBucket struct {
+	tx    *tx
+	name  string
+	local *badger.Bucket
+}
+
+func (b *txBucket) Get(k []byte) ([]byte, error) {
+	if i, ok := b.tx.writes[b.name+":"+string(k)]; ok {
+		cmd := b.tx.ops[i]
+		if cmd.Op == opDelete || (cmd.ExpireAt > 0 && cmd.ExpireAt <= time.Now().Unix()) {
+			return nil, store.ErrNotFound
+		}
+		return append([]byte(nil), cmd.Value...), nil
+	}
+	return b.local.Get(k)
+}
+
+func (b *txBucket) Has(k []byte) bool {
+	_, err := b.Get(k)
+	return err == nil
+}
+
+func (b *txBucket) Set(k, v []byte) error {
+	return b.stage(command{Op: opSet, Bucket: b.name, Key: k, Value: v})
+}
+
+func (b *txBucket) SetWithTTL(k, v []byte, expireAt int64) error {
+	return b.stage(command{Op: opSet, Bucket: b.name, Key: k, Value: v, ExpireAt: expireAt})
+}
+
+func (b *txBucket) Delete(k []byte) error {
+	return b.stage(command{Op: opDelete, Bucket: b.name, Key: k})
+}
+
+func (b *txBucket) stage(cmd command) error {
+	// 拷贝一份，避免调用方在提交前修改切片
+	cmd.Key = append([]byte(nil), cmd.Key...)
+	cmd.Value = append([]byte(nil), cmd.Value...)
+	b.tx.ops = append(b.tx.ops, cmd)
+	b.tx.writes[b.name+":"+string(cmd.Key)] = len(b.tx.ops) - 1
+	return nil
+}
+
+// Bucket a bucket whose writes are committed through raft before being applied locally
+type Bucket struct {
+	name  string
+	node  *Node
+	local *badger.Bucket
+}
+
+func (b *Bucket) Set(k, v []byte) error {
+	return b.node.apply(command{Op: opSet, Bucket: b.name, Key: k, Value: v})
+}
+
+func (b *Bucket) SetWithTTL(k, v []byte, expireAt int64) error {
+	return b.node.apply(command{Op: opSet, Bucket: b.name, Key: k, Value: v, ExpireAt: expireAt})
+}
+
+func (b *Bucket) Get(k []byte) ([]byte, error) {
+	return b.local.Get(k)
+}
+
+func (b *Bucket) Has(k []byte) bool {
+	return b.local.Has(k)
+}
+
+func (b *Bucket) Delete(k []byte) error {
+	return b.node.apply(command{Op: opDelete, Bucket: b.name, Key: k})
+}
+
+func (b *Bucket) Iter(fn func(k, v []byte) error) int64 {
+	return b.local.Iter(fn)
+}
+
+func (b *Bucket) IterKeys(fn func(k []byte) error) int64 {
+	return b.local.IterKeys(fn)
+}
+
+func (b *Bucket) Scan(start []byte, fn func(k, v []byte) bool) error {
+	return b.local.Scan(start, fn)
+}
+
+// Update 只能在leader上执行，读取和提交期间持有锁，保证读到的值在提交前不被其他Update修改
+func (b *Bucket) Update(k []byte, fn func(v []byte, ok bool) ([]byte, error)) error {
+	b.node.updateMu.Lock()
+	defer b.node.updateMu.Unlock()
+	if !b.node.IsLeader() {
+		return ErrNotLeader
+	}
+	v, err := b.local.Get(k)
+	ok := err == nil
+	if err != nil && err != store.ErrNotFound {
+		return err
+	}
+	v, err = fn(v, ok)
+	if err != nil {
+		return err
+	}
+	return b.node.apply(command{Op: opUpdate, Bucket: b.name, Key: k, Value: v})
+}
+
+func (b *Bucket) Stream(ctx context.Context, fn func(k, v []byte) error) (int64, error) {
+	return b.local.Stream(ctx, fn)
+}
+
+func (b *Bucket) Chan(ctx context.Context, ch chan<- store.KV) (int64, error) {
+	return b.local.Chan(ctx, ch)
+}
+
+// AddIndex indexes are maintained locally by every node when commands are applied
+func (b *Bucket) AddIndex(idx store.Index) error {
+	return b.local.AddIndex(idx)
+}
+
+func (b *Bucket) IndexScan(name string, start, end []byte, fn func(k []byte) bool) error {
+	return b.local.IndexScan(name, start, end, fn)
+}
+
+// Watch reports the changes applied locally, on every node
+func (b *Bucket) Watch(ctx context.Context, fn func(store.Event) error) error {
+	return b.local.Watch(ctx, fn)
+}
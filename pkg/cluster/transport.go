@@ -0,0 +1,50 @@
+package cluster
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+)
+
+// tlsStreamLayer raft.StreamLayer over mutual TLS, nodes accept only peers
+// with a certificate of the cluster CA
+type tlsStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+	client    *tls.Config
+}
+
+func newTLSStreamLayer(bind string, advertise net.Addr, server, client *tls.Config) (*tlsStreamLayer, error) {
+	if server == nil || client == nil {
+		return nil, errors.New("both server and client tls must be set")
+	}
+	if server.ClientAuth != tls.RequireAndVerifyClientCert {
+		return nil, errors.New("the raft transport must verify client certificates")
+	}
+	ln, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsStreamLayer{
+		Listener:  tls.NewListener(ln, server),
+		advertise: advertise,
+		client:    client,
+	}, nil
+}
+
+// Addr the advertised address, sent to other nodes
+func (l *tlsStreamLayer) Addr() net.Addr {
+	return l.advertise
+}
+
+func (l *tlsStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", string(address), l.client)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,29 @@
+package health
+
+import (
+	"context"
+	"fmt"
+)
+
+// DiskUsage file system usage of a directory
+type DiskUsage struct {
+	Path  string `json:"path"`
+	Total uint64 `json:"total"`
+	Free  uint64 `json:"free"`
+	Used  uint64 `json:"used"`
+}
+
+// DiskCheck reports the usage of the file system holding path,
+// fails when less than minFree bytes are available
+func DiskCheck(path string, minFree uint64) CheckFunc {
+	return func(ctx context.Context) (interface{}, error) {
+		usage, err := Disk(path)
+		if err != nil {
+			return nil, err
+		}
+		if usage.Free < minFree {
+			return usage, fmt.Errorf("only %d bytes free on %s, want at least %d", usage.Free, path, minFree)
+		}
+		return usage, nil
+	}
+}
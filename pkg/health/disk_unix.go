@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package health
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// Disk returns the usage of the file system holding path
+func Disk(path string) (*DiskUsage, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return nil, err
+	}
+	bsize := uint64(st.Bsize)
+	total := uint64(st.Blocks) * bsize
+	free := uint64(st.Bavail) * bsize
+	return &DiskUsage{
+		Path:  path,
+		Total: total,
+		Free:  free,
+		Used:  total - uint64(st.Bfree)*bsize,
+	}, nil
+}
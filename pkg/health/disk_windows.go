@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package health
+
+import "errors"
+
+// Disk returns the usage of the file system holding path
+func Disk(path string) (*DiskUsage, error) {
+	return nil, errors.New("disk usage not supported on windows")
+}
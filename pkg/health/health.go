@@ -0,0 +1,136 @@
+package health
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Check status
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// CheckFunc probes one dependency, detail is reported as is in the result
+type CheckFunc func(ctx context.Context) (detail interface{}, err error)
+
+// Result outcome of a single check
+type Result struct {
+	Name     string      `json:"name"`
+	Status   string      `json:"status"`
+	Duration string      `json:"duration"`
+	Error    string      `json:"error,omitempty"`
+	Detail   interface{} `json:"detail,omitempty"`
+}
+
+// Report outcome of all checks, status is down if any check is down
+type Report struct {
+	Status   string   `json:"status"`
+	Duration string   `json:"duration"`
+	Checks   []Result `json:"checks"`
+}
+
+// Up whether every check passed
+func (r *Report) Up() bool {
+	return r.Status == StatusUp
+}
+
+// Checker a named set of checks run concurrently
+type Checker struct {
+	mu      sync.RWMutex
+	checks  map[string]CheckFunc
+	timeout time.Duration
+}
+
+// NewChecker creates a checker, each check is cancelled after timeout
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{
+		checks:  make(map[string]CheckFunc),
+		timeout: timeout,
+	}
+}
+
+// Register adds or replaces a named check
+func (c *Checker) Register(name string, fn CheckFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = fn
+}
+
+// Run executes all checks and collects their results sorted by name
+func (c *Checker) Run(ctx context.Context) *Report {
+	c.mu.RLock()
+	checks := make(map[string]CheckFunc, len(c.checks))
+	for name, fn := range c.checks {
+		checks[name] = fn
+	}
+	c.mu.RUnlock()
+
+	start := time.Now()
+	results := make([]Result, 0, len(checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, fn := range checks {
+		wg.Add(1)
+		go func(name string, fn CheckFunc) {
+			defer wg.Done()
+			res := c.run(ctx, name, fn)
+			mu.Lock()
+			results = append(results, res)
+			mu.Unlock()
+		}(name, fn)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	report := &Report{
+		Status:   StatusUp,
+		Duration: time.Since(start).String(),
+		Checks:   results,
+	}
+	for _, res := range results {
+		if res.Status != StatusUp {
+			report.Status = StatusDown
+		}
+	}
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, name string, fn CheckFunc) Result {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	type outcome struct {
+		detail interface{}
+		err    error
+	}
+	start := time.Now()
+	done := make(chan outcome, 1)
+	go func() {
+		detail, err := fn(ctx)
+		done <- outcome{detail, err}
+	}()
+
+	res := Result{Name: name, Status: StatusUp}
+	select {
+	case o := <-done:
+		res.Detail = o.detail
+		if o.err != nil {
+			res.Status = StatusDown
+			res.Error = o.err.Error()
+		}
+	case <-ctx.Done():
+		// 检查超时，不再等待其结果
+		res.Status = StatusDown
+		res.Error = ctx.Err().Error()
+	}
+	res.Duration = time.Since(start).String()
+	return res
+}
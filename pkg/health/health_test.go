@@ -0,0 +1,37 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestChecker(t *testing.T) {
+	c := NewChecker(50 * time.Millisecond)
+	c.Register("ok", func(ctx context.Context) (interface{}, error) {
+		return "fine", nil
+	})
+	report := c.Run(context.Background())
+	if !report.Up() || len(report.Checks) != 1 || report.Checks[0].Detail != "fine" {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	c.Register("broken", func(ctx context.Context) (interface{}, error) {
+		return nil, errors.New("broken")
+	})
+	c.Register("slow", func(ctx context.Context) (interface{}, error) {
+		time.Sleep(time.Second)
+		return nil, nil
+	})
+	report = c.Run(context.Background())
+	if report.Up() {
+		t.Fatal("expected report to be down")
+	}
+	want := map[string]string{"broken": StatusDown, "ok": StatusUp, "slow": StatusDown}
+	for _, res := range report.Checks {
+		if res.Status != want[res.Name] {
+			t.Errorf("%s: got %s, want %s", res.Name, res.Status, want[res.Name])
+		}
+	}
+}
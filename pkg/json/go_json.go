@@ -9,6 +9,9 @@ package json
 
 import json "github.com/goccy/go-json"
 
+// Engine json implementation selected by build tags
+const Engine = "go_json"
+
 var (
 	// Marshal is exported by gin/json package.
 	Marshal = json.Marshal
@@ -9,6 +9,9 @@ package json
 
 import "encoding/json"
 
+// Engine json implementation selected by build tags
+const Engine = "encoding/json"
+
 var (
 	// Marshal is exported by gin/json package.
 	Marshal = json.Marshal
@@ -15,6 +15,9 @@ import (
 	"unsafe"
 )
 
+// Engine json implementation selected by build tags
+const Engine = "jsoniter"
+
 var (
 	json = jsoniter.ConfigCompatibleWithStandardLibrary
 	// Marshal is exported by gin/json package.
@@ -0,0 +1,6 @@
+package json
+
+import std "encoding/json"
+
+// RawMessage is a raw encoded JSON value, supported by all json implementations.
+type RawMessage = std.RawMessage
@@ -0,0 +1,137 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CloseFunc stops a component, it should return once the component stopped or ctx expired
+type CloseFunc func(ctx context.Context) error
+
+type component struct {
+	name  string
+	close CloseFunc
+}
+
+// Manager stops registered components in reverse registration order,
+// so components are stopped before the ones they depend on, e.g. http before the store.
+type Manager struct {
+	mu         sync.Mutex
+	components []component
+	timeout    time.Duration
+	logger     *zap.Logger
+	done       bool
+}
+
+// New creates a manager, each component is given timeout to stop
+func New(timeout time.Duration, logger *zap.Logger) *Manager {
+	return &Manager{
+		timeout: timeout,
+		logger:  logger.With(zap.String("mod", "lifecycle")),
+	}
+}
+
+// Register adds a component to stop on shutdown
+func (m *Manager) Register(name string, fn CloseFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.components = append(m.components, component{name, fn})
+}
+
+// ShutdownError the components that failed to stop
+type ShutdownError struct {
+	Errors map[string]error
+}
+
+func (e *ShutdownError) Error() string {
+	names := make([]string, 0, len(e.Errors))
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, 0, len(names))
+	for _, name := range names {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", name, e.Errors[name]))
+	}
+	return "shutdown failed: " + strings.Join(msgs, "; ")
+}
+
+// Shutdown stops all components, a component failing or timing out does not prevent the next ones from stopping.
+// Calling Shutdown more than once is a no-op.
+func (m *Manager) Shutdown() error {
+	m.mu.Lock()
+	if m.done {
+		m.mu.Unlock()
+		return nil
+	}
+	m.done = true
+	components := make([]component, len(m.components))
+	copy(components, m.components)
+	m.mu.Unlock()
+
+	errs := make(map[string]error)
+	for i := len(components) - 1; i >= 0; i-- {
+		c := components[i]
+		start := time.Now()
+		if err := m.stop(c); err != nil {
+			m.logger.Error("component failed to stop", zap.String("component", c.name), zap.Duration("duration", time.Since(start)), zap.Error(err))
+			errs[c.name] = err
+			continue
+		}
+		m.logger.Info("component stopped", zap.String("component", c.name), zap.Duration("duration", time.Since(start)))
+	}
+	if len(errs) > 0 {
+		return &ShutdownError{Errors: errs}
+	}
+	return nil
+}
+
+func (m *Manager) stop(c component) (err error) {
+	ctx := context.Background()
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		done <- c.close(ctx)
+	}()
+
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		// 组件未在超时时间内停止，不再等待，继续停止下一个组件
+		return fmt.Errorf("did not stop within %s", m.timeout)
+	}
+}
+
+// WaitSignal blocks until one of the signals is received, default to SIGINT and SIGTERM
+func WaitSignal(signals ...os.Signal) os.Signal {
+	if len(signals) == 0 {
+		// kill (no param) default send syscall.SIGTERM
+		// kill -2 is syscall.SIGINT
+		// kill -9 is syscall. SIGKILL but can"t be catch, so don't need add it
+		signals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, signals...)
+	defer signal.Stop(quit)
+	return <-quit
+}
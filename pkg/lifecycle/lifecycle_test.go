@@ -0,0 +1,45 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestShutdown(t *testing.T) {
+	m := New(50*time.Millisecond, zap.NewNop())
+	var order []string
+	m.Register("store", func(ctx context.Context) error {
+		order = append(order, "store")
+		return nil
+	})
+	m.Register("maintenance", func(ctx context.Context) error {
+		panic("boom")
+	})
+	m.Register("webhooks", func(ctx context.Context) error {
+		<-ctx.Done()
+		return errors.New("unreachable")
+	})
+	m.Register("http", func(ctx context.Context) error {
+		order = append(order, "http")
+		return nil
+	})
+
+	err := m.Shutdown()
+	var se *ShutdownError
+	if !errors.As(err, &se) {
+		t.Fatalf("expected ShutdownError, got %v", err)
+	}
+	if len(se.Errors) != 2 || se.Errors["maintenance"] == nil || se.Errors["webhooks"] == nil {
+		t.Fatalf("unexpected errors: %v", se.Errors)
+	}
+	if len(order) != 2 || order[0] != "http" || order[1] != "store" {
+		t.Fatalf("unexpected stop order: %v", order)
+	}
+	if err := m.Shutdown(); err != nil {
+		t.Fatalf("second shutdown: %v", err)
+	}
+}
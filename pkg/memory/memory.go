@@ -0,0 +1,305 @@
+package memory
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shumin1027/otpd/pkg/store"
+)
+
+var (
+	_ store.Store         = (*Store)(nil)
+	_ store.Transactional = (*Store)(nil)
+)
+
+type entry struct {
+	value    []byte
+	expireAt int64 // unix time, 0 never expires
+}
+
+func (e *entry) expired(now int64) bool {
+	return e.expireAt > 0 && e.expireAt <= now
+}
+
+// Store a pure go in-memory store, data is lost on close, intended for tests and development
+type Store struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string]*entry
+	closed  bool
+}
+
+func Open() *Store {
+	return &Store{buckets: make(map[string]map[string]*entry)}
+}
+
+func (s *Store) Bucket(name string) store.Bucket {
+	return &Bucket{name: name, stor: s}
+}
+
+func (s *Store) Driver() string {
+	return store.DriverMemory
+}
+
+func (s *Store) Dir() string {
+	return ""
+}
+
+func (s *Store) Probe() error {
+	b := s.Bucket("__health")
+	v := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := b.SetWithTTL([]byte("probe"), v, time.Now().Add(time.Minute).Unix()); err != nil {
+		return errors.Wrap(err, "write probe")
+	}
+	got, err := b.Get([]byte("probe"))
+	if err != nil {
+		return errors.Wrap(err, "read probe")
+	}
+	if !bytes.Equal(got, v) {
+		return errors.New("probe value mismatch")
+	}
+	return nil
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.buckets = nil
+	return nil
+}
+
+var errClosed = errors.New("store closed")
+
+// Bucket a namespace of keys inside the memory store
+type Bucket struct {
+	name string
+	stor *Store
+}
+
+func (b *Bucket) Set(k, v []byte) error {
+	return b.set(k, v, 0)
+}
+
+func (b *Bucket) SetWithTTL(k, v []byte, expireAt int64) error {
+	return b.set(k, v, expireAt)
+}
+
+func (b *Bucket) set(k, v []byte, expireAt int64) error {
+	s := b.stor
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errClosed
+	}
+	m, ok := s.buckets[b.name]
+	if !ok {
+		m = make(map[string]*entry)
+		s.buckets[b.name] = m
+	}
+	// 拷贝一份，避免调用方修改切片影响已存储的值
+	m[string(k)] = &entry{value: append([]byte(nil), v...), expireAt: expireAt}
+	return nil
+}
+
+func (b *Bucket) Get(k []byte) ([]byte, error) {
+	s := b.stor
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, errClosed
+	}
+	e, ok := s.buckets[b.name][string(k)]
+	if !ok || e.expired(time.Now().Unix()) {
+		return nil, store.ErrNotFound
+	}
+	return append([]byte(nil), e.value...), nil
+}
+
+func (b *Bucket) Has(k []byte) bool {
+	_, err := b.Get(k)
+	return err == nil
+}
+
+func (b *Bucket) Delete(k []byte) error {
+	s := b.stor
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errClosed
+	}
+	delete(s.buckets[b.name], string(k))
+	return nil
+}
+
+// snapshot returns the live entries sorted by key, fn is called without holding the lock
+func (b *Bucket) snapshot() ([]string, []*entry) {
+	s := b.stor
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now().Unix()
+	m := s.buckets[b.name]
+	keys := make([]string, 0, len(m))
+	for k, e := range m {
+		if !e.expired(now) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	entries := make([]*entry, len(keys))
+	for i, k := range keys {
+		entries[i] = m[k]
+	}
+	return keys, entries
+}
+
+func (b *Bucket) Iter(fn func(k, v []byte) error) int64 {
+	var total int64
+	keys, entries := b.snapshot()
+	for i, k := range keys {
+		if err := fn([]byte(k), append([]byte(nil), entries[i].value...)); err == nil {
+			total++
+		}
+	}
+	return total
+}
+
+func (b *Bucket) IterKeys(fn func(k []byte) error) int64 {
+	var total int64
+	keys, _ := b.snapshot()
+	for _, k := range keys {
+		if err := fn([]byte(k)); err == nil {
+			total++
+		}
+	}
+	return total
+}
+
+func (b *Bucket) Scan(start []byte, fn func(k, v []byte) bool) error {
+	keys, entries := b.snapshot()
+	i := sort.SearchStrings(keys, string(start))
+	for ; i < len(keys); i++ {
+		if !fn([]byte(keys[i]), append([]byte(nil), entries[i].value...)) {
+			break
+		}
+	}
+	return nil
+}
+
+func (b *Bucket) Update(k []byte, fn func(v []byte, ok bool) ([]byte, error)) error {
+	s := b.stor
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errClosed
+	}
+	m, ok := s.buckets[b.name]
+	if !ok {
+		m = make(map[string]*entry)
+		s.buckets[b.name] = m
+	}
+	var old []byte
+	var expireAt int64
+	e, ok := m[string(k)]
+	if ok && e.expired(time.Now().Unix()) {
+		ok = false
+	}
+	if ok {
+		old = append([]byte(nil), e.value...)
+		expireAt = e.expireAt
+	}
+	v, err := fn(old, ok)
+	if err != nil {
+		return err
+	}
+	m[string(k)] = &entry{value: append([]byte(nil), v...), expireAt: expireAt}
+	return nil
+}
+
+// Txn implements store.Transactional, the store is locked while fn runs,
+// writes are staged and applied only if fn succeeds
+func (s *Store) Txn(fn func(tx store.Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errClosed
+	}
+	t := &tx{stor: s, now: time.Now().Unix(), writes: make(map[string]map[string]*entry)}
+	if err := fn(t); err != nil {
+		return err
+	}
+	for name, writes := range t.writes {
+		m, ok := s.buckets[name]
+		if !ok {
+			m = make(map[string]*entry)
+			s.buckets[name] = m
+		}
+		for k, e := range writes {
+			if e == nil {
+				delete(m, k)
+				continue
+			}
+			m[k] = e
+		}
+	}
+	return nil
+}
+
+// tx 暂存事务内的写入，nil表示删除
+type tx struct {
+	stor   *Store
+	now    int64
+	writes map[string]map[string]*entry
+}
+
+func (t *tx) Bucket(name string) store.TxBucket {
+	return &txBucket{tx: t, name: name}
+}
+
+type txBucket struct {
+	tx   *tx
+	name string
+}
+
+func (b *txBucket) Get(k []byte) ([]byte, error) {
+	e, ok := b.tx.writes[b.name][string(k)]
+	if !ok {
+		e, ok = b.tx.stor.buckets[b.name][string(k)]
+	}
+	if !ok || e == nil || e.expired(b.tx.now) {
+		return nil, store.ErrNotFound
+	}
+	return append([]byte(nil), e.value...), nil
+}
+
+func (b *txBucket) Has(k []byte) bool {
+	_, err := b.Get(k)
+	return err == nil
+}
+
+func (b *txBucket) Set(k, v []byte) error {
+	b.stage(k, &entry{value: append([]byte(nil), v...)})
+	return nil
+}
+
+func (b *txBucket) SetWithTTL(k, v []byte, expireAt int64) error {
+	b.stage(k, &entry{value: append([]byte(nil), v...), expireAt: expireAt})
+	return nil
+}
+
+func (b *txBucket) Delete(k []byte) error {
+	b.stage(k, nil)
+	return nil
+}
+
+func (b *txBucket) stage(k []byte, e *entry) {
+	m, ok := b.tx.writes[b.name]
+	if !ok {
+		m = make(map[string]*entry)
+		b.tx.writes[b.name] = m
+	}
+	m[string(k)] = e
+}
@@ -1,23 +1,141 @@
 package otp
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/pquerna/otp"
 	"github.com/shumin1027/otpd/pkg/badger"
+	"github.com/shumin1027/otpd/pkg/bolt"
 	"github.com/shumin1027/otpd/pkg/logger"
-	"github.com/vmihailenco/msgpack/v5"
+	"github.com/shumin1027/otpd/pkg/memory"
+	"github.com/shumin1027/otpd/pkg/schema"
+	"github.com/shumin1027/otpd/pkg/store"
+	"go.uber.org/zap"
 )
 
-var bucket *badger.Bucket
+var stor store.Store
+var bucket store.Bucket
+var accounts *store.TypedBucket[Account]
+
+var encryption badger.Encryption
 
-func Init(path string) {
-	stor, _ := badger.Open(path, logger.L())
-	bucket = stor.CreateBucket("otp")
+// SetEncryption encrypts the badger stores opened afterwards, the other drivers do not support it
+func SetEncryption(enc badger.Encryption) {
+	encryption = enc
+}
+
+// Open opens a store with the given driver, support badger, bolt and memory
+func Open(driver, path string) (store.Store, error) {
+	if len(encryption.Key) > 0 && driver != store.DriverBadger && driver != "" {
+		return nil, fmt.Errorf("encryption at rest is not supported by driver %s", driver)
+	}
+	switch driver {
+	case store.DriverBadger, "":
+		return badger.OpenEncrypted(path, encryption, logger.L())
+	case store.DriverBolt:
+		if path == "" {
+			return nil, fmt.Errorf("data path is required for driver %s", driver)
+		}
+		return bolt.Open(path)
+	case store.DriverMemory:
+		return memory.Open(), nil
+	}
+	return nil, fmt.Errorf("unknown storage driver: %s", driver)
+}
+
+// Init opens the store and uses it for accounts,
+// fails if the database was written by a newer otpd
+func Init(driver, path string) error {
+	s, err := Open(driver, path)
+	if err != nil {
+		return err
+	}
+	if err := schema.Check(s, SchemaVersion()); err != nil {
+		s.Close()
+		return err
+	}
+	// 只给空库记录当前版本，已有数据的库由Migrate升级全部记录后再记录
+	if empty(s) {
+		if err := schema.SetVersion(s, SchemaVersion()); err != nil {
+			s.Close()
+			return err
+		}
+	}
+	if err := SetStore(s); err != nil {
+		s.Close()
+		return err
+	}
+	return nil
+}
+
+// empty whether the store holds no account
+func empty(s store.Store) bool {
+	found := false
+	s.Bucket("otp").Scan(nil, func(k, v []byte) bool {
+		found = true
+		return false
+	})
+	return !found
+}
+
+// SetStore uses the given store for accounts, e.g. an in-memory store in tests
+func SetStore(s store.Store) error {
+	stor = s
+	bucket = s.Bucket("otp")
+	accounts = store.NewTypedBucket[Account](bucket, accountSchema.Codec(store.MsgpackCodec))
+	return addIndexes()
+}
+
+// Storage returns the store in use
+func Storage() store.Store {
+	return stor
+}
+
+// accountSchema versions of the stored Account
+//   - 0: msgpack without envelope
+//   - 1: adds CreatedAt and UpdatedAt
+//   - 2: adds Disabled, Groups and LastUsedAt
+var accountSchema = schema.New("account")
+
+func init() {
+	// 旧记录没有时间戳，msgpack按字段名解码，payload无需转换
+	accountSchema.Register(0, func(payload []byte) ([]byte, error) {
+		return payload, nil
+	})
+	// 新字段的零值即为默认值：启用、无分组、从未使用
+	accountSchema.Register(1, func(payload []byte) ([]byte, error) {
+		return payload, nil
+	})
+}
+
+// SchemaVersion the schema version of the database written by this binary
+func SchemaVersion() int {
+	return accountSchema.Version()
 }
 
 type Account struct {
-	OTP    string `json:"otp"`
-	Name   string `json:"name"`
-	QRCode string `json:"qr_code"`
+	OTP       string    `json:"otp"`
+	Name      string    `json:"name"`
+	QRCode    string    `json:"qr_code"`
+	CreatedAt time.Time `json:"created_at" msgpack:",omitempty"`
+	UpdatedAt time.Time `json:"updated_at" msgpack:",omitempty"`
+	// Disabled disabled accounts can not be validated
+	Disabled bool     `json:"disabled" msgpack:",omitempty"`
+	Groups   []string `json:"groups,omitempty" msgpack:",omitempty"`
+	// LastUsedAt last successful validation
+	LastUsedAt time.Time `json:"last_used_at" msgpack:",omitempty"`
+	// Options validation options, nil for the defaults
+	Options *Options `json:"options,omitempty" msgpack:",omitempty"`
+
+	// version the record version the account was read from, not stored
+	version int
+}
+
+// SetSchemaVersion implements schema.Versioned
+func (account *Account) SetSchemaVersion(version int) {
+	account.version = version
 }
 
 func (account *Account) Key() (*otp.Key, error) {
@@ -29,27 +147,164 @@ func (account *Account) Key() (*otp.Key, error) {
 }
 
 func (account *Account) Save() error {
-	// encode
-	buf, err := msgpack.Marshal(&account)
+	if ReadOnly() {
+		return ErrReadOnly
+	}
+	now := time.Now().UTC()
+	if account.CreatedAt.IsZero() {
+		account.CreatedAt = now
+	}
+	account.UpdatedAt = now
+	return account.save()
+}
+
+// SaveAll creates and updates the accounts in one transaction, nothing is written if one fails.
+// Returns ErrExists if one of the created accounts exists, the check is part of the transaction.
+// Stores without transactions save them one by one.
+func SaveAll(created, updated []*Account) error {
+	if ReadOnly() {
+		return ErrReadOnly
+	}
+	list := append(append([]*Account(nil), created...), updated...)
+	now := time.Now().UTC()
+	for _, account := range list {
+		if account.CreatedAt.IsZero() {
+			account.CreatedAt = now
+		}
+		account.UpdatedAt = now
+	}
+	t, ok := stor.(store.Transactional)
+	if !ok {
+		for _, account := range created {
+			if bucket.Has([]byte(account.Name)) {
+				return ErrExists
+			}
+		}
+		for _, account := range list {
+			if err := account.save(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	data := make([][]byte, len(list))
+	for i, account := range list {
+		var err error
+		if data[i], err = accounts.Encode(account); err != nil {
+			return err
+		}
+	}
+	err := t.Txn(func(tx store.Tx) error {
+		b := tx.Bucket("otp")
+		for _, account := range created {
+			if b.Has([]byte(account.Name)) {
+				return ErrExists
+			}
+		}
+		for i, account := range list {
+			if err := b.Set([]byte(account.Name), data[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	return bucket.Set([]byte(account.Name), buf)
+	for _, account := range list {
+		saved := *account
+		invalidate(account.Name, &saved)
+	}
+	return nil
+}
+
+// InGroup reports whether the account is a member of group
+func (account *Account) InGroup(group string) bool {
+	for _, g := range account.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// save writes the account as is, in the current record version
+func (account *Account) save() error {
+	if err := accounts.Put(account.Name, account); err != nil {
+		return err
+	}
+	saved := *account
+	invalidate(account.Name, &saved)
+	return nil
 }
 
 func Get(name string) (*Account, error) {
-	if bucket.Has([]byte(name)) {
-		val, err := bucket.Get([]byte(name))
-		if err != nil {
-			return nil, err
+	account, err := accounts.Get(name)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 读到旧版本记录时顺便写回新版本，失败不影响本次读取
+	if account.version < accountSchema.Version() && !ReadOnly() {
+		if err := account.save(); err != nil {
+			logger.L().Warn("upgrade account record", zap.String("name", name), zap.Int("version", account.version), zap.Error(err))
 		}
-		var account Account
-		// decode
-		err = msgpack.Unmarshal(val, &account)
+	}
+	return account, nil
+}
+
+// Touch records a successful validation of the account
+func Touch(name string) error {
+	return accounts.Update(name, func(account *Account) error {
+		account.LastUsedAt = time.Now().UTC()
+		return nil
+	})
+}
+
+// MigrateResult the records visited by Migrate
+type MigrateResult struct {
+	Total    int `json:"total"`
+	Upgraded int `json:"upgraded"`
+	Failed   int `json:"failed"`
+}
+
+// Migrate upgrades all stored accounts to the current version, nothing is written when dryRun is set.
+// Records that can not be decoded are logged and counted in Failed, an error is returned if there are any.
+func Migrate(dryRun bool) (MigrateResult, error) {
+	var result MigrateResult
+	// 先收集再写入，bolt不允许在只读事务中嵌套写事务
+	outdated := make(map[string]*Account)
+	bucket.Iter(func(k, v []byte) error {
+		result.Total++
+		account, err := accounts.Decode(v)
 		if err != nil {
-			return nil, err
+			result.Failed++
+			logger.L().Error("decode account record", zap.ByteString("name", k), zap.Error(err))
+			return err
+		}
+		if account.version < accountSchema.Version() {
+			outdated[string(k)] = account
+		}
+		return nil
+	})
+	if dryRun {
+		result.Upgraded = len(outdated)
+		if result.Failed > 0 {
+			return result, fmt.Errorf("%d account records could not be decoded", result.Failed)
 		}
-		return &account, nil
+		return result, nil
+	}
+
+	for name, account := range outdated {
+		if err := account.save(); err != nil {
+			return result, fmt.Errorf("upgrade account %s: %w", name, err)
+		}
+		result.Upgraded++
+	}
+	if result.Failed > 0 {
+		return result, fmt.Errorf("%d account records could not be decoded", result.Failed)
 	}
-	return nil, nil
+	return result, schema.SetVersion(stor, accountSchema.Version())
 }
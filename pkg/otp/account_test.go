@@ -0,0 +1,523 @@
+package otp
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shumin1027/otpd/pkg/memory"
+	"github.com/shumin1027/otpd/pkg/schema"
+	"github.com/shumin1027/otpd/pkg/store"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestAccountStore(t *testing.T) {
+	drivers := map[string]string{
+		store.DriverMemory: "",
+		store.DriverBadger: "",
+		store.DriverBolt:   filepath.Join(t.TempDir(), "otpd.db"),
+	}
+	for driver, path := range drivers {
+		t.Run(driver, func(t *testing.T) {
+			if err := Init(driver, path); err != nil {
+				t.Fatal(err)
+			}
+			defer Storage().Close()
+
+			if err := Storage().Probe(); err != nil {
+				t.Fatal(err)
+			}
+
+			account, err := Get("alice")
+			if err != nil || account != nil {
+				t.Fatalf("expected no account, got %v, %v", account, err)
+			}
+
+			key := GenerateKey("alice", GenerateSecret())
+			if err := (&Account{OTP: key.URL(), Name: "alice"}).Save(); err != nil {
+				t.Fatal(err)
+			}
+			account, err = Get("alice")
+			if err != nil || account == nil {
+				t.Fatalf("expected account, got %v, %v", account, err)
+			}
+			if got, _ := account.Key(); got.Secret() != key.Secret() {
+				t.Fatalf("secret mismatch")
+			}
+
+			var names []string
+			bucket.IterKeys(func(k []byte) error {
+				names = append(names, string(k))
+				return nil
+			})
+			if len(names) != 1 || names[0] != "alice" {
+				t.Fatalf("unexpected keys: %v", names)
+			}
+		})
+	}
+}
+
+func TestLegacyAccount(t *testing.T) {
+	if err := SetStore(memory.Open()); err != nil {
+		t.Fatal(err)
+	}
+	defer Storage().Close()
+
+	// 没有版本信封的旧记录
+	legacy := struct {
+		OTP    string
+		Name   string
+		QRCode string
+	}{GenerateKey("bob", GenerateSecret()).URL(), "bob", ""}
+	buf, _ := msgpack.Marshal(&legacy)
+	bucket.Set([]byte("bob"), buf)
+
+	result, err := Migrate(true)
+	if err != nil || result.Total != 1 || result.Upgraded != 1 {
+		t.Fatalf("dry run: %+v, %v", result, err)
+	}
+	account, err := Get("bob")
+	if err != nil || account == nil || account.OTP != legacy.OTP {
+		t.Fatalf("expected legacy account, got %v, %v", account, err)
+	}
+	// Get已经把记录写回为当前版本
+	result, err = Migrate(false)
+	if err != nil || result.Upgraded != 0 {
+		t.Fatalf("migrate: %+v, %v", result, err)
+	}
+	if v, _ := schema.StoredVersion(Storage()); v != SchemaVersion() {
+		t.Fatalf("schema version %d", v)
+	}
+}
+
+func TestMigrateUndecodable(t *testing.T) {
+	if err := SetStore(memory.Open()); err != nil {
+		t.Fatal(err)
+	}
+	defer Storage().Close()
+
+	bucket.Set([]byte("broken"), schema.Encode(1, []byte{0xc1}))
+	result, err := Migrate(true)
+	if err == nil || result.Failed != 1 {
+		t.Fatalf("dry run must report undecodable records: %+v, %v", result, err)
+	}
+}
+
+func TestInitStampsEmptyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "otpd.db")
+	if err := Init(store.DriverBolt, path); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := schema.StoredVersion(Storage()); v != SchemaVersion() {
+		t.Fatalf("empty store not stamped, version %d", v)
+	}
+	Storage().Close()
+
+	// 有数据但没有版本的旧库，Init不能直接记录当前版本
+	path = filepath.Join(t.TempDir(), "legacy.db")
+	s, err := Open(store.DriverBolt, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := msgpack.Marshal(&struct{ OTP, Name string }{GenerateKey("bob", GenerateSecret()).URL(), "bob"})
+	s.Bucket("otp").Set([]byte("bob"), buf)
+	s.Close()
+
+	if err := Init(store.DriverBolt, path); err != nil {
+		t.Fatal(err)
+	}
+	defer Storage().Close()
+	if v, _ := schema.StoredVersion(Storage()); v != 0 {
+		t.Fatalf("store with data stamped as version %d", v)
+	}
+	if _, err := Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := schema.StoredVersion(Storage()); v != SchemaVersion() {
+		t.Fatalf("migrated store version %d", v)
+	}
+}
+
+func TestList(t *testing.T) {
+	drivers := map[string]string{
+		store.DriverMemory: "",
+		store.DriverBadger: "",
+	}
+	for driver, path := range drivers {
+		t.Run(driver, func(t *testing.T) {
+			if err := Init(driver, path); err != nil {
+				t.Fatal(err)
+			}
+			defer Storage().Close()
+
+			old := time.Now().AddDate(0, 0, -100)
+			for _, a := range []*Account{
+				{Name: "alice", Groups: []string{"ops", "dev"}, LastUsedAt: time.Now()},
+				{Name: "bob", Groups: []string{"dev"}, Disabled: true, LastUsedAt: old},
+				{Name: "carol"},
+			} {
+				if err := a.Save(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			names := func(f Filter) string {
+				list, _, err := List(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var names []string
+				for _, a := range list {
+					names = append(names, a.Name)
+				}
+				sort.Strings(names)
+				return strings.Join(names, ",")
+			}
+			disabled, enabled := true, false
+			cases := map[string]Filter{
+				"alice,bob":   {Group: "dev"},
+				"bob":         {Disabled: &disabled},
+				"alice,carol": {Disabled: &enabled},
+				"bob,carol":   {UnusedSince: time.Now().AddDate(0, 0, -90)},
+				"alice":       {Group: "dev", Disabled: &enabled},
+			}
+			for want, f := range cases {
+				if got := names(f); got != want {
+					t.Errorf("%+v: got %s, want %s", f, got, want)
+				}
+			}
+
+			// 分页遍历得到同样的结果，过滤掉的账户不会产生空页
+			for want, f := range cases {
+				var all []string
+				for pages := 0; ; pages++ {
+					f.Limit = 1
+					list, next, err := List(f)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(list) == 0 && next != "" {
+						t.Errorf("%+v: empty page with a cursor", f)
+					}
+					for _, a := range list {
+						all = append(all, a.Name)
+					}
+					if next == "" || pages > 3 {
+						break
+					}
+					f.Cursor = next
+				}
+				sort.Strings(all)
+				if got := strings.Join(all, ","); got != want {
+					t.Errorf("%+v paged: got %s, want %s", f, got, want)
+				}
+			}
+
+			// 更新后旧的索引值失效
+			if err := accounts.Update("alice", func(a *Account) error {
+				a.Groups = []string{"ops"}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if got := names(Filter{Group: "dev"}); got != "bob" {
+				t.Errorf("after update got %s", got)
+			}
+			if err := Touch("bob"); err != nil {
+				t.Fatal(err)
+			}
+			if got := names(Filter{UnusedSince: time.Now().AddDate(0, 0, -90)}); got != "carol" {
+				t.Errorf("after touch got %s", got)
+			}
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	if err := Init(store.DriverBadger, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer Storage().Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events := make(chan AccountEvent, 16)
+	go Watch(ctx, func(e AccountEvent) error {
+		events <- e
+		return nil
+	})
+
+	// 订阅是异步建立的，重复写入直到收到事件
+	account := &Account{Name: "alice", Groups: []string{"ops"}}
+	for {
+		if err := account.Save(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case e := <-events:
+			if e.Op != store.OpPut || e.Name != "alice" || e.Account == nil || e.Account.Groups[0] != "ops" {
+				t.Fatalf("unexpected event: %+v", e)
+			}
+			bucket.Delete([]byte("alice"))
+			for {
+				select {
+				case e := <-events:
+					if e.Op == store.OpDelete {
+						if e.Account != nil {
+							t.Fatalf("unexpected delete event: %+v", e)
+						}
+						return
+					}
+				case <-ctx.Done():
+					t.Fatal("no delete event received")
+				}
+			}
+		case <-time.After(20 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal("no event received")
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	if err := SetStore(memory.Open()); err != nil {
+		t.Fatal(err)
+	}
+	defer Storage().Close()
+	SetGuard(GuardConfig{MaxFailures: 2, LockoutDuration: time.Minute, ReplayWindow: time.Minute})
+
+	if r, _ := Record("alice", "123456", true); r != ResultOK {
+		t.Fatalf("got %s", r)
+	}
+	if r, _ := Record("alice", "123456", true); r != ResultReplay {
+		t.Fatalf("expected replay, got %s", r)
+	}
+	Record("alice", "000000", false)
+	if Locked("alice") {
+		t.Fatal("locked after one failure")
+	}
+	Record("alice", "000000", false)
+	if !Locked("alice") {
+		t.Fatal("not locked after max failures")
+	}
+	// 没有版本信封的旧计数照常累加
+	Storage().Bucket("failures").Set([]byte("bob"), []byte("1"))
+	Record("bob", "000000", false)
+	if !Locked("bob") {
+		t.Fatal("legacy failure count not read")
+	}
+
+	// 存储出错时不能放行验证码
+	Storage().Close()
+	if r, err := Record("alice", "654321", true); err == nil || r != ResultError {
+		t.Fatalf("expected error result, got %s, %v", r, err)
+	}
+	if r, err := Record("alice", "000000", false); err == nil || r != ResultError {
+		t.Fatalf("expected error result, got %s, %v", r, err)
+	}
+}
+
+func TestLookupKeyCache(t *testing.T) {
+	for _, driver := range []string{store.DriverMemory, store.DriverBadger} {
+		t.Run(driver, func(t *testing.T) {
+			if err := Init(driver, ""); err != nil {
+				t.Fatal(err)
+			}
+			defer Storage().Close()
+			stop, err := EnableCache(CacheConfig{MaxEntries: 100, TTL: time.Minute})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stop(context.Background())
+
+			first := GenerateKey("alice", GenerateSecret())
+			if err := (&Account{OTP: first.URL(), Name: "alice"}).Save(); err != nil {
+				t.Fatal(err)
+			}
+			if _, key, err := LookupKey("alice"); err != nil || key.Secret() != first.Secret() {
+				t.Fatalf("got %v, %v", key, err)
+			}
+			currentCache().cache.Wait()
+			if _, ok := currentCache().get("alice"); !ok {
+				t.Fatal("account not cached")
+			}
+
+			// 更换密钥后缓存失效，badger通过变更订阅异步失效
+			second := GenerateKey("alice", GenerateSecret())
+			if err := (&Account{OTP: second.URL(), Name: "alice"}).Save(); err != nil {
+				t.Fatal(err)
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				currentCache().cache.Wait()
+				_, key, err := LookupKey("alice")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if key.Secret() == second.Secret() {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("cached key not invalidated")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestCachePendingRead(t *testing.T) {
+	stop, err := EnableCache(CacheConfig{MaxEntries: 100, TTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop(context.Background())
+	c := currentCache()
+	read := func(name, otp string) *cacheEntry {
+		return &cacheEntry{account: &Account{Name: name, OTP: otp}}
+	}
+
+	// 其它账户的变化不影响缓存
+	gen := c.begin("alice")
+	c.update("bob", nil)
+	c.finish("alice", gen, read("alice", "a"))
+	c.cache.Wait()
+	if _, ok := c.get("alice"); !ok {
+		t.Error("change of another account prevented caching")
+	}
+
+	// 读取期间账户变成了其它值，不缓存读到的值
+	gen = c.begin("carol")
+	c.update("carol", &Account{Name: "carol", OTP: "new"})
+	c.finish("carol", gen, read("carol", "old"))
+	c.cache.Wait()
+	if _, ok := c.get("carol"); ok {
+		t.Error("stale account cached")
+	}
+
+	// 收到的变化就是读到的值，可以缓存
+	gen = c.begin("dave")
+	c.update("dave", &Account{Name: "dave", OTP: "d"})
+	c.finish("dave", gen, read("dave", "d"))
+	c.cache.Wait()
+	if _, ok := c.get("dave"); !ok {
+		t.Error("account matching the change not cached")
+	}
+	if len(c.reads) != 0 {
+		t.Errorf("pending reads left: %v", c.reads)
+	}
+}
+
+func TestManage(t *testing.T) {
+	if err := SetStore(memory.Open()); err != nil {
+		t.Fatal(err)
+	}
+	defer Storage().Close()
+
+	account, err := Create("alice", []string{"ops"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Create("alice", nil); !errors.Is(err, ErrExists) {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+	if _, err := Create("export", nil); !errors.Is(err, ErrReserved) {
+		t.Fatalf("expected ErrReserved, got %v", err)
+	}
+	disabled, err := SetDisabled("alice", true)
+	if err != nil || !disabled.Disabled || disabled.OTP != account.OTP {
+		t.Fatalf("disable: %+v, %v", disabled, err)
+	}
+	rekeyed, err := Rekey("alice")
+	if err != nil || rekeyed.OTP == account.OTP || !rekeyed.Disabled {
+		t.Fatalf("rekey: %+v, %v", rekeyed, err)
+	}
+	Storage().Bucket("failures").Set([]byte("alice"), []byte("3"))
+	if err := Delete("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if Storage().Bucket("failures").Has([]byte("alice")) {
+		t.Error("failure count left after delete")
+	}
+	if err := Delete("alice"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := SetDisabled("alice", false); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestSaveAll(t *testing.T) {
+	if err := SetStore(memory.Open()); err != nil {
+		t.Fatal(err)
+	}
+	defer Storage().Close()
+
+	alice, err := Create("alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 要创建的账户已存在时什么都不写入
+	bob := &Account{Name: "bob", OTP: alice.OTP}
+	alice.Disabled = true
+	if err := SaveAll([]*Account{bob, {Name: "alice"}}, []*Account{alice}); !errors.Is(err, ErrExists) {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+	if a, _ := Get("bob"); a != nil {
+		t.Error("bob created by a failed save")
+	}
+	if a, _ := Get("alice"); a == nil || a.Disabled {
+		t.Error("alice updated by a failed save")
+	}
+	if err := SaveAll([]*Account{bob}, []*Account{alice}); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := Get("alice"); a == nil || !a.Disabled || !Storage().Bucket("otp").Has([]byte("bob")) {
+		t.Error("accounts not saved")
+	}
+}
+
+func TestScratchCode(t *testing.T) {
+	if err := SetStore(memory.Open()); err != nil {
+		t.Fatal(err)
+	}
+	defer Storage().Close()
+
+	if _, err := Create("alice", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounts.Update("alice", func(a *Account) error {
+		a.Options = &Options{WindowSize: 99, ScratchCodes: []string{"12345678", "87654321"}}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	account, _ := Get("alice")
+	if !account.Options.HasScratchCode("12345678") || account.Options.Window() != MaxWindowSize {
+		t.Fatalf("unexpected options %+v", account.Options)
+	}
+	if used, err := UseScratchCode("alice", "12345678"); err != nil || !used {
+		t.Fatalf("use: %v, %v", used, err)
+	}
+	// 应急码只能使用一次
+	if used, err := UseScratchCode("alice", "12345678"); err != nil || used {
+		t.Fatalf("used twice: %v, %v", used, err)
+	}
+	if account, _ := Get("alice"); len(account.Options.ScratchCodes) != 1 {
+		t.Errorf("unexpected scratch codes %v", account.Options.ScratchCodes)
+	}
+	if _, err := UseScratchCode("bob", "12345678"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// Record使用应急码，follower转发的校验也能使用
+	if result, err := Record("alice", "87654321", false); err != nil || result != ResultOK {
+		t.Fatalf("record scratch code: %v, %v", result, err)
+	}
+	if result, err := Record("alice", "87654321", false); err != nil || result != ResultBadCode {
+		t.Fatalf("record used scratch code: %v, %v", result, err)
+	}
+}
@@ -0,0 +1,222 @@
+package otp
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/pquerna/otp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shumin1027/otpd/pkg/logger"
+	"go.uber.org/zap"
+)
+
+var (
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otpd_account_cache_requests_total",
+		Help: "Account cache lookups by result.",
+	}, []string{"result"})
+	cacheHits          = cacheRequests.WithLabelValues("hit")
+	cacheMisses        = cacheRequests.WithLabelValues("miss")
+	cacheInvalidations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "otpd_account_cache_invalidations_total",
+		Help: "Cached accounts dropped because their key changed or they were deleted.",
+	})
+)
+
+// CacheConfig account cache settings
+type CacheConfig struct {
+	// MaxEntries number of accounts kept in memory, 0 disables the cache
+	MaxEntries int64
+	// TTL how long an account is cached, bounds staleness when the store can not be watched
+	TTL time.Duration
+}
+
+// cacheEntry a decoded account with its parsed key
+type cacheEntry struct {
+	account *Account
+	key     *otp.Key
+}
+
+// accountCache 缓存解码后的账户，校验时不再读取存储和解析otpauth url
+type accountCache struct {
+	cache *ristretto.Cache
+	ttl   time.Duration
+
+	// mu 保证失效和写入缓存的顺序，reads记录正在读取存储的账户，
+	// 读取期间该账户变成了其它值则不写入缓存，避免缓存旧值
+	mu    sync.Mutex
+	reads map[string]*pendingRead
+}
+
+// pendingRead the lookups of an account reading the store and its changes since
+type pendingRead struct {
+	readers    int
+	generation uint64
+	// latest the account of the last change, nil when deleted
+	latest *Account
+}
+
+// cache the enabled *accountCache, nil when disabled
+var cache atomic.Value
+
+func init() {
+	cache.Store((*accountCache)(nil))
+}
+
+func currentCache() *accountCache {
+	return cache.Load().(*accountCache)
+}
+
+// EnableCache caches the decoded accounts read by LookupKey. Entries are refreshed or
+// dropped from the change feed of the store, or on local writes when the store can not
+// be watched. Call it after the final SetStore, the returned func stops the watcher.
+func EnableCache(cfg CacheConfig) (func(context.Context) error, error) {
+	if cfg.MaxEntries <= 0 {
+		return func(context.Context) error { return nil }, nil
+	}
+	rc, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters:        cfg.MaxEntries * 10,
+		MaxCost:            cfg.MaxEntries,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := &accountCache{cache: rc, ttl: cfg.TTL, reads: make(map[string]*pendingRead)}
+	cache.Store(c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := Watch(ctx, func(e AccountEvent) error {
+			c.update(e.Name, e.Account)
+			return nil
+		})
+		if errors.Is(err, ErrWatchUnsupported) {
+			logger.L().Info("store can not be watched, cached accounts expire after the ttl", zap.Duration("ttl", cfg.TTL))
+		} else if err != nil {
+			logger.L().Error("watch accounts for the cache", zap.Error(err))
+		}
+	}()
+
+	return func(ctx context.Context) error {
+		cancel()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		cache.CompareAndSwap(c, (*accountCache)(nil))
+		rc.Close()
+		return nil
+	}, nil
+}
+
+func (c *accountCache) get(name string) (*cacheEntry, bool) {
+	v, ok := c.cache.Get(name)
+	if !ok {
+		return nil, false
+	}
+	return v.(*cacheEntry), true
+}
+
+// begin registers a lookup reading the account from the store, returns its generation
+func (c *accountCache) begin(name string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.reads[name]
+	if !ok {
+		p = &pendingRead{}
+		c.reads[name] = p
+	}
+	p.readers++
+	return p.generation
+}
+
+// finish ends a lookup started at gen, entry is cached unless the account changed
+// in the meantime to something else than what was read. entry is nil when the read failed.
+func (c *accountCache) finish(name string, gen uint64, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.reads[name]
+	// 变更订阅异步送达，读取期间收到的可能正是读到的这次写入
+	if entry != nil && (p.generation == gen || reflect.DeepEqual(p.latest, entry.account)) {
+		c.cache.SetWithTTL(name, entry, 1, c.ttl)
+	}
+	if p.readers--; p.readers == 0 {
+		delete(c.reads, name)
+	}
+}
+
+// update 账户变化时，key不变则替换缓存的账户，否则丢弃，account为nil表示已删除
+func (c *accountCache) update(name string, account *Account) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.reads[name]; ok {
+		p.generation++
+		p.latest = account
+	}
+	entry, ok := c.get(name)
+	if !ok {
+		return
+	}
+	if account == nil || account.OTP != entry.account.OTP {
+		c.cache.Del(name)
+		cacheInvalidations.Inc()
+		return
+	}
+	c.cache.SetWithTTL(name, &cacheEntry{account: account, key: entry.key}, 1, c.ttl)
+}
+
+// LookupKey returns the account and its parsed key, from the cache when enabled.
+// Both are nil if the account does not exist.
+func LookupKey(name string) (*Account, *otp.Key, error) {
+	c := currentCache()
+	if c == nil {
+		return lookupKey(name)
+	}
+	if entry, ok := c.get(name); ok {
+		cacheHits.Inc()
+		account := *entry.account
+		return &account, entry.key, nil
+	}
+	cacheMisses.Inc()
+
+	gen := c.begin(name)
+	account, key, err := lookupKey(name)
+	var entry *cacheEntry
+	if account != nil {
+		cached := *account
+		entry = &cacheEntry{account: &cached, key: key}
+	}
+	c.finish(name, gen, entry)
+	return account, key, err
+}
+
+// lookupKey reads the account from the store and parses its key
+func lookupKey(name string) (*Account, *otp.Key, error) {
+	account, err := Get(name)
+	if err != nil || account == nil {
+		return nil, nil, err
+	}
+	key, err := account.Key()
+	if err != nil {
+		return nil, nil, err
+	}
+	return account, key, nil
+}
+
+// invalidate drops a locally written account, the change feed may deliver it later
+func invalidate(name string, account *Account) {
+	if c := currentCache(); c != nil {
+		c.update(name, account)
+	}
+}
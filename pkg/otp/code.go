@@ -0,0 +1,208 @@
+package otp
+
+import (
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
+)
+
+// CodeParams parameters of HOTP (RFC 4226) and TOTP (RFC 6238) codes
+type CodeParams struct {
+	// Key raw shared secret
+	Key []byte
+	// TOTP time based codes, counter based otherwise
+	TOTP      bool
+	Algorithm otp.Algorithm
+	Digits    int
+	// Period time step of TOTP
+	Period time.Duration
+	// Start the time TOTP steps are counted from, T0 of RFC 6238
+	Start time.Time
+	// Counter the moving factor of HOTP
+	Counter uint64
+}
+
+// DefaultCodeParams the parameters of the codes issued by otpd
+func DefaultCodeParams() CodeParams {
+	return CodeParams{
+		TOTP:      true,
+		Algorithm: otp.AlgorithmSHA1,
+		Digits:    6,
+		Period:    30 * time.Second,
+		Start:     time.Unix(0, 0),
+	}
+}
+
+// ParseKey decodes a base32 secret, case, spaces and padding do not matter
+func ParseKey(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Join(strings.Fields(secret), ""))
+	secret = strings.TrimRight(secret, "=")
+	key, err := b32NoPadding.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base32 secret: %w", err)
+	}
+	return key, nil
+}
+
+// EncodeKey encodes a secret as unpadded base32, the form used in otpauth:// URIs
+func EncodeKey(key []byte) string {
+	return b32NoPadding.EncodeToString(key)
+}
+
+// ParseHexKey decodes a hex secret, the default key format of oathtool
+func ParseHexKey(secret string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.Join(strings.Fields(secret), ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex secret: %w", err)
+	}
+	return key, nil
+}
+
+// ParseCodeURL reads the parameters of an otpauth:// URI, missing ones keep their default
+func ParseCodeURL(uri string) (CodeParams, error) {
+	p := DefaultCodeParams()
+	u, err := url.Parse(uri)
+	if err != nil {
+		return p, err
+	}
+	if u.Scheme != "otpauth" {
+		return p, fmt.Errorf("not an otpauth uri: %s", uri)
+	}
+	switch strings.ToLower(u.Host) {
+	case "totp":
+	case "hotp":
+		p.TOTP = false
+	default:
+		return p, fmt.Errorf("unknown otp type: %s", u.Host)
+	}
+	q := u.Query()
+	if p.Key, err = ParseKey(q.Get("secret")); err != nil {
+		return p, err
+	}
+	if v := q.Get("algorithm"); v != "" {
+		if p.Algorithm, err = ParseAlgorithm(v); err != nil {
+			return p, err
+		}
+	}
+	if v := q.Get("digits"); v != "" {
+		if p.Digits, err = strconv.Atoi(v); err != nil {
+			return p, fmt.Errorf("invalid digits: %s", v)
+		}
+	}
+	if v := q.Get("period"); v != "" {
+		period, err := strconv.Atoi(v)
+		if err != nil || period <= 0 {
+			return p, fmt.Errorf("invalid period: %s", v)
+		}
+		p.Period = time.Duration(period) * time.Second
+	}
+	if v := q.Get("counter"); v != "" {
+		if p.Counter, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return p, fmt.Errorf("invalid counter: %s", v)
+		}
+	}
+	return p, nil
+}
+
+// ParseAlgorithm parses sha1, sha256 or sha512, case insensitive
+func ParseAlgorithm(s string) (otp.Algorithm, error) {
+	switch strings.ToLower(strings.ReplaceAll(s, "-", "")) {
+	case "sha1":
+		return otp.AlgorithmSHA1, nil
+	case "sha256":
+		return otp.AlgorithmSHA256, nil
+	case "sha512":
+		return otp.AlgorithmSHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported algorithm: %s", s)
+}
+
+// Step the TOTP time step of t, negative before Start
+func (p CodeParams) Step(t time.Time) int64 {
+	d := t.Sub(p.Start)
+	step := int64(d / p.Period)
+	if d < 0 && d%p.Period != 0 {
+		step--
+	}
+	return step
+}
+
+// Code the code of a counter, or of a time step for TOTP
+func (p CodeParams) Code(counter uint64) (string, error) {
+	if p.Digits < 1 || p.Digits > 10 {
+		return "", fmt.Errorf("digits must be between 1 and 10, got %d", p.Digits)
+	}
+	return hotp.GenerateCodeCustom(base32.StdEncoding.EncodeToString(p.Key), counter, hotp.ValidateOpts{
+		Digits:    otp.Digits(p.Digits),
+		Algorithm: p.Algorithm,
+	})
+}
+
+// Verify searches the code in the counters, or time steps for TOTP, from first to last
+// and returns the matching one
+func (p CodeParams) Verify(code string, first, last uint64) (uint64, bool, error) {
+	for c := first; ; c++ {
+		expected, err := p.Code(c)
+		if err != nil {
+			return 0, false, err
+		}
+		if expected == code {
+			return c, true, nil
+		}
+		if c == last {
+			return 0, false, nil
+		}
+	}
+}
+
+// URL the otpauth:// URI of the parameters, labeled issuer:name like the keys issued by otpd
+func (p CodeParams) URL(issuer, name string) string {
+	q := url.Values{}
+	q.Set("secret", EncodeKey(p.Key))
+	if issuer != "" {
+		q.Set("issuer", issuer)
+	}
+	q.Set("algorithm", p.Algorithm.String())
+	q.Set("digits", strconv.Itoa(p.Digits))
+	typ := "hotp"
+	if p.TOTP {
+		typ = "totp"
+		q.Set("period", strconv.Itoa(int(p.Period/time.Second)))
+	} else {
+		q.Set("counter", strconv.FormatUint(p.Counter, 10))
+	}
+	label := name
+	if issuer != "" {
+		label = issuer + ":" + name
+	}
+	u := url.URL{Scheme: "otpauth", Host: typ, Path: "/" + label, RawQuery: q.Encode()}
+	return u.String()
+}
+
+// ValidateKey validates a TOTP passcode with the algorithm, digits and period of the key,
+// accepting the codes of window time steps centered on the current one, see Options.Window
+func ValidateKey(passcode string, key *otp.Key, window int) bool {
+	p, err := ParseCodeURL(key.URL())
+	if err != nil || !p.TOTP {
+		return Validate(passcode, key.Secret())
+	}
+	step := p.Step(time.Now())
+	skew := int64(window-1) / 2
+	for s := step - skew; s <= step+skew; s++ {
+		if s < 0 {
+			continue
+		}
+		if code, err := p.Code(uint64(s)); err == nil && subtle.ConstantTimeCompare([]byte(code), []byte(passcode)) == 1 {
+			return true
+		}
+	}
+	return false
+}
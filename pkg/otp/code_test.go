@@ -0,0 +1,48 @@
+package otp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+)
+
+func TestCodeParams(t *testing.T) {
+	// RFC 6238 附录B的测试向量
+	p, err := ParseCodeURL("otpauth://totp/test?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ&digits=8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for sec, want := range map[int64]string{59: "94287082", 1111111109: "07081804", 2000000000: "69279037"} {
+		code, err := p.Code(uint64(p.Step(time.Unix(sec, 0))))
+		if err != nil || code != want {
+			t.Fatalf("at %d: got %s, want %s, %v", sec, code, want, err)
+		}
+	}
+	p.Algorithm = otp.AlgorithmSHA256
+	p.Key = []byte("12345678901234567890123456789012")
+	if code, _ := p.Code(1); code != "46119246" {
+		t.Fatalf("sha256: got %s", code)
+	}
+
+	// RFC 4226 附录D
+	key, err := ParseHexKey("3132333435363738393031323334353637383930")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := DefaultCodeParams()
+	h.TOTP, h.Key = false, key
+	if c, ok, _ := h.Verify("399871", 0, 9); !ok || c != 8 {
+		t.Fatalf("verify: %d %v", c, ok)
+	}
+	if _, ok, _ := h.Verify("399871", 0, 7); ok {
+		t.Fatal("found outside of the window")
+	}
+
+	if _, err := ParseKey("gezd gnbv gy3t qojq"); err != nil {
+		t.Fatal(err)
+	}
+	if p.Step(time.Unix(-1, 0)) != -1 {
+		t.Fatal("negative step")
+	}
+}
@@ -0,0 +1,56 @@
+package otp
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/shumin1027/otpd/pkg/logger"
+	"github.com/shumin1027/otpd/pkg/store"
+	"go.uber.org/zap"
+)
+
+// ErrWatchUnsupported the storage driver does not publish changes
+var ErrWatchUnsupported = errors.New("storage driver does not support watching changes")
+
+// AccountEvent a change of an account
+type AccountEvent struct {
+	Op   store.Op
+	Name string
+	// Account nil when deleted
+	Account *Account
+	Version uint64
+	Time    time.Time
+}
+
+// Watch calls fn for every account change until ctx is done, see store.Watcher
+func Watch(ctx context.Context, fn func(AccountEvent) error) error {
+	w, ok := bucket.(store.Watcher)
+	if !ok {
+		return ErrWatchUnsupported
+	}
+	return w.Watch(ctx, func(e store.Event) error {
+		event := AccountEvent{
+			Op:      e.Op,
+			Name:    string(e.Key),
+			Version: e.Version,
+			Time:    time.Now(),
+		}
+		if e.Op == store.OpPut {
+			account, err := accounts.Decode(e.Value)
+			if err != nil {
+				// 无法解码的记录不影响后续事件
+				logger.L().Warn("decode account event", zap.String("name", event.Name), zap.Error(err))
+				return nil
+			}
+			event.Account = account
+		}
+		return fn(event)
+	})
+}
+
+// Watchable whether the store in use supports Watch
+func Watchable() bool {
+	_, ok := bucket.(store.Watcher)
+	return ok
+}
@@ -0,0 +1,270 @@
+package otp
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shumin1027/otpd/pkg/schema"
+	"github.com/shumin1027/otpd/pkg/store"
+)
+
+// ErrReadOnly returned by writes on a read-only follower
+var ErrReadOnly = errors.New("read-only follower, write to the leader")
+
+// Result the outcome of a passcode validation
+type Result string
+
+const (
+	ResultOK      Result = "ok"
+	ResultBadCode Result = "bad_code"
+	ResultReplay  Result = "replay"
+	ResultLocked  Result = "locked"
+	// ResultError the validation could not be recorded, the passcode is rejected
+	ResultError Result = "error"
+)
+
+// GuardConfig replay protection and lockout settings
+type GuardConfig struct {
+	// MaxFailures failed validations before the account is locked, 0 disables lockout.
+	// Anyone can lock an account through /validate, so it is off by default.
+	MaxFailures int
+	// LockoutDuration how long failures are remembered and the account stays locked
+	LockoutDuration time.Duration
+	// ReplayWindow how long a used passcode is rejected, covers the accepted clock skew
+	ReplayWindow time.Duration
+}
+
+var guard = GuardConfig{
+	LockoutDuration: 15 * time.Minute,
+	ReplayWindow:    90 * time.Second,
+}
+
+// guardSchema versions of the failure counts and used passcodes
+//   - 0: the value without envelope
+//   - 1: in the version envelope
+var guardSchema = schema.New("guard")
+
+func init() {
+	guardSchema.Register(0, func(payload []byte) ([]byte, error) {
+		return payload, nil
+	})
+}
+
+func encodeCount(n int) []byte {
+	return guardSchema.Marshal([]byte(strconv.Itoa(n)))
+}
+
+// decodeCount 无法解析的计数视为0
+func decodeCount(data []byte) int {
+	payload, _, err := guardSchema.Unmarshal(data)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(string(payload))
+	return n
+}
+
+// usedMark the value of a used passcode
+func usedMark() []byte {
+	return guardSchema.Marshal([]byte{'1'})
+}
+
+// SetGuard changes the replay protection and lockout settings
+func SetGuard(cfg GuardConfig) {
+	guard = cfg
+}
+
+// Recorder records the state changes of a validation and returns its final result
+type Recorder func(name, passcode string, ok bool) (Result, error)
+
+var (
+	recorderMu sync.RWMutex
+	recorder   Recorder = Record
+	readOnly   int32
+)
+
+// SetRecorder replaces the recorder, e.g. followers forward validations to the leader
+func SetRecorder(r Recorder) {
+	recorderMu.Lock()
+	defer recorderMu.Unlock()
+	recorder = r
+}
+
+// SetReadOnly rejects account writes, used by followers
+func SetReadOnly(ro bool) {
+	var v int32
+	if ro {
+		v = 1
+	}
+	atomic.StoreInt32(&readOnly, v)
+}
+
+// ReadOnly whether account writes are rejected
+func ReadOnly() bool {
+	return atomic.LoadInt32(&readOnly) == 1
+}
+
+// RecordValidation records a validation with the current recorder
+func RecordValidation(name, passcode string, ok bool) (Result, error) {
+	recorderMu.RLock()
+	r := recorder
+	recorderMu.RUnlock()
+	return r(name, passcode, ok)
+}
+
+// Locked whether the account is locked after too many failures
+func Locked(name string) bool {
+	if guard.MaxFailures <= 0 {
+		return false
+	}
+	return failures(name) >= guard.MaxFailures
+}
+
+func failures(name string) int {
+	val, err := stor.Bucket("failures").Get([]byte(name))
+	if err != nil {
+		return 0
+	}
+	return decodeCount(val)
+}
+
+// Record applies a validation to the local store: a failed passcode matching a scratch code
+// consumes it and succeeds. A successful passcode is rejected if already used, otherwise
+// it is marked used, failures are reset and the account touched.
+// A failed passcode counts towards the lockout.
+// On any error ResultError is returned, a passcode is never accepted without replay protection.
+// The writes are committed in one transaction when the store is Transactional.
+func Record(name, passcode string, ok bool) (Result, error) {
+	// 应急码在写入的节点上使用，follower转发的校验同样生效
+	if !ok {
+		account, err := Get(name)
+		if err != nil {
+			return ResultError, err
+		}
+		if account != nil && account.Options.HasScratchCode(passcode) {
+			if ok, err = UseScratchCode(name, passcode); err != nil {
+				return ResultError, err
+			}
+		}
+	}
+	t, transactional := stor.(store.Transactional)
+	if !transactional {
+		return recordEach(name, passcode, ok)
+	}
+	if !ok {
+		if guard.MaxFailures <= 0 {
+			return ResultBadCode, nil
+		}
+		expireAt := time.Now().Add(guard.LockoutDuration).Unix()
+		err := t.Txn(func(tx store.Tx) error {
+			failed := tx.Bucket("failures")
+			n := 0
+			if v, err := failed.Get([]byte(name)); err == nil {
+				n = decodeCount(v)
+			}
+			// 每次失败都延长计数的有效期
+			return failed.SetWithTTL([]byte(name), encodeCount(n+1), expireAt)
+		})
+		if err != nil {
+			return ResultError, err
+		}
+		return ResultBadCode, nil
+	}
+
+	result := ResultOK
+	now := time.Now()
+	err := t.Txn(func(tx store.Tx) error {
+		// 冲突重试时fn会重新执行，先重置结果
+		result = ResultOK
+		if guard.ReplayWindow > 0 {
+			used := tx.Bucket("replay")
+			key := []byte(name + ":" + passcode)
+			if used.Has(key) {
+				result = ResultReplay
+				return nil
+			}
+			if err := used.SetWithTTL(key, usedMark(), now.Add(guard.ReplayWindow).Unix()); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket("failures").Delete([]byte(name)); err != nil {
+			return err
+		}
+		return touch(tx, name, now)
+	})
+	if err != nil {
+		return ResultError, err
+	}
+	return result, nil
+}
+
+// touch updates the last use of an account inside a transaction, missing accounts are ignored
+func touch(tx store.Tx, name string, now time.Time) error {
+	b := tx.Bucket("otp")
+	data, err := b.Get([]byte(name))
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	account, err := accounts.Decode(data)
+	if err != nil {
+		return err
+	}
+	account.LastUsedAt = now.UTC()
+	if data, err = accounts.Encode(account); err != nil {
+		return err
+	}
+	return b.Set([]byte(name), data)
+}
+
+// recordEach Record for stores without transactions, each write is committed separately
+func recordEach(name, passcode string, ok bool) (Result, error) {
+	failed := stor.Bucket("failures")
+	if !ok {
+		if guard.MaxFailures <= 0 {
+			return ResultBadCode, nil
+		}
+		// 每次失败都延长计数的有效期
+		expireAt := time.Now().Add(guard.LockoutDuration).Unix()
+		n := failures(name) + 1
+		if err := failed.SetWithTTL([]byte(name), encodeCount(n), expireAt); err != nil {
+			return ResultError, err
+		}
+		return ResultBadCode, nil
+	}
+
+	if guard.ReplayWindow > 0 {
+		replay := false
+		used := stor.Bucket("replay")
+		key := []byte(name + ":" + passcode)
+		err := used.Update(key, func(v []byte, exists bool) ([]byte, error) {
+			if exists {
+				replay = true
+				return nil, store.ErrStop
+			}
+			return usedMark(), nil
+		})
+		if err != nil && err != store.ErrStop {
+			return ResultError, err
+		}
+		if replay {
+			return ResultReplay, nil
+		}
+		// Update保留原有过期时间，新记录再设置TTL
+		if err := used.SetWithTTL(key, usedMark(), time.Now().Add(guard.ReplayWindow).Unix()); err != nil {
+			return ResultError, err
+		}
+	}
+	if err := failed.Delete([]byte(name)); err != nil {
+		return ResultError, err
+	}
+	if err := Touch(name); err != nil && !errors.Is(err, store.ErrNotFound) {
+		return ResultError, err
+	}
+	return ResultOK, nil
+}
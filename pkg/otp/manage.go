@@ -0,0 +1,116 @@
+package otp
+
+import (
+	"errors"
+	"time"
+
+	"github.com/shumin1027/otpd/pkg/store"
+)
+
+var (
+	// ErrNotFound returned when the account does not exist
+	ErrNotFound = errors.New("account not found")
+	// ErrExists returned by Create when the account already exists
+	ErrExists = errors.New("account already exists")
+	// ErrReserved returned by Create for the names of the fixed /admin/accounts routes
+	ErrReserved = errors.New("account name is reserved")
+)
+
+// reservedNames 与/admin/accounts/export和report冲突，这样的账户无法通过/admin/accounts/:name查看
+var reservedNames = map[string]bool{"export": true, "report": true}
+
+// Create enrolls a new account with a random secret, returns ErrExists if the name is taken
+// and ErrReserved for export and report
+func Create(name string, groups []string) (*Account, error) {
+	if name == "" {
+		return nil, errors.New("the name cannot be empty")
+	}
+	if reservedNames[name] {
+		return nil, ErrReserved
+	}
+	account := &Account{Name: name, Groups: groups}
+	account.newKey()
+	// 检查与写入在同一个事务中，并发创建同名账户时只有一个成功
+	if err := SaveAll([]*Account{account}, nil); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// newKey 生成新的密钥和对应的二维码
+func (account *Account) newKey() {
+	key := GenerateKey(account.Name, GenerateSecret())
+	account.OTP = key.URL()
+	account.QRCode = GenerateQRCode(key)
+}
+
+// Delete removes the account and its failure count, returns ErrNotFound if it does not exist
+func Delete(name string) error {
+	if ReadOnly() {
+		return ErrReadOnly
+	}
+	t, ok := stor.(store.Transactional)
+	if !ok {
+		if !bucket.Has([]byte(name)) {
+			return ErrNotFound
+		}
+		if err := accounts.Delete(name); err != nil {
+			return err
+		}
+		invalidate(name, nil)
+		return stor.Bucket("failures").Delete([]byte(name))
+	}
+	// 账户和失败计数一起删除，不会留下只删了一半的状态
+	err := t.Txn(func(tx store.Tx) error {
+		b := tx.Bucket("otp")
+		if !b.Has([]byte(name)) {
+			return ErrNotFound
+		}
+		if err := b.Delete([]byte(name)); err != nil {
+			return err
+		}
+		return tx.Bucket("failures").Delete([]byte(name))
+	})
+	if err != nil {
+		return err
+	}
+	invalidate(name, nil)
+	return nil
+}
+
+// SetDisabled disables or enables the account, disabled accounts fail validation
+func SetDisabled(name string, disabled bool) (*Account, error) {
+	return modify(name, func(account *Account) {
+		account.Disabled = disabled
+	})
+}
+
+// Rekey replaces the secret of the account, the previous authenticator stops working
+func Rekey(name string) (*Account, error) {
+	return modify(name, func(account *Account) {
+		account.newKey()
+	})
+}
+
+// modify updates a stored account in one transaction, returns ErrNotFound if it does not exist
+func modify(name string, fn func(*Account)) (*Account, error) {
+	if ReadOnly() {
+		return nil, ErrReadOnly
+	}
+	var updated *Account
+	err := accounts.Update(name, func(account *Account) error {
+		fn(account)
+		account.UpdatedAt = time.Now().UTC()
+		updated = account
+		return nil
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	saved := *updated
+	invalidate(name, &saved)
+	return updated, nil
+}
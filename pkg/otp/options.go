@@ -0,0 +1,94 @@
+package otp
+
+import (
+	"crypto/subtle"
+	"errors"
+
+	"github.com/shumin1027/otpd/pkg/store"
+)
+
+const (
+	// DefaultWindowSize codes accepted around the current time step, one step of clock skew each way
+	DefaultWindowSize = 3
+	// MaxWindowSize larger windows are reduced to this size, they make guessing codes too easy
+	MaxWindowSize = 21
+)
+
+// Options per account validation options, as in pam_google_authenticator files
+type Options struct {
+	// WindowSize codes accepted around the current time step, 0 for DefaultWindowSize
+	WindowSize int `json:"window_size,omitempty" msgpack:",omitempty"`
+	// ScratchCodes single use emergency codes accepted instead of a passcode
+	ScratchCodes []string `json:"scratch_codes,omitempty" msgpack:",omitempty"`
+	// RateLimit and DisallowReuse are kept for export only, otpd applies its own lockout and replay protection
+	RateLimit     *RateLimit `json:"rate_limit,omitempty" msgpack:",omitempty"`
+	DisallowReuse bool       `json:"disallow_reuse,omitempty" msgpack:",omitempty"`
+}
+
+// RateLimit at most Attempts logins every Interval seconds
+type RateLimit struct {
+	Attempts int `json:"attempts"`
+	Interval int `json:"interval"`
+}
+
+// Window the window size to validate with, nil options have the default one
+func (o *Options) Window() int {
+	switch {
+	case o == nil || o.WindowSize <= 0:
+		return DefaultWindowSize
+	case o.WindowSize > MaxWindowSize:
+		return MaxWindowSize
+	}
+	return o.WindowSize
+}
+
+// HasScratchCode whether code is one of the unused scratch codes
+func (o *Options) HasScratchCode(code string) bool {
+	if o == nil {
+		return false
+	}
+	return scratchIndex(o.ScratchCodes, code) >= 0
+}
+
+func scratchIndex(codes []string, code string) int {
+	for i, c := range codes {
+		if subtle.ConstantTimeCompare([]byte(c), []byte(code)) == 1 {
+			return i
+		}
+	}
+	return -1
+}
+
+// UseScratchCode removes the scratch code from the account, false if it was not there,
+// e.g. used by a concurrent validation. Followers can not use scratch codes, they are read-only.
+func UseScratchCode(name, code string) (bool, error) {
+	if ReadOnly() {
+		return false, ErrReadOnly
+	}
+	used := false
+	var updated *Account
+	err := accounts.Update(name, func(account *Account) error {
+		used = false
+		if account.Options == nil {
+			return store.ErrStop
+		}
+		i := scratchIndex(account.Options.ScratchCodes, code)
+		if i < 0 {
+			return store.ErrStop
+		}
+		codes := account.Options.ScratchCodes
+		account.Options.ScratchCodes = append(codes[:i:i], codes[i+1:]...)
+		used = true
+		updated = account
+		return nil
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return false, ErrNotFound
+	}
+	if err != nil || !used {
+		return false, err
+	}
+	saved := *updated
+	invalidate(name, &saved)
+	return used, nil
+}
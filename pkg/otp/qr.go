@@ -0,0 +1,82 @@
+package otp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strings"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
+)
+
+// qrQuietZone modules of blank border around the code, scanners need it to find the code
+const qrQuietZone = 2
+
+// TerminalQRCode renders content as a QR code of unicode half blocks, two modules per character
+// row. Dark modules are printed as blanks, so the code scans on terminals with a dark background.
+func TerminalQRCode(content string) (string, error) {
+	code, err := qr.Encode(content, qr.M, qr.Auto)
+	if err != nil {
+		return "", err
+	}
+	size := code.Bounds().Dx()
+	dark := func(x, y int) bool {
+		x, y = x-qrQuietZone, y-qrQuietZone
+		if x < 0 || y < 0 || x >= size || y >= size {
+			return false
+		}
+		r, _, _, _ := code.At(x, y).RGBA()
+		return r == 0
+	}
+
+	var sb strings.Builder
+	total := size + 2*qrQuietZone
+	for y := 0; y < total; y += 2 {
+		for x := 0; x < total; x++ {
+			top, bottom := dark(x, y), dark(x, y+1) || y+1 >= total
+			switch {
+			case !top && !bottom:
+				sb.WriteString("█")
+			case !top:
+				sb.WriteString("▀")
+			case !bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteByte(' ')
+			}
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String(), nil
+}
+
+// QRCodePNG renders content as a PNG QR code of at least size pixels with a blank border,
+// larger when the code has too many modules to be scaled down to size
+func QRCodePNG(content string, size int) ([]byte, error) {
+	code, err := qr.Encode(content, qr.M, qr.Auto)
+	if err != nil {
+		return nil, err
+	}
+	modules := code.Bounds().Dx() + 2*qrQuietZone
+	scale := size / modules
+	if scale < 4 {
+		scale = 4
+	}
+	scaled, err := barcode.Scale(code, code.Bounds().Dx()*scale, code.Bounds().Dy()*scale)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewGray(image.Rect(0, 0, modules*scale, modules*scale))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	offset := image.Pt(qrQuietZone*scale, qrQuietZone*scale)
+	draw.Draw(img, scaled.Bounds().Add(offset), scaled, image.Point{}, draw.Src)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
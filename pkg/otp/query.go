@@ -0,0 +1,143 @@
+package otp
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/shumin1027/otpd/pkg/store"
+)
+
+// Account indexes
+const (
+	IndexDisabled = "disabled"
+	IndexGroup    = "group"
+	IndexLastUsed = "last_used"
+)
+
+func addIndexes() error {
+	if err := accounts.Index(IndexDisabled, 1, func(_ string, a *Account) [][]byte {
+		if a.Disabled {
+			return [][]byte{{'1'}}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := accounts.Index(IndexGroup, 1, func(_ string, a *Account) [][]byte {
+		values := make([][]byte, 0, len(a.Groups))
+		for _, g := range a.Groups {
+			values = append(values, []byte(g))
+		}
+		return values
+	}); err != nil {
+		return err
+	}
+	// 从未使用的账户为0，排在最前面
+	return accounts.Index(IndexLastUsed, 1, func(_ string, a *Account) [][]byte {
+		return [][]byte{unixKey(a.LastUsedAt)}
+	})
+}
+
+// unixKey big endian unix seconds, sorts by time
+func unixKey(t time.Time) []byte {
+	buf := make([]byte, 8)
+	if !t.IsZero() && t.Unix() > 0 {
+		binary.BigEndian.PutUint64(buf, uint64(t.Unix()))
+	}
+	return buf
+}
+
+// ErrInvalidCursor returned by List for a cursor it did not return
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Filter selects accounts, zero fields match all accounts
+type Filter struct {
+	Disabled *bool
+	Group    string
+	// UnusedSince accounts not validated since this time, including never used ones
+	UnusedSince time.Time
+	// Limit max accounts returned, default 100
+	Limit int
+	// Cursor next page, returned by the previous List with the same filter
+	Cursor string
+}
+
+func (f *Filter) match(a *Account) bool {
+	if f.Disabled != nil && a.Disabled != *f.Disabled {
+		return false
+	}
+	if f.Group != "" && !a.InGroup(f.Group) {
+		return false
+	}
+	if !f.UnusedSince.IsZero() && !a.LastUsedAt.Before(f.UnusedSince) {
+		return false
+	}
+	return true
+}
+
+// List returns a page of the accounts matching the filter, using an index when one applies.
+// Entries are scanned until the page is full, next is the cursor of the following page,
+// empty when there are no more accounts. A page may be followed by an empty one.
+func List(f Filter) (list []*Account, next string, err error) {
+	if f.Limit <= 0 {
+		f.Limit = 100
+	}
+
+	cursor := f.Cursor
+	for {
+		var entries []store.Entry[Account]
+		entries, next, err = f.page(cursor, f.Limit-len(list))
+		if err != nil {
+			return nil, "", err
+		}
+		for _, e := range entries {
+			if f.match(e.Value) {
+				list = append(list, e.Value)
+			}
+		}
+		// 过滤掉的账户不计入，继续扫描直到填满一页
+		if next == "" || len(list) == f.Limit {
+			return list, next, nil
+		}
+		cursor = next
+	}
+}
+
+// page scans up to limit entries from cursor, with the index the filter uses if any
+func (f *Filter) page(cursor string, limit int) ([]store.Entry[Account], string, error) {
+	var name string
+	var start, end []byte
+	var value func(a *Account) []byte
+	switch {
+	case f.Group != "":
+		name, value = IndexGroup, func(*Account) []byte { return []byte(f.Group) }
+		start, end = store.Exact([]byte(f.Group))
+	case f.Disabled != nil && *f.Disabled:
+		name, value = IndexDisabled, func(*Account) []byte { return []byte{'1'} }
+		start, end = store.Exact([]byte{'1'})
+	case !f.UnusedSince.IsZero():
+		name, value = IndexLastUsed, func(a *Account) []byte { return unixKey(a.LastUsedAt) }
+		end = unixKey(f.UnusedSince)
+	default:
+		// 没有可用的索引，按key分页扫描
+		return accounts.List(cursor, limit)
+	}
+
+	// 索引的cursor是下一页在索引中的起点，hex编码
+	if cursor != "" {
+		var err error
+		if start, err = hex.DecodeString(cursor); err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+	entries, err := accounts.Query(name, start, end, limit)
+	if err != nil || len(entries) == 0 {
+		return nil, "", err
+	}
+	last := entries[len(entries)-1]
+	// 紧接在最后一条索引之后
+	after := append(store.IndexKey(value(last.Value), []byte(last.Key)), 0)
+	return entries, hex.EncodeToString(after), nil
+}
@@ -0,0 +1,72 @@
+package otp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ReportUnusedDays thresholds of Report.UnusedDays
+var ReportUnusedDays = []int{30, 90, 365}
+
+// Report statistics of the stored accounts
+type Report struct {
+	Total     int `json:"total"`
+	Disabled  int `json:"disabled"`
+	NeverUsed int `json:"never_used"`
+	// UnusedDays accounts not validated in at least this many days, including never used ones
+	UnusedDays map[int]int `json:"unused_days"`
+	// Groups accounts per group
+	Groups map[string]int `json:"groups"`
+	// Versions stored records per schema version, records below SchemaVersion can be migrated
+	Versions    map[int]int `json:"versions"`
+	GeneratedAt time.Time   `json:"generated_at"`
+}
+
+// Each calls fn for every account, one at a time and in no particular order, until ctx is done.
+// A slow fn slows down the iteration, returning an error stops it, store.ErrStop without error.
+func Each(ctx context.Context, fn func(*Account) error) error {
+	var mu sync.Mutex
+	return accounts.Stream(ctx, func(_ string, account *Account) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return fn(account)
+	})
+}
+
+// BuildReport reads all accounts and summarizes them
+func BuildReport(ctx context.Context) (*Report, error) {
+	now := time.Now()
+	report := &Report{
+		UnusedDays:  make(map[int]int, len(ReportUnusedDays)),
+		Groups:      make(map[string]int),
+		Versions:    make(map[int]int),
+		GeneratedAt: now.UTC(),
+	}
+	for _, days := range ReportUnusedDays {
+		report.UnusedDays[days] = 0
+	}
+	err := Each(ctx, func(account *Account) error {
+		report.Total++
+		if account.Disabled {
+			report.Disabled++
+		}
+		if account.LastUsedAt.IsZero() {
+			report.NeverUsed++
+		}
+		for _, days := range ReportUnusedDays {
+			if account.LastUsedAt.Before(now.AddDate(0, 0, -days)) {
+				report.UnusedDays[days]++
+			}
+		}
+		for _, g := range account.Groups {
+			report.Groups[g]++
+		}
+		report.Versions[account.version]++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
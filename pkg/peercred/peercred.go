@@ -0,0 +1,162 @@
+package peercred
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/shumin1027/otpd/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// ErrUnsupported peer credentials are not available on this platform
+var ErrUnsupported = errors.New("peer credentials not supported on this platform")
+
+// Cred identity of the process on the other end of a unix socket
+type Cred struct {
+	PID int32  `json:"pid"`
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+}
+
+// Conn a unix socket connection carrying the peer credentials read at accept time
+type Conn struct {
+	net.Conn
+	Cred *Cred
+}
+
+// FromConn returns the peer credentials of a connection accepted by Listener
+func FromConn(conn net.Conn) (*Cred, bool) {
+	if c, ok := conn.(*Conn); ok && c.Cred != nil {
+		return c.Cred, true
+	}
+	return nil, false
+}
+
+// Config unix socket listener config
+type Config struct {
+	// Path socket file path
+	Path string
+	// Mode socket file mode, e.g: 0660, empty keeps 0600
+	Mode os.FileMode
+	// Owner socket file owner, user name or uid, empty keeps the current user
+	Owner string
+	// Group socket file group, group name or gid, empty keeps the current group
+	Group string
+}
+
+// Listener unix socket listener attaching peer credentials to accepted connections
+type Listener struct {
+	*net.UnixListener
+}
+
+// Listen creates the unix socket, removes a stale socket file left by a previous run
+func Listen(cfg Config) (*Listener, error) {
+	if fi, err := os.Lstat(cfg.Path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", cfg.Path)
+		}
+		if err := removeStale(cfg.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	// socket以0600创建，chmod之前其他用户不能连接
+	restore := umask(0177)
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: cfg.Path, Net: "unix"})
+	restore()
+	if err != nil {
+		return nil, err
+	}
+	if err := chmod(cfg); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &Listener{ln}, nil
+}
+
+// removeStale 只删除无人监听的socket，不影响正在运行的实例
+func removeStale(path string) error {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by a running process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return errors.Wrap(err, "check stale socket")
+	}
+	return errors.Wrap(os.Remove(path), "remove stale socket")
+}
+
+func chmod(cfg Config) error {
+	if cfg.Mode != 0 {
+		if err := os.Chmod(cfg.Path, cfg.Mode); err != nil {
+			return errors.Wrap(err, "chmod socket")
+		}
+	}
+	if cfg.Owner == "" && cfg.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if cfg.Owner != "" {
+		id, err := lookupUser(cfg.Owner)
+		if err != nil {
+			return err
+		}
+		uid = id
+	}
+	if cfg.Group != "" {
+		id, err := lookupGroup(cfg.Group)
+		if err != nil {
+			return err
+		}
+		gid = id
+	}
+	return errors.Wrap(os.Chown(cfg.Path, uid, gid), "chown socket")
+}
+
+func lookupUser(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+func lookupGroup(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// Accept waits for the next connection and reads its peer credentials,
+// connections whose credentials can not be read are closed and skipped
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.UnixListener.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+		cred, err := readCred(conn)
+		if err != nil && err != ErrUnsupported {
+			// 返回错误会使服务停止，只关闭这个连接
+			log.L().Warn("read peer credentials", zap.Error(err))
+			conn.Close()
+			continue
+		}
+		return &Conn{Conn: conn, Cred: cred}, nil
+	}
+}
@@ -0,0 +1,36 @@
+//go:build linux
+// +build linux
+
+package peercred
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// readCred reads SO_PEERCRED of the connection
+func readCred(conn *net.UnixConn) (*Cred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *unix.Ucred
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, serr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	return &Cred{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}, nil
+}
+
+// umask sets the process umask and returns a func restoring the previous one
+func umask(mask int) func() {
+	old := unix.Umask(mask)
+	return func() { unix.Umask(old) }
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package peercred
+
+import "net"
+
+func readCred(conn *net.UnixConn) (*Cred, error) {
+	return nil, ErrUnsupported
+}
+
+func umask(mask int) func() {
+	return func() {}
+}
@@ -0,0 +1,71 @@
+//go:build linux
+// +build linux
+
+package peercred
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "otpd.sock")
+	ln, err := Listen(Config{Path: path, Mode: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected socket file %v, %v", fi, err)
+	}
+
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cred, ok := FromConn(conn)
+	if !ok || cred.UID != uint32(os.Getuid()) || cred.PID != int32(os.Getpid()) {
+		t.Errorf("unexpected credentials %+v", cred)
+	}
+
+	// 正在使用的socket不能被删除
+	if _, err := Listen(Config{Path: path}); err == nil {
+		t.Error("expected an error for a socket in use")
+	}
+}
+
+func TestStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "otpd.sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 模拟异常退出留下的socket文件
+	ln.SetUnlinkOnClose(false)
+	ln.Close()
+
+	stale, err := Listen(Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 未设置mode时不受umask影响，只有当前用户可以连接
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("unexpected socket file %v, %v", fi, err)
+	}
+	stale.Close()
+
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen(Config{Path: path}); err == nil {
+		t.Error("expected an error for a regular file")
+	}
+}
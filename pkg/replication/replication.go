@@ -0,0 +1,286 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shumin1027/otpd/pkg/client"
+	"github.com/shumin1027/otpd/pkg/otp"
+	"github.com/shumin1027/otpd/pkg/store"
+	"go.uber.org/zap"
+)
+
+// Roles of an otpd instance
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+)
+
+// stateBucket 本地的复制进度，Apply时跳过，不会被复制到其他节点
+const stateBucket = "\x00replication"
+
+// header see http.HeaderBackupVersion
+const headerBackupVersion = "X-Backup-Version"
+
+// ErrNotFollower returned by Promote on a leader
+var ErrNotFollower = errors.New("not a follower")
+
+// Config follower settings
+type Config struct {
+	// Leader url of the leader, e.g: https://otpd-1:18181 or unix:///run/otpd.sock
+	Leader string
+	// Interval how often changes are pulled from the leader
+	Interval time.Duration
+}
+
+// Status replication state of this instance
+type Status struct {
+	Role     string    `json:"role"`
+	Leader   string    `json:"leader,omitempty"`
+	Since    uint64    `json:"since"`
+	LastSync time.Time `json:"last_sync"`
+	// Applied entries applied since start
+	Applied int64  `json:"applied"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Follower pulls incremental backups from the leader and applies them locally,
+// validations are served locally and their state changes forwarded to the leader
+type Follower struct {
+	cfg     Config
+	client  *client.Client
+	applier store.Applier
+	state   store.Bucket
+	logger  *zap.Logger
+
+	mu     sync.Mutex
+	status Status
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+var (
+	mu      sync.Mutex
+	current *Follower
+)
+
+// NewFollower creates a follower of the leader at cfg.Leader, call Start to run it
+func NewFollower(cfg Config, s store.Store, c *client.Client, logger *zap.Logger) (*Follower, error) {
+	applier, ok := s.(store.Applier)
+	if !ok {
+		return nil, fmt.Errorf("storage driver %s does not support replication", s.Driver())
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	f := &Follower{
+		cfg:     cfg,
+		client:  c,
+		applier: applier,
+		state:   s.Bucket(stateBucket),
+		logger:  logger.With(zap.String("mod", "replication")),
+		status:  Status{Role: RoleFollower, Leader: cfg.Leader},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	// 同一个leader从上次的进度继续，换了leader则全量同步
+	if leader, err := f.state.Get([]byte("leader")); err == nil && string(leader) == cfg.Leader {
+		if v, err := f.state.Get([]byte("since")); err == nil {
+			f.status.Since, _ = strconv.ParseUint(string(v), 10, 64)
+		}
+	}
+	return f, nil
+}
+
+// Start makes the local accounts read-only and runs the pull loop in a goroutine
+func (f *Follower) Start() {
+	mu.Lock()
+	current = f
+	mu.Unlock()
+	otp.SetReadOnly(true)
+	otp.SetRecorder(f.Record)
+	go f.run()
+}
+
+func (f *Follower) run() {
+	defer close(f.done)
+	f.logger.Info("following leader", zap.String("leader", f.cfg.Leader), zap.Uint64("since", f.since()))
+	ticker := time.NewTicker(f.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		f.pull()
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (f *Follower) since() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status.Since
+}
+
+// pull applies the changes committed on the leader since the last pull
+func (f *Follower) pull() {
+	since := f.since()
+	n, version, err := f.sync(since)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err != nil {
+		if f.status.Error == "" {
+			f.logger.Error("pull from leader failed", zap.String("leader", f.cfg.Leader), zap.Error(err))
+		}
+		f.status.Error = err.Error()
+		return
+	}
+	if f.status.Error != "" {
+		f.logger.Info("pull from leader recovered", zap.String("leader", f.cfg.Leader))
+	}
+	f.status.Error = ""
+	f.status.Since = version
+	f.status.LastSync = time.Now()
+	f.status.Applied += int64(n)
+	if n > 0 {
+		f.logger.Debug("changes applied", zap.Int("entries", n), zap.Uint64("since", since), zap.Uint64("version", version))
+	}
+}
+
+func (f *Follower) sync(since uint64) (int, uint64, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Stop时取消正在进行的请求
+	go func() {
+		select {
+		case <-f.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	query := url.Values{"since": []string{strconv.FormatUint(since, 10)}}
+	resp, err := f.client.Do(ctx, http.MethodPost, "/admin/backup", query, nil)
+	if err != nil {
+		return 0, since, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return 0, since, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	version, err := strconv.ParseUint(resp.Header.Get(headerBackupVersion), 10, 64)
+	if err != nil {
+		return 0, since, errors.Wrap(err, "invalid backup version header")
+	}
+	n, err := f.applier.Apply(resp.Body, []byte(stateBucket+":"))
+	if err != nil {
+		return n, since, errors.Wrap(err, "apply changes")
+	}
+	if version != since {
+		if err := f.state.Set([]byte("leader"), []byte(f.cfg.Leader)); err != nil {
+			return n, since, err
+		}
+		if err := f.state.Set([]byte("since"), []byte(strconv.FormatUint(version, 10))); err != nil {
+			return n, since, err
+		}
+	}
+	return n, version, nil
+}
+
+// Record forwards a validation to the leader, which applies replay protection
+// and lockout for the whole cluster. When the leader is unreachable the
+// validation fails with otp.ResultError, replay protection can't be checked.
+func (f *Follower) Record(name, passcode string, ok bool) (otp.Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var out RecordResult
+	err := f.client.Call(ctx, http.MethodPost, "/admin/replication/record", nil, RecordRequest{name, passcode, ok}, &out)
+	if err != nil {
+		return otp.ResultError, errors.Wrap(err, "forward validation to leader")
+	}
+	return out.Result, nil
+}
+
+// RecordRequest a validation forwarded by a follower
+type RecordRequest struct {
+	Name     string `json:"name"`
+	Passcode string `json:"passcode"`
+	OK       bool   `json:"ok"`
+}
+
+// RecordResult the result of a forwarded validation
+type RecordResult struct {
+	Result otp.Result `json:"result"`
+}
+
+// Stop stops pulling and waits for a running pull to finish or ctx to expire
+func (f *Follower) Stop(ctx context.Context) error {
+	f.once.Do(func() {
+		close(f.stop)
+	})
+	select {
+	case <-f.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Status returns the replication state
+func (f *Follower) Status() Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status
+}
+
+// Current returns the replication state of this instance
+func Current() Status {
+	mu.Lock()
+	f := current
+	mu.Unlock()
+	if f == nil {
+		return Status{Role: RoleLeader}
+	}
+	return f.Status()
+}
+
+// IsFollower whether this instance follows a leader
+func IsFollower() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return current != nil
+}
+
+// Promote stops following the leader and makes this instance writable.
+// The old leader must be stopped or turned into a follower of this instance first.
+func Promote(ctx context.Context) error {
+	mu.Lock()
+	f := current
+	mu.Unlock()
+	if f == nil {
+		return ErrNotFollower
+	}
+	if err := f.Stop(ctx); err != nil {
+		return err
+	}
+	otp.SetRecorder(otp.Record)
+	otp.SetReadOnly(false)
+	mu.Lock()
+	current = nil
+	mu.Unlock()
+	f.logger.Info("promoted to leader", zap.String("old_leader", f.cfg.Leader), zap.Uint64("since", f.since()))
+	return nil
+}
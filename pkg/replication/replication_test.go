@@ -0,0 +1,80 @@
+package replication
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/shumin1027/otpd/pkg/badger"
+	"github.com/shumin1027/otpd/pkg/client"
+	"go.uber.org/zap"
+)
+
+func TestFollower(t *testing.T) {
+	leader, err := badger.Open("", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	local, err := badger.Open("", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+		// 与http.Backup一致：先确定version再写出内容
+		var buf bytes.Buffer
+		version, err := leader.Backup(&buf, since)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(headerBackupVersion, strconv.FormatUint(version, 10))
+		w.Write(buf.Bytes())
+	}))
+	defer srv.Close()
+
+	c, err := client.New(client.Config{URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFollower(Config{Leader: srv.URL}, local, c, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accounts := leader.Bucket("otp")
+	accounts.Set([]byte("alice"), []byte("1"))
+	accounts.Set([]byte("bob"), []byte("1"))
+	f.pull()
+	accounts.Set([]byte("alice"), []byte("2"))
+	accounts.Delete([]byte("bob"))
+	f.pull()
+
+	if s := f.Status(); s.Error != "" || s.Since == 0 {
+		t.Fatalf("unexpected status: %+v", s)
+	}
+	if v, err := local.Bucket("otp").Get([]byte("alice")); err != nil || string(v) != "2" {
+		t.Fatalf("alice not replicated: %q, %v", v, err)
+	}
+	if local.Bucket("otp").Has([]byte("bob")) {
+		t.Fatal("delete not replicated")
+	}
+
+	// 没有新的变更时不会重复拉取上次的最后一个版本
+	applied := f.Status().Applied
+	f.pull()
+	if s := f.Status(); s.Applied != applied {
+		t.Fatalf("entries pulled twice: %d != %d", s.Applied, applied)
+	}
+
+	// 重启后从保存的进度继续
+	f2, _ := NewFollower(Config{Leader: srv.URL}, local, c, zap.NewNop())
+	if f2.since() != f.since() {
+		t.Fatalf("progress not restored: %d != %d", f2.since(), f.since())
+	}
+}
@@ -0,0 +1,163 @@
+package schema
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/shumin1027/otpd/pkg/store"
+)
+
+// marker first byte of a versioned record, 0xc1 is never used by msgpack,
+// so unversioned records written before the envelope existed are read as version 0.
+const marker = 0xc1
+
+// Bucket and key holding the schema version of the database
+const (
+	MetaBucket = "meta"
+	VersionKey = "schema_version"
+)
+
+// ErrTooNew returned when the database or a record was written by a newer otpd
+var ErrTooNew = errors.New("schema version is newer than supported, upgrade otpd")
+
+// Encode wraps payload in a version envelope
+func Encode(version int, payload []byte) []byte {
+	buf := make([]byte, 1+binary.MaxVarintLen64+len(payload))
+	buf[0] = marker
+	n := 1 + binary.PutUvarint(buf[1:], uint64(version))
+	return append(buf[:n], payload...)
+}
+
+// Decode returns the version and payload of a record, records without envelope are version 0
+func Decode(data []byte) (int, []byte, error) {
+	if len(data) == 0 || data[0] != marker {
+		return 0, data, nil
+	}
+	v, n := binary.Uvarint(data[1:])
+	if n <= 0 {
+		return 0, nil, errors.New("corrupted record version")
+	}
+	return int(v), data[1+n:], nil
+}
+
+// Migration upgrades a payload from one version to the next
+type Migration func(payload []byte) ([]byte, error)
+
+// Schema the migrations of one kind of record
+type Schema struct {
+	Name       string
+	migrations []Migration
+}
+
+func New(name string) *Schema {
+	return &Schema{Name: name}
+}
+
+// Register adds the migration from version from to from+1, migrations must be registered in order
+func (s *Schema) Register(from int, fn Migration) {
+	if from != len(s.migrations) {
+		panic(fmt.Sprintf("schema %s: migration from version %d registered out of order", s.Name, from))
+	}
+	s.migrations = append(s.migrations, fn)
+}
+
+// Version the current record version
+func (s *Schema) Version() int {
+	return len(s.migrations)
+}
+
+// Marshal wraps a payload in the current version envelope
+func (s *Schema) Marshal(payload []byte) []byte {
+	return Encode(s.Version(), payload)
+}
+
+// Unmarshal returns the payload upgraded to the current version and the version it was stored with
+func (s *Schema) Unmarshal(data []byte) ([]byte, int, error) {
+	version, payload, err := Decode(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version > s.Version() {
+		return nil, version, errors.Wrapf(ErrTooNew, "%s record version %d", s.Name, version)
+	}
+	for v := version; v < s.Version(); v++ {
+		payload, err = s.migrations[v](payload)
+		if err != nil {
+			return nil, version, errors.Wrapf(err, "migrate %s record from version %d", s.Name, v)
+		}
+	}
+	return payload, version, nil
+}
+
+// StoredVersion returns the schema version saved in the database, 0 if never saved
+func StoredVersion(s store.Store) (int, error) {
+	val, err := s.Bucket(MetaBucket).Get([]byte(VersionKey))
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(val))
+}
+
+// SetVersion saves the schema version in the database
+func SetVersion(s store.Store, version int) error {
+	return s.Bucket(MetaBucket).Set([]byte(VersionKey), []byte(strconv.Itoa(version)))
+}
+
+// Check refuses a database written by a newer otpd. The version is not recorded here:
+// a database with older records gets the current version once migrated.
+func Check(s store.Store, current int) error {
+	stored, err := StoredVersion(s)
+	if err != nil {
+		return errors.Wrap(err, "read schema version")
+	}
+	if stored > current {
+		return errors.Wrapf(ErrTooNew, "database schema version %d, supported %d", stored, current)
+	}
+	return nil
+}
+
+// Versioned implemented by values that want to know the version they were stored with
+type Versioned interface {
+	SetSchemaVersion(version int)
+}
+
+// Codec returns a codec wrapping inner in the version envelope, upgrading values on read
+func (s *Schema) Codec(inner store.Codec) store.Codec {
+	return &codec{schema: s, inner: inner}
+}
+
+type codec struct {
+	schema *Schema
+	inner  store.Codec
+}
+
+func (c *codec) Name() string {
+	return c.inner.Name()
+}
+
+func (c *codec) Marshal(v interface{}) ([]byte, error) {
+	payload, err := c.inner.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.schema.Marshal(payload), nil
+}
+
+func (c *codec) Unmarshal(data []byte, v interface{}) error {
+	payload, version, err := c.schema.Unmarshal(data)
+	if err != nil {
+		return err
+	}
+	if err := c.inner.Unmarshal(payload, v); err != nil {
+		return err
+	}
+	if vv, ok := v.(Versioned); ok {
+		vv.SetSchemaVersion(version)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package schema
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/shumin1027/otpd/pkg/memory"
+)
+
+func TestUnmarshal(t *testing.T) {
+	s := New("test")
+	s.Register(0, func(p []byte) ([]byte, error) { return append(p, '1'), nil })
+	s.Register(1, func(p []byte) ([]byte, error) { return append(p, '2'), nil })
+
+	cases := []struct {
+		data    []byte
+		version int
+		want    string
+	}{
+		{[]byte("v"), 0, "v12"},
+		{Encode(1, []byte("v")), 1, "v2"},
+		{s.Marshal([]byte("v")), 2, "v"},
+	}
+	for _, c := range cases {
+		got, version, err := s.Unmarshal(c.data)
+		if err != nil || version != c.version || string(got) != c.want {
+			t.Errorf("got %q, %d, %v, want %q, %d", got, version, err, c.want, c.version)
+		}
+	}
+	if _, _, err := s.Unmarshal(Encode(3, nil)); !errors.Is(err, ErrTooNew) {
+		t.Errorf("expected ErrTooNew, got %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	st := memory.Open()
+	if err := Check(st, 2); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := StoredVersion(st); v != 0 {
+		t.Fatalf("check must not record the version, stored %d", v)
+	}
+	if err := SetVersion(st, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(st, 1); !errors.Is(err, ErrTooNew) {
+		t.Fatalf("expected ErrTooNew, got %v", err)
+	}
+}
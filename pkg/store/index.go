@@ -0,0 +1,54 @@
+package store
+
+// Index a secondary index over the entries of a bucket
+type Index struct {
+	Name string
+	// Version bump it when Values changes, the index is rebuilt from the entries
+	Version int
+	// Values returns the index values of an entry, nil if the entry is not indexed.
+	// 0x00 separates the value from the key in the index, variable length values must not contain it.
+	Values func(k, v []byte) [][]byte
+}
+
+// Indexer implemented by buckets maintaining secondary indexes in the same
+// transaction as the entries they index
+type Indexer interface {
+	// AddIndex declares an index, it is built from the existing entries when new or its version changed
+	AddIndex(idx Index) error
+	// IndexScan calls fn with the key of every entry having an index value in [start, end)
+	// in index order until fn returns false, nil end means no upper bound.
+	// An entry with several matching values is passed once per value.
+	IndexScan(name string, start, end []byte, fn func(k []byte) bool) error
+}
+
+// indexSep separates the index value from the entry key
+const indexSep = 0x00
+
+// IndexKey the sort key of an entry in an index, value 0x00 key
+func IndexKey(value, k []byte) []byte {
+	buf := make([]byte, 0, len(value)+1+len(k))
+	buf = append(buf, value...)
+	buf = append(buf, indexSep)
+	return append(buf, k...)
+}
+
+// Exact returns the range of an index matching value exactly
+func Exact(value []byte) (start, end []byte) {
+	start = append(append([]byte(nil), value...), indexSep)
+	end = append(append([]byte(nil), value...), indexSep+1)
+	return start, end
+}
+
+// Prefix returns the range of an index matching values starting with prefix
+func Prefix(prefix []byte) (start, end []byte) {
+	start = append([]byte(nil), prefix...)
+	end = append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return start, end[:i+1]
+		}
+	}
+	// prefix全是0xff或为空，没有上界
+	return start, nil
+}
@@ -0,0 +1,127 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// Storage drivers
+const (
+	DriverBadger = "badger"
+	DriverBolt   = "bolt"
+	DriverMemory = "memory"
+)
+
+var (
+	// ErrNotFound returned by Bucket.Get when the key does not exist
+	ErrNotFound = errors.New("key not found")
+	// ErrConflict returned by Txn when the transaction kept conflicting with concurrent writes
+	ErrConflict = errors.New("transaction conflict")
+	// ErrTxnTooBig returned by Txn when the writes exceed the transaction size limit of the store
+	ErrTxnTooBig = errors.New("transaction too big")
+)
+
+// Store a key value storage backend holding named buckets
+type Store interface {
+	// Bucket returns the bucket with the given name, created on first write
+	Bucket(name string) Bucket
+	// Driver name of the storage driver
+	Driver() string
+	// Dir data directory on disk, empty for in-memory stores
+	Dir() string
+	// Probe writes and reads back a short lived key to check the store is usable
+	Probe() error
+	// Close flushes pending writes and releases the underlying files
+	Close() error
+}
+
+// Bucket a namespace of keys inside a Store
+type Bucket interface {
+	Set(k, v []byte) error
+	// SetWithTTL sets a key expiring at the given unix time
+	SetWithTTL(k, v []byte, expireAt int64) error
+	// Get returns ErrNotFound if the key does not exist
+	Get(k []byte) ([]byte, error)
+	Has(k []byte) bool
+	Delete(k []byte) error
+	// Iter calls fn for every key and value, returns the number of calls without error
+	Iter(fn func(k, v []byte) error) int64
+	// IterKeys calls fn for every key, returns the number of calls without error
+	IterKeys(fn func(k []byte) error) int64
+	// Scan calls fn for every key from start in key order, until fn returns false
+	Scan(start []byte, fn func(k, v []byte) bool) error
+	// Update reads and rewrites a key in one transaction, ok is false if the key does not exist.
+	// The key keeps its expiry, nothing is written if fn returns an error.
+	Update(k []byte, fn func(v []byte, ok bool) ([]byte, error)) error
+}
+
+// Tx a read-write transaction across the buckets of a Store
+type Tx interface {
+	Bucket(name string) TxBucket
+}
+
+// TxBucket the keys of a bucket inside a transaction, reads see the writes of the transaction
+type TxBucket interface {
+	// Get returns ErrNotFound if the key does not exist
+	Get(k []byte) ([]byte, error)
+	Has(k []byte) bool
+	Set(k, v []byte) error
+	SetWithTTL(k, v []byte, expireAt int64) error
+	Delete(k []byte) error
+}
+
+// Transactional implemented by stores able to commit writes to several keys and buckets atomically
+type Transactional interface {
+	// Txn runs fn in a read-write transaction and commits its writes atomically,
+	// nothing is written if fn returns an error, which is returned as is.
+	// fn is run again when the transaction conflicts with a concurrent write,
+	// it must not have other side effects.
+	Txn(fn func(tx Tx) error) error
+}
+
+// KV a key and its value read from a bucket
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
+// Streamer implemented by buckets able to read all keys concurrently, in no particular order
+type Streamer interface {
+	// Stream calls fn for every key and value from several goroutines until ctx is done.
+	// The first error returned by fn stops the stream and is returned, except ErrStop.
+	// Returns the number of calls without error.
+	Stream(ctx context.Context, fn func(k, v []byte) error) (int64, error)
+	// Chan sends every key and value to ch, blocking while ch is full, until ctx is done.
+	// ch is not closed. Returns the number of entries sent.
+	Chan(ctx context.Context, ch chan<- KV) (int64, error)
+}
+
+// Sizer implemented by stores able to report their on-disk size
+type Sizer interface {
+	Size() (int64, int64)
+}
+
+// Backuper implemented by stores supporting online, incremental backups
+type Backuper interface {
+	// Backup writes all entries with a version greater than since to w,
+	// returns the since to pass for the next incremental backup
+	Backup(w io.Writer, since uint64) (uint64, error)
+	// Load restores entries written by Backup
+	Load(r io.Reader) error
+}
+
+// Applier implemented by stores able to replay the output of Backup from another store
+type Applier interface {
+	// Apply writes the entries of a Backup stream as regular local writes,
+	// keys starting with skip are ignored
+	Apply(r io.Reader, skip []byte) (int, error)
+}
+
+// Maintainer implemented by stores needing periodic maintenance
+type Maintainer interface {
+	// RunGC reclaims space of the value log, returns the number of rewritten files
+	RunGC(discardRatio float64) (int, error)
+	// Flatten compacts all tables into one level
+	Flatten(workers int) error
+}
@@ -0,0 +1,263 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrStop returned by a callback to stop without error: TypedBucket.Update leaves the value unchanged, Stream ends early
+var ErrStop = errors.New("stop update")
+
+// TypedBucket a Bucket storing values of type T encoded by a Codec
+type TypedBucket[T any] struct {
+	bucket  Bucket
+	codec   Codec
+	indexes map[string]IndexFunc[T]
+}
+
+// IndexFunc returns the index values of an entry, see Index.Values
+type IndexFunc[T any] func(key string, v *T) [][]byte
+
+// NewTypedBucket wraps a Bucket, values are encoded with codec
+func NewTypedBucket[T any](b Bucket, codec Codec) *TypedBucket[T] {
+	return &TypedBucket[T]{bucket: b, codec: codec, indexes: make(map[string]IndexFunc[T])}
+}
+
+// Bucket returns the underlying raw bucket
+func (b *TypedBucket[T]) Bucket() Bucket {
+	return b.bucket
+}
+
+// Decode decodes a raw value of the bucket
+func (b *TypedBucket[T]) Decode(data []byte) (*T, error) {
+	v := new(T)
+	if err := b.codec.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Encode encodes a value as stored in the bucket, e.g. to write it in a Txn
+func (b *TypedBucket[T]) Encode(v *T) ([]byte, error) {
+	return b.codec.Marshal(v)
+}
+
+// Get returns ErrNotFound if the key does not exist
+func (b *TypedBucket[T]) Get(key string) (*T, error) {
+	data, err := b.bucket.Get([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	return b.Decode(data)
+}
+
+func (b *TypedBucket[T]) Put(key string, v *T) error {
+	data, err := b.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.bucket.Set([]byte(key), data)
+}
+
+func (b *TypedBucket[T]) Delete(key string) error {
+	return b.bucket.Delete([]byte(key))
+}
+
+// Entry a key and its decoded value
+type Entry[T any] struct {
+	Key   string
+	Value *T
+}
+
+// List returns up to limit entries in key order starting at cursor,
+// next is the cursor of the following page, empty when there are no more entries
+func (b *TypedBucket[T]) List(cursor string, limit int) ([]Entry[T], string, error) {
+	var entries []Entry[T]
+	var next string
+	var derr error
+	err := b.bucket.Scan([]byte(cursor), func(k, data []byte) bool {
+		if limit > 0 && len(entries) == limit {
+			next = string(k)
+			return false
+		}
+		v, err := b.Decode(data)
+		if err != nil {
+			derr = err
+			return false
+		}
+		entries = append(entries, Entry[T]{Key: string(k), Value: v})
+		return true
+	})
+	if err == nil {
+		err = derr
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return entries, next, nil
+}
+
+// Stream calls fn for every entry until ctx is done, fn returning ErrStop ends the stream without error.
+// On a Streamer fn is called concurrently in no particular order, other buckets are scanned in key order.
+func (b *TypedBucket[T]) Stream(ctx context.Context, fn func(key string, v *T) error) error {
+	decode := func(k, data []byte) error {
+		v, err := b.Decode(data)
+		if err != nil {
+			return fmt.Errorf("decode %s: %w", k, err)
+		}
+		return fn(string(k), v)
+	}
+	if s, ok := b.bucket.(Streamer); ok {
+		_, err := s.Stream(ctx, decode)
+		return err
+	}
+
+	var ferr error
+	err := b.bucket.Scan(nil, func(k, data []byte) bool {
+		if ferr = ctx.Err(); ferr != nil {
+			return false
+		}
+		ferr = decode(k, data)
+		return ferr == nil
+	})
+	if err == nil {
+		err = ferr
+	}
+	if err == ErrStop {
+		return nil
+	}
+	return err
+}
+
+// Update reads, modifies and writes back a key in one transaction,
+// returns ErrNotFound if the key does not exist, fn returning ErrStop leaves the value unchanged
+func (b *TypedBucket[T]) Update(key string, fn func(v *T) error) error {
+	err := b.bucket.Update([]byte(key), func(data []byte, ok bool) ([]byte, error) {
+		if !ok {
+			return nil, ErrNotFound
+		}
+		v, err := b.Decode(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(v); err != nil {
+			return nil, err
+		}
+		return b.codec.Marshal(v)
+	})
+	if err == ErrStop {
+		return nil
+	}
+	return err
+}
+
+// Index declares a secondary index, indexes must be declared before the bucket is used.
+// Buckets not implementing Indexer keep no index, Query scans them instead.
+func (b *TypedBucket[T]) Index(name string, version int, fn IndexFunc[T]) error {
+	b.indexes[name] = fn
+	ix, ok := b.bucket.(Indexer)
+	if !ok {
+		return nil
+	}
+	return ix.AddIndex(Index{
+		Name:    name,
+		Version: version,
+		Values: func(k, data []byte) [][]byte {
+			v, err := b.Decode(data)
+			if err != nil {
+				return nil
+			}
+			return fn(string(k), v)
+		},
+	})
+}
+
+// Query returns up to limit entries having an index value in [start, end) in index order,
+// use Exact and Prefix to build the range, limit <= 0 returns all entries
+func (b *TypedBucket[T]) Query(name string, start, end []byte, limit int) ([]Entry[T], error) {
+	fn, ok := b.indexes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown index %s", name)
+	}
+	ix, ok := b.bucket.(Indexer)
+	if !ok {
+		return b.scanQuery(fn, start, end, limit)
+	}
+
+	var keys []string
+	seen := make(map[string]bool)
+	err := ix.IndexScan(name, start, end, func(k []byte) bool {
+		if !seen[string(k)] {
+			seen[string(k)] = true
+			keys = append(keys, string(k))
+		}
+		return limit <= 0 || len(keys) < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry[T], 0, len(keys))
+	for _, k := range keys {
+		v, err := b.Get(k)
+		if errors.Is(err, ErrNotFound) {
+			// 扫描索引后被删除
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, Entry[T]{Key: k, Value: v})
+	}
+	return entries, nil
+}
+
+// scanQuery evaluates an index on every entry, for buckets without index support
+func (b *TypedBucket[T]) scanQuery(fn IndexFunc[T], start, end []byte, limit int) ([]Entry[T], error) {
+	type match struct {
+		sortKey []byte
+		entry   Entry[T]
+	}
+	var matches []match
+	var derr error
+	err := b.bucket.Scan(nil, func(k, data []byte) bool {
+		v, err := b.Decode(data)
+		if err != nil {
+			derr = err
+			return false
+		}
+		var sortKey []byte
+		for _, value := range fn(string(k), v) {
+			key := IndexKey(value, k)
+			if bytes.Compare(key, start) < 0 || (end != nil && bytes.Compare(key, end) >= 0) {
+				continue
+			}
+			if sortKey == nil || bytes.Compare(key, sortKey) < 0 {
+				sortKey = key
+			}
+		}
+		if sortKey != nil {
+			matches = append(matches, match{sortKey, Entry[T]{Key: string(k), Value: v}})
+		}
+		return true
+	})
+	if err == nil {
+		err = derr
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return bytes.Compare(matches[i].sortKey, matches[j].sortKey) < 0
+	})
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	entries := make([]Entry[T], len(matches))
+	for i, m := range matches {
+		entries[i] = m.entry
+	}
+	return entries, nil
+}
@@ -0,0 +1,264 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shumin1027/otpd/pkg/badger"
+	"github.com/shumin1027/otpd/pkg/bolt"
+	"github.com/shumin1027/otpd/pkg/memory"
+	"github.com/shumin1027/otpd/pkg/store"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type item struct {
+	Name  string
+	Count int
+}
+
+func openStores(t *testing.T) map[string]store.Store {
+	b, err := badger.Open("", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt, err := bolt.Open(filepath.Join(t.TempDir(), "otpd.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]store.Store{"memory": memory.Open(), "badger": b, "bolt": bt}
+	t.Cleanup(func() {
+		for _, s := range stores {
+			s.Close()
+		}
+	})
+	return stores
+}
+
+func TestTypedBucket(t *testing.T) {
+	for driver, s := range openStores(t) {
+		for _, codec := range []store.Codec{store.MsgpackCodec, store.JSONCodec} {
+			t.Run(driver+"/"+codec.Name(), func(t *testing.T) {
+				b := store.NewTypedBucket[item](s.Bucket("items-"+codec.Name()), codec)
+				if _, err := b.Get("a"); !errors.Is(err, store.ErrNotFound) {
+					t.Fatalf("expected ErrNotFound, got %v", err)
+				}
+				for i := 0; i < 5; i++ {
+					key := fmt.Sprintf("k%d", i)
+					if err := b.Put(key, &item{Name: key}); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				var keys []string
+				cursor := ""
+				for {
+					entries, next, err := b.List(cursor, 2)
+					if err != nil {
+						t.Fatal(err)
+					}
+					for _, e := range entries {
+						keys = append(keys, e.Key)
+					}
+					if next == "" {
+						break
+					}
+					cursor = next
+				}
+				if fmt.Sprint(keys) != "[k0 k1 k2 k3 k4]" {
+					t.Fatalf("unexpected keys: %v", keys)
+				}
+
+				if err := b.Update("k1", func(v *item) error { v.Count++; return nil }); err != nil {
+					t.Fatal(err)
+				}
+				if v, _ := b.Get("k1"); v.Count != 1 {
+					t.Fatalf("update not applied: %+v", v)
+				}
+				if err := b.Update("k9", func(v *item) error { return nil }); !errors.Is(err, store.ErrNotFound) {
+					t.Fatalf("expected ErrNotFound, got %v", err)
+				}
+				b.Delete("k1")
+				if _, err := b.Get("k1"); !errors.Is(err, store.ErrNotFound) {
+					t.Fatalf("expected ErrNotFound after delete, got %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	b := store.NewTypedBucket[wrapperspb.StringValue](memory.Open().Bucket("pb"), store.ProtobufCodec)
+	if err := b.Put("a", wrapperspb.String("alice")); err != nil {
+		t.Fatal(err)
+	}
+	v, err := b.Get("a")
+	if err != nil || v.GetValue() != "alice" {
+		t.Fatalf("got %v, %v", v, err)
+	}
+	if err := store.NewTypedBucket[item](memory.Open().Bucket("pb"), store.ProtobufCodec).Put("a", &item{}); err == nil {
+		t.Fatal("expected error for non proto message")
+	}
+}
+
+func TestStream(t *testing.T) {
+	for driver, s := range openStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			b := store.NewTypedBucket[item](s.Bucket("stream"), store.MsgpackCodec)
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("k%02d", i)
+				if err := b.Put(key, &item{Name: key, Count: i}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// 其他bucket的数据不应出现
+			s.Bucket("other").Set([]byte("k00"), []byte("x"))
+
+			var mu sync.Mutex
+			sum, n := 0, 0
+			err := b.Stream(context.Background(), func(key string, v *item) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if key != v.Name {
+					return fmt.Errorf("key %s holds %s", key, v.Name)
+				}
+				sum += v.Count
+				n++
+				return nil
+			})
+			if err != nil || n != 50 || sum != 49*50/2 {
+				t.Fatalf("streamed %d entries, sum %d, err %v", n, sum, err)
+			}
+
+			boom := errors.New("boom")
+			if err := b.Stream(context.Background(), func(string, *item) error { return boom }); err != boom {
+				t.Fatalf("expected fn error, got %v", err)
+			}
+			if err := b.Stream(context.Background(), func(string, *item) error { return store.ErrStop }); err != nil {
+				t.Fatalf("expected no error on ErrStop, got %v", err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if err := b.Stream(ctx, func(string, *item) error { return nil }); err != context.Canceled {
+				t.Fatalf("expected canceled, got %v", err)
+			}
+		})
+	}
+}
+
+func TestChanBackpressure(t *testing.T) {
+	s, err := badger.Open("", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	b := s.CreateBucket("chan")
+	for i := 0; i < 100; i++ {
+		b.Set([]byte(fmt.Sprintf("k%02d", i)), []byte("v"))
+	}
+
+	// 接收方只读取10条后停止，Chan不能阻塞
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan store.KV)
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.Chan(ctx, ch)
+		done <- err
+	}()
+	for i := 0; i < 10; i++ {
+		kv := <-ch
+		if string(kv.Value) != "v" {
+			t.Fatalf("unexpected value %q", kv.Value)
+		}
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("expected canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Chan blocked after the receiver stopped")
+	}
+}
+
+func TestTxn(t *testing.T) {
+	for driver, s := range openStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			ts, ok := s.(store.Transactional)
+			if !ok {
+				t.Skip("store is not transactional")
+			}
+			err := ts.Txn(func(tx store.Tx) error {
+				a, b := tx.Bucket("txn-a"), tx.Bucket("txn-b")
+				if err := a.Set([]byte("k"), []byte("1")); err != nil {
+					return err
+				}
+				if v, err := a.Get([]byte("k")); err != nil || string(v) != "1" {
+					t.Errorf("read own write: %q %v", v, err)
+				}
+				return b.SetWithTTL([]byte("k"), []byte("2"), time.Now().Add(time.Minute).Unix())
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v, err := s.Bucket("txn-b").Get([]byte("k")); err != nil || string(v) != "2" {
+				t.Fatalf("committed value: %q %v", v, err)
+			}
+
+			// fn返回错误时不写入任何数据
+			errAbort := errors.New("abort")
+			err = ts.Txn(func(tx store.Tx) error {
+				if err := tx.Bucket("txn-a").Delete([]byte("k")); err != nil {
+					return err
+				}
+				if tx.Bucket("txn-a").Has([]byte("k")) {
+					t.Error("deleted key still visible in the transaction")
+				}
+				if err := tx.Bucket("txn-b").Set([]byte("k"), []byte("3")); err != nil {
+					return err
+				}
+				return errAbort
+			})
+			if err != errAbort {
+				t.Fatalf("expected errAbort, got %v", err)
+			}
+			if !s.Bucket("txn-a").Has([]byte("k")) {
+				t.Fatal("rolled back delete was applied")
+			}
+			if v, _ := s.Bucket("txn-b").Get([]byte("k")); string(v) != "2" {
+				t.Fatalf("rolled back set was applied: %q", v)
+			}
+
+			// 并发递增，冲突的事务重试后不丢失更新
+			const n = 8
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					err := ts.Txn(func(tx store.Tx) error {
+						b := tx.Bucket("txn-counter")
+						count := 0
+						if v, err := b.Get([]byte("n")); err == nil {
+							fmt.Sscan(string(v), &count)
+						}
+						return b.Set([]byte("n"), []byte(fmt.Sprint(count+1)))
+					})
+					if err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+			if v, _ := s.Bucket("txn-counter").Get([]byte("n")); string(v) != fmt.Sprint(n) {
+				t.Fatalf("expected %d increments, got %q", n, v)
+			}
+		})
+	}
+}
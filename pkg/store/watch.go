@@ -0,0 +1,29 @@
+package store
+
+import "context"
+
+// Op the operation of a change event
+type Op string
+
+const (
+	OpPut    Op = "put"
+	OpDelete Op = "delete"
+)
+
+// Event a change of a key in a bucket
+type Event struct {
+	Op Op
+	// Key without the bucket prefix
+	Key []byte
+	// Value nil for OpDelete
+	Value []byte
+	// Version commit version of the change, increases with every commit
+	Version uint64
+}
+
+// Watcher implemented by buckets publishing their changes
+type Watcher interface {
+	// Watch calls fn for every change committed after Watch is called, in commit order.
+	// It blocks until ctx is done, the store is closed or fn returns an error, which is returned.
+	Watch(ctx context.Context, fn func(Event) error) error
+}
@@ -0,0 +1,66 @@
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// Identity maps a client certificate to a username.
+type Identity func(cert *x509.Certificate) (string, error)
+
+// NewIdentity returns an Identity reading the username from the given
+// certificate field, support cn, san-dns, san-email and san-uri.
+func NewIdentity(source string) (Identity, error) {
+	switch strings.ToLower(source) {
+	case IdentityCN, "":
+		return func(cert *x509.Certificate) (string, error) {
+			if cert.Subject.CommonName == "" {
+				return "", fmt.Errorf("client certificate has no common name")
+			}
+			return cert.Subject.CommonName, nil
+		}, nil
+	case IdentitySANDNS:
+		return func(cert *x509.Certificate) (string, error) {
+			if len(cert.DNSNames) == 0 {
+				return "", fmt.Errorf("client certificate has no dns san")
+			}
+			return cert.DNSNames[0], nil
+		}, nil
+	case IdentitySANEmail:
+		return func(cert *x509.Certificate) (string, error) {
+			if len(cert.EmailAddresses) == 0 {
+				return "", fmt.Errorf("client certificate has no email san")
+			}
+			// 保留完整地址，只取@前的部分时任意域名的root@都会映射为root
+			return cert.EmailAddresses[0], nil
+		}, nil
+	case IdentitySANURI:
+		return func(cert *x509.Certificate) (string, error) {
+			if len(cert.URIs) == 0 {
+				return "", fmt.Errorf("client certificate has no uri san")
+			}
+			// spiffe://example.org/user/alice -> alice
+			u := cert.URIs[0]
+			path := strings.TrimSuffix(u.Path, "/")
+			if i := strings.LastIndexByte(path, '/'); i >= 0 && i < len(path)-1 {
+				return path[i+1:], nil
+			}
+			if u.Opaque != "" {
+				return u.Opaque, nil
+			}
+			return u.Host, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown tls identity source: %s", source)
+}
+
+// PeerCertificate returns the verified leaf certificate of a connection,
+// nil if the client presented no certificate or it was not verified.
+func PeerCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
@@ -0,0 +1,268 @@
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Client certificate verification modes
+const (
+	ClientAuthNone             = "none"
+	ClientAuthRequest          = "request"
+	ClientAuthRequire          = "require"
+	ClientAuthVerifyIfGiven    = "verify-if-given"
+	ClientAuthRequireAndVerify = "require-and-verify"
+)
+
+// Client certificate identity sources
+const (
+	IdentityCN       = "cn"
+	IdentitySANDNS   = "san-dns"
+	IdentitySANEmail = "san-email"
+	IdentitySANURI   = "san-uri"
+)
+
+// Config TLS listener config.
+type Config struct {
+	// CertFile server certificate chain in PEM format.
+	CertFile string
+	// KeyFile server private key in PEM format.
+	KeyFile string
+	// ClientCAFile CA bundle used to verify client certificates, empty disables mutual TLS.
+	ClientCAFile string
+	// ClientAuth client certificate policy, support none, request, require, verify-if-given and require-and-verify.
+	// Default to require-and-verify when ClientCAFile is set, otherwise none.
+	ClientAuth string
+	// ReloadInterval how often the cert, key and CA files are checked for changes, 0 disables reloading.
+	ReloadInterval time.Duration
+}
+
+// Enabled whether TLS is configured.
+func (c Config) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+func parseClientAuth(mode string, hasCA bool) (tls.ClientAuthType, error) {
+	switch strings.ToLower(mode) {
+	case "":
+		if hasCA {
+			return tls.RequireAndVerifyClientCert, nil
+		}
+		return tls.NoClientCert, nil
+	case ClientAuthNone:
+		return tls.NoClientCert, nil
+	case ClientAuthRequest:
+		return tls.RequestClientCert, nil
+	case ClientAuthRequire:
+		return tls.RequireAnyClientCert, nil
+	case ClientAuthVerifyIfGiven:
+		return tls.VerifyClientCertIfGiven, nil
+	case ClientAuthRequireAndVerify:
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("unknown tls client auth: %s", mode)
+}
+
+// Reloader keeps the certificate and client CA pool loaded from disk,
+// reloading them when the underlying files change.
+type Reloader struct {
+	// OnReload called after the files are reloaded successfully.
+	OnReload func()
+	// OnError called when reloading fails.
+	OnError func(error)
+
+	cfg        Config
+	clientAuth tls.ClientAuthType
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+	checkedAt time.Time
+}
+
+// NewReloader loads the configured files, returns error if any of them is invalid.
+func NewReloader(cfg Config) (*Reloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("tls cert and key file must both be set")
+	}
+	clientAuth, err := parseClientAuth(cfg.ClientAuth, cfg.ClientCAFile != "")
+	if err != nil {
+		return nil, err
+	}
+	if clientAuth >= tls.VerifyClientCertIfGiven && cfg.ClientCAFile == "" {
+		return nil, errors.New("tls client ca file is required to verify client certificates")
+	}
+	r := &Reloader{
+		cfg:        cfg,
+		clientAuth: clientAuth,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+	return files
+}
+
+func (r *Reloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return errors.Wrap(err, "stat tls file")
+		}
+		modTimes[f] = fi.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "load tls key pair")
+	}
+
+	var pool *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return errors.Wrap(err, "read tls client ca")
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", r.cfg.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = pool
+	r.modTimes = modTimes
+	r.checkedAt = time.Now()
+	r.mu.Unlock()
+	return nil
+}
+
+// changed 判断文件是否有修改，每个ReloadInterval最多检查一次
+func (r *Reloader) changed() bool {
+	if r.cfg.ReloadInterval <= 0 {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checkedAt) < r.cfg.ReloadInterval {
+		return false
+	}
+	r.checkedAt = time.Now()
+	for _, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			// 文件可能正在被替换，保留旧证书，下次再检查
+			return false
+		}
+		if !fi.ModTime().Equal(r.modTimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+// maybeReload reloads the files if they changed, on failure the previous
+// certificate keeps being served.
+func (r *Reloader) maybeReload() {
+	if !r.changed() {
+		return
+	}
+	if err := r.load(); err != nil {
+		if r.OnError != nil {
+			r.OnError(err)
+		}
+		return
+	}
+	if r.OnReload != nil {
+		r.OnReload()
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.maybeReload()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// ServerConfig returns a tls.Config for a listener backed by this reloader.
+func (r *Reloader) ServerConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+		ClientAuth:     r.clientAuth,
+	}
+	// 每次握手返回最新的ClientCAs
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.maybeReload()
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		c := base.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = r.clientCAs
+		return c, nil
+	}
+	return base
+}
+
+// PeerConfig returns a tls.Config dialing other nodes of a cluster: it presents
+// the reloaded certificate and verifies the peer against the client CA. The
+// peers are authenticated by the CA only, their host names are not checked,
+// so the CA must be dedicated to the cluster.
+func (r *Reloader) PeerConfig() (*tls.Config, error) {
+	if r.clientAuth != tls.RequireAndVerifyClientCert {
+		return nil, errors.New("peer connections require the require-and-verify client auth")
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			r.maybeReload()
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.cert, nil
+		},
+		// 节点地址通常是IP，由VerifyConnection按CA校验证书链
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			r.mu.RLock()
+			roots := r.clientCAs
+			r.mu.RUnlock()
+			return verifyPeer(state.PeerCertificates, roots)
+		},
+	}, nil
+}
+
+// verifyPeer verifies the certificate chain sent by a server against roots
+func verifyPeer(certs []*x509.Certificate, roots *x509.CertPool) error {
+	if len(certs) == 0 {
+		return errors.New("the peer presented no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return errors.Wrap(err, "verify peer certificate")
+}
@@ -0,0 +1,209 @@
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCert(t *testing.T, dir, cn string, modTime time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+	return certFile, keyFile
+}
+
+// writeNode 生成CA签发的节点证书，可同时用于服务端和客户端，返回证书、私钥和CA文件
+func writeNode(t *testing.T, dir string) (string, string, string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cluster ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDer)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "node.pem")
+	keyFile := filepath.Join(dir, "node-key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer}), 0600)
+	return certFile, keyFile, caFile
+}
+
+// handshake 在内存连接上完成一次握手，返回客户端和服务端的错误
+func handshake(server, client *tls.Config) (error, error) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- tls.Server(c1, server).Handshake()
+		c1.Close()
+	}()
+	err := tls.Client(c2, client).Handshake()
+	c2.Close()
+	return err, <-done
+}
+
+func TestPeerConfig(t *testing.T) {
+	certFile, keyFile, caFile := writeNode(t, t.TempDir())
+	r, err := NewReloader(Config{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientAuth: ClientAuthRequireAndVerify})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := r.PeerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cerr, serr := handshake(r.ServerConfig(), client); cerr != nil || serr != nil {
+		t.Fatalf("handshake between nodes: %v, %v", cerr, serr)
+	}
+
+	// 其它CA签发的节点双方都拒绝
+	otherCert, otherKey, otherCA := writeNode(t, t.TempDir())
+	other, err := NewReloader(Config{CertFile: otherCert, KeyFile: otherKey, ClientCAFile: otherCA, ClientAuth: ClientAuthRequireAndVerify})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherClient, _ := other.PeerConfig()
+	if cerr, _ := handshake(other.ServerConfig(), client); cerr == nil {
+		t.Error("client accepted a server of another ca")
+	}
+	if _, serr := handshake(r.ServerConfig(), otherClient); serr == nil {
+		t.Error("server accepted a client of another ca")
+	}
+
+	// 不校验客户端证书时不能用于节点间连接
+	plain, err := NewReloader(Config{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.PeerConfig(); err == nil {
+		t.Error("expected error without client verification")
+	}
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "first", time.Now().Add(-time.Minute))
+
+	r, err := NewReloader(Config{CertFile: certFile, KeyFile: keyFile, ReloadInterval: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := r.GetCertificate(nil)
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if leaf.Subject.CommonName != "first" {
+		t.Fatalf("unexpected cn: %s", leaf.Subject.CommonName)
+	}
+
+	writeCert(t, dir, "second", time.Now())
+	cert, _ = r.GetCertificate(nil)
+	leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	if leaf.Subject.CommonName != "second" {
+		t.Fatalf("certificate not reloaded, cn: %s", leaf.Subject.CommonName)
+	}
+}
+
+func TestReloaderRequiresCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "server", time.Now())
+	_, err := NewReloader(Config{CertFile: certFile, KeyFile: keyFile, ClientAuth: ClientAuthRequireAndVerify})
+	if err == nil {
+		t.Fatal("expected error without client ca")
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	u, _ := url.Parse("spiffe://example.org/user/alice")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "root"},
+		DNSNames:       []string{"host.example.org"},
+		EmailAddresses: []string{"bob@example.org"},
+		URIs:           []*url.URL{u},
+	}
+	cases := map[string]string{
+		IdentityCN:       "root",
+		IdentitySANDNS:   "host.example.org",
+		IdentitySANEmail: "bob@example.org",
+		IdentitySANURI:   "alice",
+	}
+	for source, want := range cases {
+		identity, err := NewIdentity(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := identity(cert)
+		if err != nil || got != want {
+			t.Errorf("%s: got %q, %v, want %q", source, got, err, want)
+		}
+	}
+	if _, err := NewIdentity("serial"); err == nil {
+		t.Error("expected error for unknown source")
+	}
+}
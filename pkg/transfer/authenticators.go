@@ -0,0 +1,373 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/shumin1027/otpd/pkg/otp"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Formats of the backups of authenticator apps, import only
+const (
+	// FormatAegis the json export of Aegis, plain or an encrypted vault
+	FormatAegis = "aegis"
+	// FormatAndOTP the plain json backup of andOTP
+	FormatAndOTP = "andotp"
+	// FormatFreeOTP the json export of FreeOTP+
+	FormatFreeOTP = "freeotp"
+)
+
+func init() {
+	Register(FormatAegis, aegisFormat{})
+	Register(FormatAndOTP, andOTPFormat{})
+	Register(FormatFreeOTP, freeOTPFormat{})
+}
+
+// appToken an account of an authenticator app backup
+type appToken struct {
+	Type      string
+	Issuer    string
+	Name      string
+	Key       []byte
+	Algorithm string
+	Digits    int
+	Period    int
+	Counter   uint64
+	Groups    []string
+}
+
+// record 账户名带上issuer，同一用户在不同服务的令牌不会重名。
+// otpd只校验TOTP，其它类型的令牌标记为不支持，导入时跳过，预览时仍可列出
+func (t appToken) record() Record {
+	issuer, name := strings.TrimSpace(t.Issuer), strings.TrimSpace(t.Name)
+	// 名称可能带有issuer前缀，与URI的label相同
+	if i := strings.Index(name, ":"); i >= 0 {
+		if issuer == "" {
+			issuer = strings.TrimSpace(name[:i])
+		}
+		name = strings.TrimSpace(name[i+1:])
+	}
+	r := Record{Name: name, Groups: t.Groups}
+	switch {
+	case name == "":
+		r.Name = issuer
+	case issuer != "":
+		r.Name = issuer + ":" + name
+	}
+	p := otp.DefaultCodeParams()
+	p.Key = t.Key
+	switch typ := strings.ToLower(t.Type); typ {
+	case "totp":
+	case "hotp":
+		p.TOTP, p.Counter = false, t.Counter
+		r.Unsupported = "hotp tokens are not supported"
+	default:
+		r.Unsupported = fmt.Sprintf("%s tokens are not supported", typ)
+	}
+	if t.Algorithm != "" {
+		a, err := otp.ParseAlgorithm(t.Algorithm)
+		if err != nil && r.Unsupported == "" {
+			r.Unsupported = err.Error()
+		}
+		if err == nil {
+			p.Algorithm = a
+		}
+	}
+	if t.Digits > 0 {
+		p.Digits = t.Digits
+	}
+	if t.Period > 0 {
+		p.Period = time.Duration(t.Period) * time.Second
+	}
+	r.URL = p.URL(issuer, name)
+	return r
+}
+
+// base32Token the base32 secrets of Aegis and andOTP, an invalid one marks the record invalid
+func base32Token(t appToken, secret string) Record {
+	key, err := otp.ParseKey(secret)
+	t.Key = key
+	r := t.record()
+	if err != nil && r.Invalid == "" {
+		r.Invalid = "invalid secret: " + err.Error()
+	}
+	return r
+}
+
+// hexBytes hex encoded bytes in Aegis vaults
+type hexBytes []byte
+
+func (b *hexBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := hex.DecodeString(s)
+	*b = v
+	return err
+}
+
+// aegisSlotPassword 其它类型的slot需要生物识别或原始密钥，无法用口令解密
+const aegisSlotPassword = 1
+
+// aegisMaxMemory scrypt参数来自文件，限制内存用量，Aegis默认N=32768,r=8，约32MiB
+const aegisMaxMemory = 256 << 20
+
+type aegisParams struct {
+	Nonce hexBytes `json:"nonce"`
+	Tag   hexBytes `json:"tag"`
+}
+
+type aegisSlot struct {
+	Type      int         `json:"type"`
+	Key       hexBytes    `json:"key"`
+	KeyParams aegisParams `json:"key_params"`
+	N         int         `json:"n"`
+	R         int         `json:"r"`
+	P         int         `json:"p"`
+	Salt      hexBytes    `json:"salt"`
+}
+
+type aegisVault struct {
+	Header struct {
+		Slots  []aegisSlot  `json:"slots"`
+		Params *aegisParams `json:"params"`
+	} `json:"header"`
+	// DB a json object, or the base64 ciphertext of one in encrypted vaults
+	DB json.RawMessage `json:"db"`
+}
+
+type aegisDB struct {
+	Entries []struct {
+		Type   string   `json:"type"`
+		Name   string   `json:"name"`
+		Issuer string   `json:"issuer"`
+		Groups []string `json:"groups"`
+		Info   struct {
+			Secret  string `json:"secret"`
+			Algo    string `json:"algo"`
+			Digits  int    `json:"digits"`
+			Period  int    `json:"period"`
+			Counter uint64 `json:"counter"`
+		} `json:"info"`
+	} `json:"entries"`
+	// Groups 版本3起条目引用分组的uuid
+	Groups []struct {
+		UUID string `json:"uuid"`
+		Name string `json:"name"`
+	} `json:"groups"`
+}
+
+type aegisFormat struct{}
+
+func (aegisFormat) Detect(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("{")) && bytes.Contains(data, []byte(`"header"`)) && bytes.Contains(data, []byte(`"db"`))
+}
+
+func (aegisFormat) Encode(io.Writer, []Record) error {
+	return ErrUnsupported
+}
+
+func (f aegisFormat) Decode(r io.Reader) ([]Record, error) {
+	return f.DecodePassphrase(r, "")
+}
+
+// DecodePassphrase decrypts encrypted vaults with the password slot of the passphrase
+func (aegisFormat) DecodePassphrase(r io.Reader, passphrase string) ([]Record, error) {
+	var vault aegisVault
+	if err := json.NewDecoder(r).Decode(&vault); err != nil {
+		return nil, err
+	}
+	data := []byte(vault.DB)
+	if vault.Header.Params != nil {
+		var err error
+		if data, err = vault.decrypt(passphrase); err != nil {
+			return nil, err
+		}
+	}
+	var db aegisDB
+	if err := json.Unmarshal(data, &db); err != nil {
+		return nil, err
+	}
+	groups := map[string]string{}
+	for _, g := range db.Groups {
+		groups[g.UUID] = g.Name
+	}
+
+	records := make([]Record, 0, len(db.Entries))
+	for _, e := range db.Entries {
+		t := appToken{
+			Type:      e.Type,
+			Issuer:    e.Issuer,
+			Name:      e.Name,
+			Algorithm: e.Info.Algo,
+			Digits:    e.Info.Digits,
+			Period:    e.Info.Period,
+			Counter:   e.Info.Counter,
+		}
+		// 版本2的groups是分组名，版本3是uuid
+		for _, g := range e.Groups {
+			if name, ok := groups[g]; ok {
+				g = name
+			}
+			t.Groups = append(t.Groups, g)
+		}
+		records = append(records, base32Token(t, e.Info.Secret))
+	}
+	return records, nil
+}
+
+// decrypt 用口令解开password slot中的主密钥，再用主密钥解密db
+func (v *aegisVault) decrypt(passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, ErrPassphraseRequired
+	}
+	var ciphertext string
+	if err := json.Unmarshal(v.DB, &ciphertext); err != nil {
+		return nil, errors.New("invalid encrypted db")
+	}
+	db, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, errors.New("invalid encrypted db")
+	}
+
+	slots := 0
+	for _, slot := range v.Header.Slots {
+		if slot.Type != aegisSlotPassword {
+			continue
+		}
+		slots++
+		if slot.N <= 0 || slot.R <= 0 || slot.P <= 0 || 128*slot.N*slot.R > aegisMaxMemory || slot.P > 16 {
+			return nil, fmt.Errorf("unsupported scrypt parameters n=%d r=%d p=%d", slot.N, slot.R, slot.P)
+		}
+		key, err := scrypt.Key([]byte(passphrase), slot.Salt, slot.N, slot.R, slot.P, 32)
+		if err != nil {
+			return nil, err
+		}
+		master, err := aegisOpen(key, slot.KeyParams, slot.Key)
+		if err != nil {
+			continue
+		}
+		if db, err = aegisOpen(master, *v.Header.Params, db); err != nil {
+			return nil, ErrWrongPassphrase
+		}
+		return db, nil
+	}
+	if slots == 0 {
+		return nil, errors.New("the vault has no password slot")
+	}
+	return nil, ErrWrongPassphrase
+}
+
+// aegisOpen AES-GCM解密，Aegis单独保存tag
+func aegisOpen(key []byte, params aegisParams, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(params.Nonce))
+	if err != nil {
+		return nil, err
+	}
+	sealed := append(append([]byte(nil), ciphertext...), params.Tag...)
+	return gcm.Open(nil, params.Nonce, sealed, nil)
+}
+
+type andOTPFormat struct{}
+
+// Detect 与otpd的json格式一样是数组，以secret字段区分
+func (andOTPFormat) Detect(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("[")) && bytes.Contains(data, []byte(`"secret"`))
+}
+
+func (andOTPFormat) Encode(io.Writer, []Record) error {
+	return ErrUnsupported
+}
+
+func (andOTPFormat) Decode(r io.Reader) ([]Record, error) {
+	var entries []struct {
+		Secret    string   `json:"secret"`
+		Issuer    string   `json:"issuer"`
+		Label     string   `json:"label"`
+		Type      string   `json:"type"`
+		Algorithm string   `json:"algorithm"`
+		Digits    int      `json:"digits"`
+		Period    int      `json:"period"`
+		Counter   uint64   `json:"counter"`
+		Tags      []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, err
+	}
+	records := make([]Record, 0, len(entries))
+	for _, e := range entries {
+		records = append(records, base32Token(appToken{
+			Type:      e.Type,
+			Issuer:    e.Issuer,
+			Name:      e.Label,
+			Algorithm: e.Algorithm,
+			Digits:    e.Digits,
+			Period:    e.Period,
+			Counter:   e.Counter,
+			Groups:    e.Tags,
+		}, e.Secret))
+	}
+	return records, nil
+}
+
+type freeOTPFormat struct{}
+
+func (freeOTPFormat) Detect(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("{")) && bytes.Contains(data, []byte(`"tokens"`))
+}
+
+func (freeOTPFormat) Encode(io.Writer, []Record) error {
+	return ErrUnsupported
+}
+
+// Decode FreeOTP+的密钥是有符号字节数组
+func (freeOTPFormat) Decode(r io.Reader) ([]Record, error) {
+	var backup struct {
+		Tokens []struct {
+			Type      string `json:"type"`
+			IssuerExt string `json:"issuerExt"`
+			Label     string `json:"label"`
+			Secret    []int8 `json:"secret"`
+			Algo      string `json:"algo"`
+			Digits    int    `json:"digits"`
+			Period    int    `json:"period"`
+			Counter   uint64 `json:"counter"`
+		} `json:"tokens"`
+	}
+	if err := json.NewDecoder(r).Decode(&backup); err != nil {
+		return nil, err
+	}
+	records := make([]Record, 0, len(backup.Tokens))
+	for _, t := range backup.Tokens {
+		key := make([]byte, len(t.Secret))
+		for i, b := range t.Secret {
+			key[i] = byte(b)
+		}
+		records = append(records, appToken{
+			Type:      t.Type,
+			Issuer:    t.IssuerExt,
+			Name:      t.Label,
+			Key:       key,
+			Algorithm: t.Algo,
+			Digits:    t.Digits,
+			Period:    t.Period,
+			Counter:   t.Counter,
+		}.record())
+	}
+	return records, nil
+}
@@ -0,0 +1,205 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shumin1027/otpd/pkg/otp"
+)
+
+// Built in formats
+const (
+	// FormatURI one otpauth:// URI per line, blank lines and lines starting with # are ignored
+	FormatURI = "uri"
+	// FormatJSON an array of records
+	FormatJSON = "json"
+	// FormatCSV a header line and one account per line, see csvColumns
+	FormatCSV = "csv"
+)
+
+func init() {
+	Register(FormatURI, uriFormat{})
+	Register(FormatJSON, jsonFormat{})
+	Register(FormatCSV, csvFormat{})
+}
+
+type uriFormat struct{}
+
+func (uriFormat) Detect(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("otpauth://"))
+}
+
+func (uriFormat) Encode(w io.Writer, records []Record) error {
+	for _, r := range records {
+		if _, err := fmt.Fprintln(w, r.URL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decode 账户名取自URI的label，去掉issuer前缀
+func (uriFormat) Decode(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, name, err := Label(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		records = append(records, Record{Name: name, URL: line})
+	}
+	return records, scanner.Err()
+}
+
+type jsonFormat struct{}
+
+func (jsonFormat) Detect(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("[")) && bytes.Contains(data, []byte(`"url"`))
+}
+
+func (jsonFormat) Encode(w io.Writer, records []Record) error {
+	if records == nil {
+		records = []Record{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(records)
+}
+
+func (jsonFormat) Decode(r io.Reader) ([]Record, error) {
+	var records []Record
+	if err := json.NewDecoder(r).Decode(&records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// csvColumns name and secret are required when reading, the others default to the otpd defaults.
+// groups are separated by semicolons.
+var csvColumns = []string{"name", "issuer", "secret", "algorithm", "digits", "period", "groups", "disabled"}
+
+type csvFormat struct{}
+
+func (csvFormat) Encode(w io.Writer, records []Record) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvColumns); err != nil {
+		return err
+	}
+	for _, r := range records {
+		p, err := otp.ParseCodeURL(r.URL)
+		if err != nil {
+			return fmt.Errorf("%s: %w", r.Name, err)
+		}
+		issuer, _, _ := Label(r.URL)
+		if err := cw.Write([]string{
+			r.Name,
+			issuer,
+			otp.EncodeKey(p.Key),
+			p.Algorithm.String(),
+			strconv.Itoa(p.Digits),
+			strconv.Itoa(int(p.Period.Seconds())),
+			strings.Join(r.Groups, ";"),
+			strconv.FormatBool(r.Disabled),
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (csvFormat) Decode(r io.Reader) ([]Record, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, h := range header {
+		columns[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	for _, required := range []string{"name", "secret"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("missing csv column %q, the header must contain %s", required, strings.Join(csvColumns, ","))
+		}
+	}
+
+	var records []Record
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		get := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		record, err := csvRecord(get)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, record)
+	}
+}
+
+// csvRecord builds the otpauth:// URI of a csv row
+func csvRecord(get func(column string) string) (Record, error) {
+	record := Record{Name: get("name")}
+	p := otp.DefaultCodeParams()
+	var err error
+	if p.Key, err = otp.ParseKey(get("secret")); err != nil {
+		return record, err
+	}
+	if v := get("algorithm"); v != "" {
+		if p.Algorithm, err = otp.ParseAlgorithm(v); err != nil {
+			return record, err
+		}
+	}
+	if v := get("digits"); v != "" {
+		if p.Digits, err = strconv.Atoi(v); err != nil {
+			return record, fmt.Errorf("invalid digits: %s", v)
+		}
+	}
+	if v := get("period"); v != "" {
+		period, err := strconv.Atoi(v)
+		if err != nil || period <= 0 {
+			return record, fmt.Errorf("invalid period: %s", v)
+		}
+		p.Period = time.Duration(period) * time.Second
+	}
+	if v := get("disabled"); v != "" {
+		if record.Disabled, err = strconv.ParseBool(v); err != nil {
+			return record, fmt.Errorf("invalid disabled: %s", v)
+		}
+	}
+	for _, g := range strings.Split(get("groups"), ";") {
+		if g = strings.TrimSpace(g); g != "" {
+			record.Groups = append(record.Groups, g)
+		}
+	}
+	record.URL = p.URL(get("issuer"), record.Name)
+	return record, nil
+}
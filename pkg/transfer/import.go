@@ -0,0 +1,245 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/shumin1027/otpd/pkg/otp"
+)
+
+// Policy what Import does with accounts that already exist
+type Policy string
+
+const (
+	// PolicySkip keeps the existing account
+	PolicySkip Policy = "skip"
+	// PolicyOverwrite replaces the key, groups and state of the existing account
+	PolicyOverwrite Policy = "overwrite"
+	// PolicyFail imports nothing if any account exists
+	PolicyFail Policy = "fail"
+)
+
+// ParsePolicy parses skip, overwrite or fail, empty is skip
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case "":
+		return PolicySkip, nil
+	case PolicySkip, PolicyOverwrite, PolicyFail:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q, support skip, overwrite, fail", s)
+}
+
+var (
+	// ErrInvalid returned by Import when some records are invalid, nothing is imported
+	ErrInvalid = errors.New("invalid records, nothing imported")
+	// ErrConflict returned by Import with PolicyFail when some accounts exist, nothing is imported
+	ErrConflict = errors.New("accounts already exist, nothing imported")
+)
+
+// Actions of the entries of a Result
+const (
+	ActionCreate    = "create"
+	ActionOverwrite = "overwrite"
+	ActionSkip      = "skip"
+	ActionConflict  = "conflict"
+	ActionInvalid   = "invalid"
+)
+
+// Options of Import
+type Options struct {
+	Policy Policy
+	// DryRun only reports what would be imported
+	DryRun bool
+}
+
+// Entry what Import did, or would do, with a record, described without its secret
+type Entry struct {
+	Name      string   `json:"name"`
+	Issuer    string   `json:"issuer,omitempty"`
+	Type      string   `json:"type,omitempty"`
+	Algorithm string   `json:"algorithm,omitempty"`
+	Digits    int      `json:"digits,omitempty"`
+	Period    int      `json:"period,omitempty"`
+	Groups    []string `json:"groups,omitempty"`
+	Action    string   `json:"action"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// Result of Import
+type Result struct {
+	DryRun      bool    `json:"dry_run"`
+	Total       int     `json:"total"`
+	Created     int     `json:"created"`
+	Overwritten int     `json:"overwritten"`
+	Skipped     int     `json:"skipped"`
+	Conflicts   int     `json:"conflicts"`
+	Invalid     int     `json:"invalid"`
+	Entries     []Entry `json:"entries"`
+}
+
+func (r *Result) add(record *Record, action string, err error) {
+	e := Entry{Name: record.Name, Groups: record.Groups, Action: action}
+	// 无法解析的URI只列出名称
+	if p, perr := otp.ParseCodeURL(record.URL); perr == nil {
+		e.Issuer, _, _ = Label(record.URL)
+		e.Type, e.Algorithm, e.Digits = "hotp", p.Algorithm.String(), p.Digits
+		if p.TOTP {
+			e.Type, e.Period = "totp", int(p.Period.Seconds())
+		}
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	r.Entries = append(r.Entries, e)
+	switch action {
+	case ActionCreate:
+		r.Created++
+	case ActionOverwrite:
+		r.Overwritten++
+	case ActionSkip:
+		r.Skipped++
+	case ActionConflict:
+		r.Conflicts++
+	case ActionInvalid:
+		r.Invalid++
+	}
+}
+
+// Import validates all records and checks them against the existing accounts before writing any,
+// an invalid record, or an existing account with PolicyFail, aborts the import with nothing written.
+// Unsupported records are skipped.
+// The accounts are saved in one transaction, a store error leaves none of them imported,
+// and ErrConflict is returned if an account to create has been created since the check.
+// The result lists the action of every record, also when an error is returned.
+func Import(records []Record, opts Options) (*Result, error) {
+	if opts.Policy == "" {
+		opts.Policy = PolicySkip
+	}
+	result := &Result{DryRun: opts.DryRun, Total: len(records), Entries: make([]Entry, 0, len(records))}
+
+	// 先检查全部记录，确定每条的处理方式
+	existing := make([]*otp.Account, len(records))
+	seen := map[string]bool{}
+	for i := range records {
+		r := &records[i]
+		if r.Unsupported != "" {
+			result.add(r, ActionSkip, errors.New(r.Unsupported))
+			continue
+		}
+		if err := r.Validate(); err != nil {
+			result.add(r, ActionInvalid, err)
+			continue
+		}
+		if seen[r.Name] {
+			result.add(r, ActionInvalid, errors.New("duplicate name"))
+			continue
+		}
+		seen[r.Name] = true
+
+		account, err := otp.Get(r.Name)
+		if err != nil {
+			return result, err
+		}
+		existing[i] = account
+		switch {
+		case account == nil:
+			result.add(r, ActionCreate, nil)
+		case opts.Policy == PolicyOverwrite:
+			result.add(r, ActionOverwrite, nil)
+		case opts.Policy == PolicyFail:
+			result.add(r, ActionConflict, otp.ErrExists)
+		default:
+			result.add(r, ActionSkip, nil)
+		}
+	}
+	if result.Invalid > 0 {
+		return result, ErrInvalid
+	}
+	if result.Conflicts > 0 {
+		return result, ErrConflict
+	}
+	if opts.DryRun {
+		return result, nil
+	}
+
+	// 新建和覆盖的账户在一个事务中提交，失败时不会只导入一部分
+	var created, updated []*otp.Account
+	for i, e := range result.Entries {
+		if e.Action != ActionCreate && e.Action != ActionOverwrite {
+			continue
+		}
+		account, err := apply(&records[i], existing[i])
+		if err != nil {
+			return result, fmt.Errorf("import %s: %w", records[i].Name, err)
+		}
+		if existing[i] == nil {
+			created = append(created, account)
+		} else {
+			updated = append(updated, account)
+		}
+	}
+	// 检查之后才创建的同名账户不会被覆盖
+	err := otp.SaveAll(created, updated)
+	if errors.Is(err, otp.ErrExists) {
+		return result, ErrConflict
+	}
+	if err != nil {
+		return result, fmt.Errorf("import: %w", err)
+	}
+	return result, nil
+}
+
+// Preview lists what Import would do with the records without writing anything,
+// unlike a dry run of Import invalid records and conflicts are not errors
+func Preview(records []Record, policy Policy) (*Result, error) {
+	result, err := Import(records, Options{Policy: policy, DryRun: true})
+	if errors.Is(err, ErrInvalid) || errors.Is(err, ErrConflict) {
+		return result, nil
+	}
+	return result, err
+}
+
+// apply writes the record over the account, a new one if nil
+func apply(r *Record, account *otp.Account) (*otp.Account, error) {
+	if account == nil {
+		account = &otp.Account{Name: r.Name}
+	}
+	account.OTP = r.URL
+	key, err := account.Key()
+	if err != nil {
+		return nil, err
+	}
+	account.QRCode = otp.GenerateQRCode(key)
+	account.Groups = r.Groups
+	account.Disabled = r.Disabled
+	account.Options = r.Options
+	return account, nil
+}
+
+// Export returns the accounts as records sorted by name, only those of group if not empty,
+// and only the named ones if names are given
+func Export(ctx context.Context, group string, names ...string) ([]Record, error) {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+	var records []Record
+	err := otp.Each(ctx, func(a *otp.Account) error {
+		if group != "" && !a.InGroup(group) {
+			return nil
+		}
+		if len(names) > 0 && !wanted[a.Name] {
+			return nil
+		}
+		records = append(records, Record{Name: a.Name, URL: a.OTP, Groups: a.Groups, Disabled: a.Disabled, Options: a.Options})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records, nil
+}
@@ -0,0 +1,341 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	potp "github.com/pquerna/otp"
+	"github.com/shumin1027/otpd/pkg/otp"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// FormatMigration the "Transfer accounts" QR codes of Google Authenticator,
+// one otpauth-migration://offline?data= URI per batch and line
+const FormatMigration = "migration"
+
+// DefaultMigrationBatchSize accounts per migration URI, Google Authenticator uses 10 so the QR code stays scannable
+const DefaultMigrationBatchSize = 10
+
+const migrationPrefix = "otpauth-migration://"
+
+/*
+MigrationPayload 的字段编号，没有生成代码，直接用protowire读写:
+
+	message MigrationPayload {
+	  repeated OtpParameters otp_parameters = 1;
+	  int32 version = 2;
+	  int32 batch_size = 3;
+	  int32 batch_index = 4;
+	  int32 batch_id = 5;
+	}
+	message OtpParameters {
+	  bytes secret = 1;
+	  string name = 2;
+	  string issuer = 3;
+	  Algorithm algorithm = 4; // 1 SHA1, 2 SHA256, 3 SHA512, 4 MD5
+	  DigitCount digits = 5;   // 1 SIX, 2 EIGHT
+	  OtpType type = 6;        // 1 HOTP, 2 TOTP
+	  int64 counter = 7;
+	}
+*/
+const (
+	payloadParameters protowire.Number = 1
+	payloadVersion    protowire.Number = 2
+	payloadBatchSize  protowire.Number = 3
+	payloadBatchIndex protowire.Number = 4
+	payloadBatchID    protowire.Number = 5
+
+	paramSecret    protowire.Number = 1
+	paramName      protowire.Number = 2
+	paramIssuer    protowire.Number = 3
+	paramAlgorithm protowire.Number = 4
+	paramDigits    protowire.Number = 5
+	paramType      protowire.Number = 6
+	paramCounter   protowire.Number = 7
+)
+
+const (
+	typeHOTP = 1
+	typeTOTP = 2
+
+	digitsSix   = 1
+	digitsEight = 2
+)
+
+// migrationAlgorithms algorithm enum values, MD5 is not supported
+var migrationAlgorithms = map[uint64]potp.Algorithm{
+	1: potp.AlgorithmSHA1,
+	2: potp.AlgorithmSHA256,
+	3: potp.AlgorithmSHA512,
+}
+
+// errMigrationPeriod Google Authenticator只支持30秒的时间步长
+var errMigrationPeriod = errors.New("only a period of 30s can be transferred to Google Authenticator")
+
+func init() {
+	Register(FormatMigration, migrationFormat{batchSize: DefaultMigrationBatchSize})
+}
+
+type migrationFormat struct {
+	batchSize int
+}
+
+func (migrationFormat) Detect(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(migrationPrefix))
+}
+
+func (f migrationFormat) Encode(w io.Writer, records []Record) error {
+	uris, err := MigrationURIs(records, f.batchSize)
+	if err != nil {
+		return err
+	}
+	for _, uri := range uris {
+		if _, err := fmt.Fprintln(w, uri); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decode 每行一个migration URI，各批次的账户合并返回
+func (migrationFormat) Decode(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		batch, err := ParseMigrationURI(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		records = append(records, batch...)
+	}
+	return records, scanner.Err()
+}
+
+// MigrationURIs encodes the records as migration URIs of at most batchSize accounts each.
+// Only TOTP keys with a period of 30s and 6 or 8 digits can be transferred.
+func MigrationURIs(records []Record, batchSize int) ([]string, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultMigrationBatchSize
+	}
+	params := make([][]byte, 0, len(records))
+	for _, r := range records {
+		p, err := migrationParameters(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", r.Name, err)
+		}
+		params = append(params, p)
+	}
+
+	batches := (len(params) + batchSize - 1) / batchSize
+	var id [4]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	batchID := uint64(binary.BigEndian.Uint32(id[:]) & 0x7fffffff)
+
+	uris := make([]string, 0, batches)
+	for i := 0; i < batches; i++ {
+		end := (i + 1) * batchSize
+		if end > len(params) {
+			end = len(params)
+		}
+		var b []byte
+		for _, p := range params[i*batchSize : end] {
+			b = protowire.AppendTag(b, payloadParameters, protowire.BytesType)
+			b = protowire.AppendBytes(b, p)
+		}
+		b = appendVarint(b, payloadVersion, 1)
+		b = appendVarint(b, payloadBatchSize, uint64(batches))
+		b = appendVarint(b, payloadBatchIndex, uint64(i))
+		b = appendVarint(b, payloadBatchID, batchID)
+		q := url.Values{"data": []string{base64.StdEncoding.EncodeToString(b)}}
+		uris = append(uris, migrationPrefix+"offline?"+q.Encode())
+	}
+	return uris, nil
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// migrationParameters the OtpParameters message of a record, named issuer:label like the URI,
+// the account name is used only without a label: names like user:issuer:label are not shown on the phone
+func migrationParameters(r Record) ([]byte, error) {
+	p, err := otp.ParseCodeURL(r.URL)
+	if err != nil {
+		return nil, err
+	}
+	if p.TOTP && p.Period != 30*time.Second {
+		return nil, errMigrationPeriod
+	}
+	var digits uint64
+	switch p.Digits {
+	case 6:
+		digits = digitsSix
+	case 8:
+		digits = digitsEight
+	default:
+		return nil, fmt.Errorf("unsupported digits: %d", p.Digits)
+	}
+	var algorithm uint64
+	for v, a := range migrationAlgorithms {
+		if a == p.Algorithm {
+			algorithm = v
+		}
+	}
+	issuer, name, err := Label(r.URL)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = r.Name
+	}
+	if issuer != "" {
+		name = issuer + ":" + name
+	}
+
+	var b []byte
+	b = protowire.AppendTag(b, paramSecret, protowire.BytesType)
+	b = protowire.AppendBytes(b, p.Key)
+	b = protowire.AppendTag(b, paramName, protowire.BytesType)
+	b = protowire.AppendString(b, name)
+	if issuer != "" {
+		b = protowire.AppendTag(b, paramIssuer, protowire.BytesType)
+		b = protowire.AppendString(b, issuer)
+	}
+	b = appendVarint(b, paramAlgorithm, algorithm)
+	b = appendVarint(b, paramDigits, digits)
+	if p.TOTP {
+		b = appendVarint(b, paramType, typeTOTP)
+	} else {
+		b = appendVarint(b, paramType, typeHOTP)
+		b = appendVarint(b, paramCounter, p.Counter)
+	}
+	return b, nil
+}
+
+// ParseMigrationURI decodes the accounts of an otpauth-migration://offline?data= URI
+func ParseMigrationURI(uri string) ([]Record, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "otpauth-migration" {
+		return nil, fmt.Errorf("not an otpauth-migration uri: %s", uri)
+	}
+	// 部分工具不转义data中的+，Query解码后变成了空格
+	data := strings.ReplaceAll(u.Query().Get("data"), " ", "+")
+	payload, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		if payload, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(data, "=")); err != nil {
+			return nil, fmt.Errorf("invalid migration data: %w", err)
+		}
+	}
+
+	var records []Record
+	err = consumeFields(payload, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if num != payloadParameters || typ != protowire.BytesType {
+			return nil
+		}
+		r, err := parseMigrationParameters(v)
+		if err != nil {
+			return err
+		}
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// parseMigrationParameters the record of an OtpParameters message
+func parseMigrationParameters(b []byte) (Record, error) {
+	p := otp.DefaultCodeParams()
+	var name, issuer string
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch num {
+		case paramSecret:
+			p.Key = append([]byte(nil), v...)
+		case paramName:
+			name = string(v)
+		case paramIssuer:
+			issuer = string(v)
+		case paramAlgorithm:
+			if n == 0 {
+				break
+			}
+			a, ok := migrationAlgorithms[n]
+			if !ok {
+				return fmt.Errorf("unsupported algorithm: %d", n)
+			}
+			p.Algorithm = a
+		case paramDigits:
+			if n == digitsEight {
+				p.Digits = 8
+			}
+		case paramType:
+			p.TOTP = n != typeHOTP
+		case paramCounter:
+			p.Counter = n
+		}
+		return nil
+	})
+	if err != nil {
+		return Record{}, err
+	}
+	// name可能带有issuer前缀，与URI的label相同
+	if i := strings.Index(name, ":"); i >= 0 {
+		if issuer == "" {
+			issuer = name[:i]
+		}
+		name = name[i+1:]
+	}
+	name = strings.TrimSpace(name)
+	return Record{Name: name, URL: p.URL(strings.TrimSpace(issuer), name)}, nil
+}
+
+// consumeFields calls fn with every field of a message, v for length delimited fields, n for varints
+func consumeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return fmt.Errorf("invalid migration data: %w", protowire.ParseError(l))
+		}
+		b = b[l:]
+		var v []byte
+		var n uint64
+		switch typ {
+		case protowire.BytesType:
+			v, l = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			n, l = protowire.ConsumeVarint(b)
+		default:
+			l = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if l < 0 {
+			return fmt.Errorf("invalid migration data: %w", protowire.ParseError(l))
+		}
+		b = b[l:]
+		if err := fn(num, typ, v, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	potp "github.com/pquerna/otp"
+	"github.com/shumin1027/otpd/pkg/otp"
+)
+
+// Formats of the secret files of the PAM modules
+const (
+	// FormatGoogleAuthenticator the ~/.google_authenticator file of pam_google_authenticator, one account per file
+	FormatGoogleAuthenticator = "google-authenticator"
+	// FormatUsersOath the /etc/users.oath file of pam_oath
+	FormatUsersOath = "users-oath"
+)
+
+func init() {
+	Register(FormatGoogleAuthenticator, googleAuthenticatorFormat{})
+	Register(FormatUsersOath, usersOathFormat{})
+}
+
+// errSingleAccount pam_google_authenticator每个用户一个文件
+var errSingleAccount = errors.New("a google-authenticator file holds exactly one account, select it by name")
+
+var (
+	gaSecret  = regexp.MustCompile(`^[A-Z2-7]{16,}$`)
+	gaScratch = regexp.MustCompile(`^[0-9]{8}$`)
+)
+
+type googleAuthenticatorFormat struct{}
+
+// Detect 第一行是base32密钥，其后是选项或应急码
+func (googleAuthenticatorFormat) Detect(data []byte) bool {
+	lines := strings.Split(string(data), "\n")
+	if !gaSecret.MatchString(strings.TrimSpace(lines[0])) {
+		return false
+	}
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, `"`) && !gaScratch.MatchString(line) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Decode 读取~/.google_authenticator，账户名需要由调用方通过SetName指定:
+
+	JBSWY3DPEHPK3PXPJBSWY3DPEH
+	" RATE_LIMIT 3 30 1718000000
+	" WINDOW_SIZE 17
+	" DISALLOW_REUSE 57266666
+	" TOTP_AUTH
+	12345678
+*/
+func (googleAuthenticatorFormat) Decode(r io.Reader) ([]Record, error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("empty google-authenticator file")
+	}
+	p := otp.DefaultCodeParams()
+	var err error
+	if p.Key, err = otp.ParseKey(scanner.Text()); err != nil {
+		return nil, err
+	}
+	p.TOTP = false
+	options := &otp.Options{}
+	for n := 2; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, `"`) {
+			if !gaScratch.MatchString(line) {
+				return nil, fmt.Errorf("line %d: invalid scratch code", n)
+			}
+			options.ScratchCodes = append(options.ScratchCodes, line)
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, `"`))
+		if len(fields) == 0 {
+			continue
+		}
+		if err := gaOption(&p, options, fields); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if options.WindowSize == 0 && options.ScratchCodes == nil && options.RateLimit == nil && !options.DisallowReuse {
+		options = nil
+	}
+	return []Record{{URL: p.URL("", ""), Options: options}}, nil
+}
+
+// gaOption applies an option line, the timestamps kept by RATE_LIMIT and DISALLOW_REUSE are dropped
+func gaOption(p *otp.CodeParams, options *otp.Options, fields []string) error {
+	atoi := func(i int) (int, error) {
+		if i >= len(fields) {
+			return 0, fmt.Errorf("missing value of %s", fields[0])
+		}
+		v, err := strconv.Atoi(fields[i])
+		if err != nil || v <= 0 {
+			return 0, fmt.Errorf("invalid %s: %s", fields[0], fields[i])
+		}
+		return v, nil
+	}
+	var err error
+	switch fields[0] {
+	case "TOTP_AUTH":
+		p.TOTP = true
+	case "HOTP_COUNTER":
+		var counter int
+		if counter, err = atoi(1); err == nil {
+			p.Counter = uint64(counter)
+		}
+	case "STEP_SIZE":
+		var step int
+		if step, err = atoi(1); err == nil {
+			p.Period = time.Duration(step) * time.Second
+		}
+	case "WINDOW_SIZE":
+		options.WindowSize, err = atoi(1)
+	case "DISALLOW_REUSE":
+		options.DisallowReuse = true
+	case "RATE_LIMIT":
+		limit := &otp.RateLimit{}
+		if limit.Attempts, err = atoi(1); err == nil {
+			limit.Interval, err = atoi(2)
+		}
+		options.RateLimit = limit
+	}
+	// 其他选项(例如TIME_SKEW)由PAM模块维护，忽略
+	return err
+}
+
+// Encode writes the file of a single SHA1 account with 6 digit codes, the only ones pam_google_authenticator supports
+func (googleAuthenticatorFormat) Encode(w io.Writer, records []Record) error {
+	if len(records) != 1 {
+		return errSingleAccount
+	}
+	r := records[0]
+	p, err := otp.ParseCodeURL(r.URL)
+	if err != nil {
+		return err
+	}
+	if p.Algorithm != potp.AlgorithmSHA1 || p.Digits != 6 {
+		return fmt.Errorf("%s: pam_google_authenticator only supports SHA1 and 6 digits", r.Name)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, otp.EncodeKey(p.Key))
+	if o := r.Options; o != nil {
+		if o.RateLimit != nil {
+			fmt.Fprintf(&buf, "\" RATE_LIMIT %d %d\n", o.RateLimit.Attempts, o.RateLimit.Interval)
+		}
+		if o.WindowSize > 0 {
+			fmt.Fprintf(&buf, "\" WINDOW_SIZE %d\n", o.WindowSize)
+		}
+		if o.DisallowReuse {
+			fmt.Fprintln(&buf, `" DISALLOW_REUSE`)
+		}
+	}
+	if p.TOTP {
+		fmt.Fprintln(&buf, `" TOTP_AUTH`)
+		if p.Period != 30*time.Second {
+			fmt.Fprintf(&buf, "\" STEP_SIZE %d\n", int(p.Period/time.Second))
+		}
+	} else {
+		fmt.Fprintf(&buf, "\" HOTP_COUNTER %d\n", p.Counter)
+	}
+	if r.Options != nil {
+		for _, code := range r.Options.ScratchCodes {
+			fmt.Fprintln(&buf, code)
+		}
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+type usersOathFormat struct{}
+
+func (usersOathFormat) Detect(data []byte) bool {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return strings.HasPrefix(strings.ToUpper(line), "HOTP")
+	}
+	return false
+}
+
+/*
+Decode 读取pam_oath的users.oath，每行一个用户:
+
+	# 类型               用户   PIN  十六进制密钥  [计数  上次的验证码  上次使用的时间]
+	HOTP/T30/6          alice  -    3132333435363738393031323334353637383930
+	HOTP                bob    -    3132333435363738393031323334353637383930  2  755224  2024-01-01T00:00:00L
+
+Users with a PIN are listed as invalid records, otpd has no PINs.
+*/
+func (usersOathFormat) Decode(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("line %d: expected type, user, pin and secret", n)
+		}
+		p, err := parseOathType(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if p.Key, err = otp.ParseHexKey(fields[3]); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if len(fields) > 4 && !p.TOTP {
+			if p.Counter, err = strconv.ParseUint(fields[4], 10, 64); err != nil {
+				return nil, fmt.Errorf("line %d: invalid counter %s", n, fields[4])
+			}
+		}
+		record := Record{Name: fields[1], URL: p.URL("", fields[1])}
+		// "-"表示没有PIN，"+"表示由其他PAM模块校验密码
+		if pin := fields[2]; pin != "-" && pin != "+" {
+			record.Invalid = "users with a pin are not supported"
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// parseOathType parses HOTP[/E|/T<seconds>][/<digits>] of users.oath
+func parseOathType(s string) (otp.CodeParams, error) {
+	p := otp.DefaultCodeParams()
+	p.TOTP = false
+	parts := strings.Split(strings.ToUpper(s), "/")
+	if parts[0] != "HOTP" {
+		return p, fmt.Errorf("unsupported token type %s", s)
+	}
+	for _, part := range parts[1:] {
+		switch {
+		case part == "E":
+		case strings.HasPrefix(part, "T"):
+			step, err := strconv.Atoi(part[1:])
+			if err != nil || step <= 0 {
+				return p, fmt.Errorf("invalid time step in %s", s)
+			}
+			p.TOTP = true
+			p.Period = time.Duration(step) * time.Second
+		default:
+			digits, err := strconv.Atoi(part)
+			if err != nil || digits < 6 || digits > 8 {
+				return p, fmt.Errorf("invalid digits in %s", s)
+			}
+			p.Digits = digits
+		}
+	}
+	return p, nil
+}
+
+func (usersOathFormat) Encode(w io.Writer, records []Record) error {
+	for _, r := range records {
+		line, err := usersOathLine(r)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// usersOathLine the line of the record in users.oath, pam_oath only supports SHA1
+func usersOathLine(r Record) (string, error) {
+	if strings.ContainsAny(r.Name, " \t") {
+		return "", fmt.Errorf("%s: users.oath user names can not contain spaces", r.Name)
+	}
+	p, err := otp.ParseCodeURL(r.URL)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", r.Name, err)
+	}
+	if p.Algorithm != potp.AlgorithmSHA1 {
+		return "", fmt.Errorf("%s: pam_oath only supports SHA1", r.Name)
+	}
+	typ := fmt.Sprintf("HOTP/E/%d", p.Digits)
+	if p.TOTP {
+		typ = fmt.Sprintf("HOTP/T%d/%d", int(p.Period/time.Second), p.Digits)
+	}
+	line := fmt.Sprintf("%s\t%s\t-\t%s", typ, r.Name, hex.EncodeToString(p.Key))
+	if !p.TOTP && p.Counter > 0 {
+		line += "\t" + strconv.FormatUint(p.Counter, 10)
+	}
+	return line, nil
+}
+
+// usersOathHeader 同步生成的文件头
+const usersOathHeader = "# managed by otpd sync, manual changes are overwritten\n"
+
+// MergeUsersOath the users.oath of the records, keeping the lines of existing, an earlier version of the file,
+// whose type, user and secret did not change: pam_oath stores the last used code and counter in them.
+// Records pam_oath does not support are left out, skipped lists why.
+func MergeUsersOath(existing []byte, records []Record) (data []byte, skipped []error) {
+	kept := map[string]string{}
+	for _, line := range strings.Split(string(existing), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		kept[strings.Join([]string{fields[0], fields[1], strings.ToLower(fields[3])}, "\t")] = strings.TrimSpace(line)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(usersOathHeader)
+	for _, r := range records {
+		line, err := usersOathLine(r)
+		if err != nil {
+			skipped = append(skipped, err)
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if old, ok := kept[strings.Join([]string{fields[0], fields[1], fields[3]}, "\t")]; ok {
+			line = old
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), skipped
+}
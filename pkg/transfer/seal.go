@@ -0,0 +1,75 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+
+	"github.com/shumin1027/otpd/pkg/backup"
+)
+
+// sealMagic 加密导出文件的文件头，后面是salt、nonce和AES-GCM密文
+var sealMagic = []byte("OTPDEXP1")
+
+const (
+	sealSaltSize  = 16
+	sealNonceSize = 12
+)
+
+var (
+	// ErrPassphraseRequired returned by Unseal when the export is encrypted and no passphrase is given
+	ErrPassphraseRequired = errors.New("the file is encrypted, a passphrase is required")
+	// ErrWrongPassphrase returned by Unseal when the passphrase does not decrypt the export
+	ErrWrongPassphrase = errors.New("wrong passphrase or corrupted file")
+)
+
+// Sealed reports whether data is an encrypted export
+func Sealed(data []byte) bool {
+	return bytes.HasPrefix(data, sealMagic)
+}
+
+// Seal encrypts an export with a key derived from the passphrase like encrypted backups
+func Seal(data []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, sealSaltSize)
+	nonce := make([]byte, sealNonceSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	aead, err := backup.DeriveKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(sealMagic)+len(salt)+len(nonce)+len(data)+aead.Overhead())
+	out = append(out, sealMagic...)
+	out = append(out, salt...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, sealMagic), nil
+}
+
+// Unseal decrypts data sealed by Seal, data not sealed is returned as is
+func Unseal(data []byte, passphrase string) ([]byte, error) {
+	if !Sealed(data) {
+		return data, nil
+	}
+	if passphrase == "" {
+		return nil, ErrPassphraseRequired
+	}
+	header := len(sealMagic) + sealSaltSize + sealNonceSize
+	if len(data) < header {
+		return nil, ErrWrongPassphrase
+	}
+	salt := data[len(sealMagic) : len(sealMagic)+sealSaltSize]
+	nonce := data[len(sealMagic)+sealSaltSize : header]
+	aead, err := backup.DeriveKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, nonce, data[header:], sealMagic)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plain, nil
+}
@@ -0,0 +1,236 @@
+// Package transfer imports and exports accounts with their secrets in the formats of other tools
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/shumin1027/otpd/pkg/otp"
+)
+
+// ErrUnsupported returned by formats that can only be read or only be written
+var ErrUnsupported = errors.New("not supported by this format")
+
+// minKeySize RFC 4226要求至少128位，常见的认证器使用80位，低于80位的密钥视为无效
+const minKeySize = 10
+
+// Record an account with its key as an otpauth:// URI
+type Record struct {
+	Name     string       `json:"name"`
+	URL      string       `json:"url"`
+	Groups   []string     `json:"groups,omitempty"`
+	Disabled bool         `json:"disabled,omitempty"`
+	Options  *otp.Options `json:"options,omitempty"`
+	// Invalid why the record can not be imported, set by formats reading accounts otpd does not support
+	Invalid string `json:"invalid,omitempty"`
+	// Unsupported why otpd can not validate the token, e.g. its type, Import skips the record
+	Unsupported string `json:"unsupported,omitempty"`
+}
+
+// Validate checks the record can be validated by otpd: a TOTP key of at least 80 bits
+func (r *Record) Validate() error {
+	if r.Invalid != "" {
+		return errors.New(r.Invalid)
+	}
+	if r.Unsupported != "" {
+		return errors.New(r.Unsupported)
+	}
+	if strings.TrimSpace(r.Name) == "" {
+		return errors.New("empty name")
+	}
+	p, err := otp.ParseCodeURL(r.URL)
+	if err != nil {
+		return err
+	}
+	if !p.TOTP {
+		return errors.New("hotp keys are not supported")
+	}
+	if len(p.Key) < minKeySize {
+		return fmt.Errorf("secret of %d bits is too short, at least 80 bits required", len(p.Key)*8)
+	}
+	if p.Digits < 6 || p.Digits > 8 {
+		return fmt.Errorf("unsupported digits: %d", p.Digits)
+	}
+	return nil
+}
+
+// Label splits the label of an otpauth:// URI into the issuer and the account name,
+// the issuer parameter is used when the label has no issuer prefix
+func Label(uri string) (issuer, name string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", err
+	}
+	label := strings.TrimPrefix(u.Path, "/")
+	if i := strings.Index(label, ":"); i >= 0 {
+		issuer, label = label[:i], label[i+1:]
+	}
+	if issuer == "" {
+		issuer = u.Query().Get("issuer")
+	}
+	return strings.TrimSpace(issuer), strings.TrimSpace(label), nil
+}
+
+// SetName names the account of a file holding a single one, like ~/.google_authenticator,
+// the label of its URI included
+func SetName(records []Record, name string) error {
+	if len(records) != 1 {
+		return fmt.Errorf("can not name %d accounts %s", len(records), name)
+	}
+	r := &records[0]
+	p, err := otp.ParseCodeURL(r.URL)
+	if err != nil {
+		return err
+	}
+	issuer, _, err := Label(r.URL)
+	if err != nil {
+		return err
+	}
+	r.Name, r.URL = name, p.URL(issuer, name)
+	return nil
+}
+
+// SetUser files the records, like the tokens of an authenticator app, under the credentials of a user:
+// the names get the prefix "user:" and the user is added to the groups,
+// so export --group user returns them, e.g. as migration QR codes for a new phone
+func SetUser(records []Record, user string) error {
+	user = strings.TrimSpace(user)
+	if user == "" || strings.Contains(user, ":") {
+		return fmt.Errorf("invalid user %q", user)
+	}
+	for i := range records {
+		r := &records[i]
+		// 空名称仍按无效记录报告
+		if strings.TrimSpace(r.Name) != "" {
+			r.Name = user + ":" + r.Name
+		}
+		groups := []string{user}
+		for _, g := range r.Groups {
+			if g != user {
+				groups = append(groups, g)
+			}
+		}
+		r.Groups = groups
+	}
+	return nil
+}
+
+// Format reads and writes records in the file format of a tool
+type Format interface {
+	// Encode writes the records, returns ErrUnsupported for import only formats
+	Encode(w io.Writer, records []Record) error
+	// Decode reads the records, returns ErrUnsupported for export only formats
+	Decode(r io.Reader) ([]Record, error)
+}
+
+// Detector implemented by formats recognizable from their content
+type Detector interface {
+	Detect(data []byte) bool
+}
+
+// PassphraseDecoder implemented by formats encrypted by their own tool, like Aegis vaults,
+// Read decodes them with the passphrase
+type PassphraseDecoder interface {
+	DecodePassphrase(r io.Reader, passphrase string) ([]Record, error)
+}
+
+type registered struct {
+	name   string
+	format Format
+}
+
+// formats 按注册顺序检测，更具体的格式应先注册
+var formats []registered
+
+// Register adds a format, formats registered first are detected first
+func Register(name string, f Format) {
+	formats = append(formats, registered{name: name, format: f})
+}
+
+// Lookup returns the format registered as name
+func Lookup(name string) (Format, error) {
+	for _, r := range formats {
+		if r.name == name {
+			return r.format, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown format %q, support %s", name, strings.Join(Formats(), ", "))
+}
+
+// Formats the names of the registered formats, sorted
+func Formats() []string {
+	names := make([]string, 0, len(formats))
+	for _, r := range formats {
+		names = append(names, r.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Detect returns the name of the first format recognizing data, csv if none does
+func Detect(data []byte) string {
+	data = bytes.TrimSpace(data)
+	for _, r := range formats {
+		if d, ok := r.format.(Detector); ok && d.Detect(data) {
+			return r.name
+		}
+	}
+	return FormatCSV
+}
+
+// Read decrypts data if sealed and decodes it in format, detected from the content if empty.
+// The passphrase also decrypts the files of formats encrypting them, see PassphraseDecoder.
+func Read(data []byte, format, passphrase string) ([]Record, error) {
+	data, err := Unseal(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if format == "" {
+		format = Detect(data)
+	}
+	f, err := Lookup(format)
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	if d, ok := f.(PassphraseDecoder); ok {
+		records, err = d.DecodePassphrase(bytes.NewReader(data), passphrase)
+	} else {
+		records, err = f.Decode(bytes.NewReader(data))
+	}
+	if errors.Is(err, ErrUnsupported) {
+		return nil, fmt.Errorf("format %s can not be imported", format)
+	}
+	if errors.Is(err, ErrPassphraseRequired) || errors.Is(err, ErrWrongPassphrase) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", format, err)
+	}
+	return records, nil
+}
+
+// Write encodes the records in format, encrypted with the passphrase if not empty
+func Write(records []Record, format, passphrase string) ([]byte, error) {
+	f, err := Lookup(format)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = f.Encode(&buf, records)
+	if errors.Is(err, ErrUnsupported) {
+		return nil, fmt.Errorf("format %s can not be exported", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if passphrase == "" {
+		return buf.Bytes(), nil
+	}
+	return Seal(buf.Bytes(), passphrase)
+}
@@ -0,0 +1,470 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shumin1027/otpd/pkg/badger"
+	"github.com/shumin1027/otpd/pkg/memory"
+	"github.com/shumin1027/otpd/pkg/otp"
+	"github.com/shumin1027/otpd/pkg/store"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/scrypt"
+)
+
+const testURL = "otpauth://totp/Example:alice?secret=JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP&issuer=Example&algorithm=SHA256&digits=8&period=60"
+
+func TestFormats(t *testing.T) {
+	records := []Record{
+		{Name: "alice", URL: testURL, Groups: []string{"ops", "dev"}, Disabled: true},
+	}
+	for _, name := range []string{FormatURI, FormatJSON, FormatCSV} {
+		t.Run(name, func(t *testing.T) {
+			data, err := Write(records, name, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if detected := Detect(data); detected != name {
+				t.Errorf("detected %s", detected)
+			}
+			got, err := Read(data, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 || got[0].Name != "alice" {
+				t.Fatalf("unexpected records %+v", got)
+			}
+			want, _ := otp.ParseCodeURL(testURL)
+			p, err := otp.ParseCodeURL(got[0].URL)
+			if err != nil || !reflect.DeepEqual(p, want) {
+				t.Errorf("expected %+v, got %+v, %v", want, p, err)
+			}
+			// uri只保存密钥
+			if name != FormatURI && (!reflect.DeepEqual(got[0].Groups, records[0].Groups) || !got[0].Disabled) {
+				t.Errorf("groups or state lost: %+v", got[0])
+			}
+		})
+	}
+}
+
+func TestMigration(t *testing.T) {
+	// Google Authenticator导出的二维码
+	const exported = "otpauth-migration://offline?data=CjEKCkhlbGxvId6tvu8SGEV4YW1wbGU6YWxpY2VAZ29vZ2xlLmNvbRoHRXhhbXBsZSABKAEwAhABGAEgACjr4JKK%2Bv%2F%2F%2F%2F8B"
+	records, err := Read([]byte(exported), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Name != "alice@google.com" {
+		t.Fatalf("unexpected records %+v", records)
+	}
+	p, err := otp.ParseCodeURL(records[0].URL)
+	if err != nil || otp.EncodeKey(p.Key) != "JBSWY3DPEHPK3PXP" || !p.TOTP || p.Digits != 6 {
+		t.Errorf("unexpected key %+v, %v", p, err)
+	}
+	if issuer, _, _ := Label(records[0].URL); issuer != "Example" {
+		t.Errorf("unexpected issuer %s", issuer)
+	}
+
+	var many []Record
+	for i := 0; i < 25; i++ {
+		name := fmt.Sprintf("user%d", i)
+		many = append(many, Record{Name: name, URL: otp.GenerateKey(name, otp.GenerateSecret()).URL()})
+	}
+	uris, err := MigrationURIs(many, 10)
+	if err != nil || len(uris) != 3 {
+		t.Fatalf("expected 3 batches, got %d, %v", len(uris), err)
+	}
+	var decoded []Record
+	for _, uri := range uris {
+		batch, err := ParseMigrationURI(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, batch...)
+	}
+	for i := range many {
+		want, _ := otp.ParseCodeURL(many[i].URL)
+		got, _ := otp.ParseCodeURL(decoded[i].URL)
+		if decoded[i].Name != many[i].Name || !reflect.DeepEqual(got, want) {
+			t.Errorf("record %d: expected %+v, got %+v", i, many[i], decoded[i])
+		}
+	}
+
+	// 用户的凭据以原来的issuer和label迁移到手机
+	if err := SetUser(records, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	uris, err = MigrationURIs(records, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch, err := ParseMigrationURI(uris[0]); err != nil || batch[0].Name != "alice@google.com" {
+		t.Errorf("unexpected migration of bob's credentials %+v, %v", batch, err)
+	}
+
+	// 60秒的时间步长无法迁移
+	if _, err := MigrationURIs([]Record{{Name: "alice", URL: testURL}}, 10); err == nil {
+		t.Error("expected an error for a period of 60s")
+	}
+}
+
+func TestSeal(t *testing.T) {
+	sealed, err := Write([]Record{{Name: "alice", URL: testURL}}, FormatURI, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("JBSWY3DP")) {
+		t.Fatal("secret in plain text")
+	}
+	if _, err := Read(sealed, "", ""); !errors.Is(err, ErrPassphraseRequired) {
+		t.Errorf("expected ErrPassphraseRequired, got %v", err)
+	}
+	if _, err := Read(sealed, "", "wrong"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("expected ErrWrongPassphrase, got %v", err)
+	}
+	if records, err := Read(sealed, "", "secret"); err != nil || len(records) != 1 {
+		t.Errorf("unexpected %v, %v", records, err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	if err := otp.Init(store.DriverMemory, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer otp.Storage().Close()
+	if _, err := otp.Create("alice", nil); err != nil {
+		t.Fatal(err)
+	}
+	bob := otp.GenerateKey("bob", otp.GenerateSecret()).URL()
+
+	// 无效记录时不写入任何账户
+	records := []Record{{Name: "bob", URL: bob}, {Name: "carol", URL: "otpauth://hotp/carol?secret=JBSWY3DPEHPK3PXP"}}
+	result, err := Import(records, Options{})
+	if !errors.Is(err, ErrInvalid) || result.Invalid != 1 {
+		t.Fatalf("expected one invalid record, got %+v, %v", result, err)
+	}
+	if a, _ := otp.Get("bob"); a != nil {
+		t.Fatal("bob imported despite an invalid record")
+	}
+
+	records = []Record{{Name: "alice", URL: testURL}, {Name: "bob", URL: bob}}
+	if _, err := Import(records, Options{Policy: PolicyFail}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	if result, err := Import(records, Options{Policy: PolicyOverwrite, DryRun: true}); err != nil || result.Overwritten != 1 || result.Created != 1 {
+		t.Fatalf("unexpected dry run %+v, %v", result, err)
+	}
+	if a, _ := otp.Get("bob"); a != nil {
+		t.Fatal("bob imported by a dry run")
+	}
+
+	result, err = Import(records, Options{Policy: PolicySkip})
+	if err != nil || result.Skipped != 1 || result.Created != 1 {
+		t.Fatalf("unexpected result %+v, %v", result, err)
+	}
+	if a, _ := otp.Get("alice"); a.OTP == testURL {
+		t.Error("alice overwritten with policy skip")
+	}
+	if _, err := Import(records, Options{Policy: PolicyOverwrite}); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := otp.Get("alice"); a.OTP != testURL || a.QRCode == "" {
+		t.Errorf("alice not overwritten: %+v", a)
+	}
+
+	exported, err := Export(context.Background(), "")
+	if err != nil || len(exported) != 2 || exported[0].Name != "alice" || exported[1].URL != bob {
+		t.Errorf("unexpected export %+v, %v", exported, err)
+	}
+}
+
+// failingStore 事务中写入名为fail的账户时出错
+type failingStore struct {
+	transactionalStore
+	fail string
+}
+
+type transactionalStore interface {
+	store.Store
+	store.Transactional
+}
+
+func (s *failingStore) Txn(fn func(tx store.Tx) error) error {
+	return s.transactionalStore.Txn(func(tx store.Tx) error {
+		return fn(failingTx{Tx: tx, fail: s.fail})
+	})
+}
+
+type failingTx struct {
+	store.Tx
+	fail string
+}
+
+func (t failingTx) Bucket(name string) store.TxBucket {
+	return failingBucket{TxBucket: t.Tx.Bucket(name), fail: t.fail}
+}
+
+type failingBucket struct {
+	store.TxBucket
+	fail string
+}
+
+func (b failingBucket) Set(k, v []byte) error {
+	if string(k) == b.fail {
+		return errors.New("disk full")
+	}
+	return b.TxBucket.Set(k, v)
+}
+
+func TestImportAtomic(t *testing.T) {
+	stores := map[string]func() (transactionalStore, error){
+		"memory": func() (transactionalStore, error) { return memory.Open(), nil },
+		"badger": func() (transactionalStore, error) { return badger.Open("", zap.NewNop()) },
+	}
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			s, err := open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := otp.SetStore(&failingStore{transactionalStore: s, fail: "carol"}); err != nil {
+				t.Fatal(err)
+			}
+			defer otp.Storage().Close()
+			if _, err := otp.Create("alice", nil); err != nil {
+				t.Fatal(err)
+			}
+			alice, _ := otp.Get("alice")
+
+			// 写入失败时新建和覆盖的账户都不生效
+			records := []Record{
+				{Name: "alice", URL: testURL},
+				{Name: "bob", URL: otp.GenerateKey("bob", otp.GenerateSecret()).URL()},
+				{Name: "carol", URL: otp.GenerateKey("carol", otp.GenerateSecret()).URL()},
+			}
+			if _, err := Import(records, Options{Policy: PolicyOverwrite}); err == nil {
+				t.Fatal("expected the store error")
+			}
+			if a, _ := otp.Get("bob"); a != nil {
+				t.Error("bob imported by a failed import")
+			}
+			if a, _ := otp.Get("alice"); a == nil || a.OTP != alice.OTP {
+				t.Error("alice overwritten by a failed import")
+			}
+		})
+	}
+}
+
+func TestPAMFormats(t *testing.T) {
+	const ga = `JBSWY3DPEHPK3PXPJBSWY3DPEH
+" RATE_LIMIT 3 30 1718000000
+" WINDOW_SIZE 17
+" DISALLOW_REUSE 57266666
+" TOTP_AUTH
+12345678
+87654321
+`
+	if detected := Detect([]byte(ga)); detected != FormatGoogleAuthenticator {
+		t.Fatalf("detected %s", detected)
+	}
+	records, err := Read([]byte(ga), "", "")
+	if err == nil {
+		err = SetName(records, "alice")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &otp.Options{
+		WindowSize:    17,
+		ScratchCodes:  []string{"12345678", "87654321"},
+		RateLimit:     &otp.RateLimit{Attempts: 3, Interval: 30},
+		DisallowReuse: true,
+	}
+	if r := records[0]; r.Name != "alice" || !reflect.DeepEqual(r.Options, want) || r.Validate() != nil {
+		t.Fatalf("unexpected record %+v", r)
+	}
+	data, err := Write(records, FormatGoogleAuthenticator, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := Read(data, FormatGoogleAuthenticator, "")
+	if err != nil || again[0].URL != mustParams(t, records[0].URL).URL("", "") || !reflect.DeepEqual(again[0].Options, want) {
+		t.Errorf("round trip lost data: %s", data)
+	}
+
+	const oath = `# users
+HOTP/T30/6	alice	-	3132333435363738393031323334353637383930
+HOTP	bob	-	3132333435363738393031323334353637383930	2	755224	2024-01-01T00:00:00L
+HOTP/T30	carol	1234	3132333435363738393031323334353637383930
+`
+	if detected := Detect([]byte(oath)); detected != FormatUsersOath {
+		t.Fatalf("detected %s", detected)
+	}
+	records, err = Read([]byte(oath), "", "")
+	if err != nil || len(records) != 3 {
+		t.Fatalf("unexpected records %+v, %v", records, err)
+	}
+	if err := records[0].Validate(); err != nil {
+		t.Errorf("alice: %v", err)
+	}
+	if records[1].Validate() == nil || records[2].Validate() == nil {
+		t.Error("expected hotp and pin users to be invalid")
+	}
+
+	// 同步时保留pam_oath记录的状态
+	existing := []byte("HOTP/T30/6\talice\t-\t3132333435363738393031323334353637383930\t0\t755224\t2024-01-01T00:00:00L\n")
+	merged, skipped := MergeUsersOath(existing, []Record{records[0], {Name: "dave", URL: testURL}})
+	if len(skipped) != 1 || !bytes.Contains(merged, existing) {
+		t.Errorf("unexpected merge %q, %v", merged, skipped)
+	}
+}
+
+func mustParams(t *testing.T, uri string) otp.CodeParams {
+	params, err := otp.ParseCodeURL(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return params
+}
+
+const testAegisDB = `{"version":3,"entries":[
+	{"type":"totp","name":"alice","issuer":"Example","groups":["6a4b"],"info":{"secret":"JBSWY3DPEHPK3PXPJBSWY3DPEH","algo":"SHA256","digits":8,"period":60}},
+	{"type":"steam","name":"bob","issuer":"Steam","info":{"secret":"JBSWY3DPEHPK3PXPJBSWY3DPEH","algo":"SHA1","digits":5,"period":30}}
+],"groups":[{"uuid":"6a4b","name":"ops"}]}`
+
+func TestAuthenticators(t *testing.T) {
+	plain := `{"version":1,"header":{"slots":null,"params":null},"db":` + testAegisDB + `}`
+	encrypted := sealAegis(t, testAegisDB, "secret")
+	andOTP := `[{"secret":"JBSWY3DPEHPK3PXPJBSWY3DPEH","issuer":"Example","label":"alice","digits":8,"type":"TOTP","algorithm":"SHA256","thumbnail":"Default","period":60,"tags":["ops"]}]`
+	// FreeOTP+的密钥是有符号字节，即JBSWY3DPEHPK3PXPJBSWY3DPEH
+	freeOTP := `{"tokenOrder":["Example:alice"],"tokens":[{"algo":"SHA256","counter":0,"digits":8,"issuerExt":"Example","label":"alice","period":60,"secret":[72,101,108,108,111,33,-34,-83,-66,-17,72,101,108,108,111,33],"type":"TOTP"}]}`
+
+	for format, data := range map[string]string{FormatAegis: plain, FormatAndOTP: andOTP, FormatFreeOTP: freeOTP, "encrypted " + FormatAegis: encrypted} {
+		t.Run(format, func(t *testing.T) {
+			if detected := Detect([]byte(data)); detected != strings.TrimPrefix(format, "encrypted ") {
+				t.Errorf("detected %s", detected)
+			}
+			records, err := Read([]byte(data), "", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			alice := records[0]
+			if err := alice.Validate(); err != nil || alice.Name != "Example:alice" {
+				t.Fatalf("unexpected record %+v, %v", alice, err)
+			}
+			p := mustParams(t, alice.URL)
+			if issuer, _, _ := Label(alice.URL); issuer != "Example" || otp.EncodeKey(p.Key) != "JBSWY3DPEHPK3PXPJBSWY3DPEE" || p.Digits != 8 || p.Period.Seconds() != 60 || p.Algorithm.String() != "SHA256" {
+				t.Errorf("unexpected params %s %+v", issuer, p)
+			}
+			if format != FormatFreeOTP && !reflect.DeepEqual(alice.Groups, []string{"ops"}) {
+				t.Errorf("unexpected groups %v", alice.Groups)
+			}
+			if len(records) > 1 && records[1].Unsupported == "" {
+				t.Error("expected the steam token to be unsupported")
+			}
+		})
+	}
+
+	if _, err := Read([]byte(encrypted), "", ""); !errors.Is(err, ErrPassphraseRequired) {
+		t.Errorf("expected ErrPassphraseRequired, got %v", err)
+	}
+	if _, err := Read([]byte(encrypted), "", "wrong"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("expected ErrWrongPassphrase, got %v", err)
+	}
+	if _, err := Write(nil, FormatAegis, ""); err == nil {
+		t.Error("expected aegis export to fail")
+	}
+
+	if err := otp.Init(store.DriverMemory, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer otp.Storage().Close()
+	records, _ := Read([]byte(plain), "", "")
+	result, err := Preview(records, PolicySkip)
+	if err != nil || result.Created != 1 || result.Skipped != 1 {
+		t.Fatalf("unexpected preview %+v, %v", result, err)
+	}
+	if e := result.Entries[0]; e.Issuer != "Example" || e.Type != "totp" || e.Period != 60 {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e := result.Entries[1]; e.Action != ActionSkip || e.Error == "" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+
+	// 不同服务的同名令牌分别导入，不支持的令牌跳过
+	backup := `[
+		{"secret":"JBSWY3DPEHPK3PXPJBSWY3DPEH","issuer":"GitHub","label":"alice","type":"TOTP"},
+		{"secret":"JBSWY3DPEHPK3PXPJBSWY3DPEH","issuer":"Google","label":"alice","type":"TOTP"},
+		{"secret":"JBSWY3DPEHPK3PXPJBSWY3DPEH","issuer":"Bank","label":"alice","type":"HOTP","counter":3}
+	]`
+	records, err = Read([]byte(backup), FormatAndOTP, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = Import(records, Options{})
+	if err != nil || result.Created != 2 || result.Skipped != 1 {
+		t.Fatalf("unexpected import %+v, %v", result, err)
+	}
+	for _, name := range []string{"GitHub:alice", "Google:alice"} {
+		if a, _ := otp.Get(name); a == nil {
+			t.Errorf("%s not imported", name)
+		}
+	}
+	if a, _ := otp.Get("Bank:alice"); a != nil {
+		t.Error("hotp token imported")
+	}
+
+	// 导入为用户的凭据，按用户分组导出
+	records, _ = Read([]byte(backup), FormatAndOTP, "")
+	if err := SetUser(records, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Import(records, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	exported, err := Export(context.Background(), "bob")
+	if err != nil || len(exported) != 2 || exported[0].Name != "bob:GitHub:alice" || exported[1].Name != "bob:Google:alice" {
+		t.Fatalf("unexpected credentials of bob %+v, %v", exported, err)
+	}
+	if err := SetUser(records, "a:b"); err == nil {
+		t.Error("expected an invalid user")
+	}
+}
+
+// sealAegis 按Aegis的vault格式加密db，主密钥由口令slot保护
+func sealAegis(t *testing.T, db, passphrase string) string {
+	encrypt := func(key, plaintext []byte) (nonce, tag, ciphertext string) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gcm, _ := cipher.NewGCM(block)
+		n := bytes.Repeat([]byte{1}, gcm.NonceSize())
+		sealed := gcm.Seal(nil, n, plaintext, nil)
+		body, tagBytes := sealed[:len(sealed)-16], sealed[len(sealed)-16:]
+		return hex.EncodeToString(n), hex.EncodeToString(tagBytes), string(body)
+	}
+	master := bytes.Repeat([]byte{7}, 32)
+	salt := bytes.Repeat([]byte{3}, 32)
+	key, err := scrypt.Key([]byte(passphrase), salt, 1024, 8, 1, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyNonce, keyTag, encryptedKey := encrypt(key, master)
+	dbNonce, dbTag, encryptedDB := encrypt(master, []byte(db))
+	return fmt.Sprintf(`{"version":1,"header":{"slots":[
+		{"type":2,"key":"00","key_params":{"nonce":"00","tag":"00"}},
+		{"type":1,"uuid":"1","key":%q,"key_params":{"nonce":%q,"tag":%q},"n":1024,"r":8,"p":1,"salt":%q}
+	],"params":{"nonce":%q,"tag":%q}},"db":%q}`,
+		hex.EncodeToString([]byte(encryptedKey)), keyNonce, keyTag, hex.EncodeToString(salt),
+		dbNonce, dbTag, base64.StdEncoding.EncodeToString([]byte(encryptedDB)))
+}